@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"vendored/apid"
+)
+
+/*********************
+ *   Configuration   *
+ *********************/
+
+/*
+settings are read in three layers: the defaults below, then the json file
+given with -config (or DAPI_CONFIG), then environment variables. every
+value can be set from the environment by its json path in capitals under
+DAPI_, so db.max_open_conns is DAPI_DB_MAX_OPEN_CONNS. lists are comma
+separated and maps are comma separated name=value pairs.
+
+secrets can be kept out of the file and the environment by pointing
+db.dsn_file, db.password_file, or auth.tokens_file at a file holding them.
+*/
+
+// the mask shown in place of secrets
+const masked = "********"
+
+// Config is everything dapi needs to start
+type Config struct {
+	Listen string `json:"listen"`
+
+	// ShutdownTimeout is how long open transactions and requests get to
+	// finish on SIGTERM
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	DB     DBConfig    `json:"db"`
+	API    APIConfig   `json:"api"`
+	Policy apid.Policy `json:"policy"`
+	Auth   AuthConfig  `json:"auth"`
+	CORS   CORSConfig  `json:"cors"`
+	Log    LogConfig   `json:"log"`
+}
+
+// DBConfig is the connection and its pool. DSN overrides the other
+// connection settings.
+type DBConfig struct {
+	DSN          string   `json:"dsn"`
+	DSNFile      string   `json:"dsn_file"`
+	Host         string   `json:"host"`
+	Port         string   `json:"port"`
+	User         string   `json:"user"`
+	Password     string   `json:"password"`
+	PasswordFile string   `json:"password_file"`
+	Name         string   `json:"name"`
+	Schemas      []string `json:"schemas"`
+
+	MaxOpenConns    int      `json:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+}
+
+// APIConfig is the Apid settings
+type APIConfig struct {
+	DecimalsAsNumbers  bool              `json:"decimals_as_numbers"`
+	MaxTransactions    int               `json:"max_transactions"`
+	TransactionTimeout Duration          `json:"transaction_timeout"`
+	WritableViews      bool              `json:"writable_views"`
+	MaxNesting         int               `json:"max_nesting"`
+	MaxBodyBytes       int               `json:"max_body_bytes"`
+	NodeName           string            `json:"node_name"`
+	Peers              map[string]string `json:"peers"`
+}
+
+// AuthConfig lists the bearer tokens that may use the api. With none,
+// anyone can.
+type AuthConfig struct {
+	Tokens     []string `json:"tokens"`
+	TokensFile string   `json:"tokens_file"`
+}
+
+// CORSConfig lists the origins browsers may call the api from, * for any
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// LogConfig is where the log goes, stderr if File is empty
+type LogConfig struct {
+	File string `json:"file"`
+}
+
+// Duration reads and writes time.Duration as a string such as "30s"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("durations are strings such as \"30s\"")
+	}
+	return d.set(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("bad duration (%s), use a number with a unit such as 30s or 5m", s)
+	}
+	d.Duration = v
+	return nil
+}
+
+// DefaultConfig is used for anything the file and environment leave out
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:          ":9000",
+		ShutdownTimeout: Duration{30 * time.Second},
+		DB:              DBConfig{Name: "test_db"},
+	}
+}
+
+// LoadConfig reads the file, if any, over the defaults, then the
+// environment, then any secret files, and validates the result
+func LoadConfig(file string, env func(string) (string, bool)) (*Config, error) {
+	c := DefaultConfig()
+	if len(file) > 0 {
+		if err := c.readFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if err := setFromEnv(reflect.ValueOf(c).Elem(), "DAPI", env); err != nil {
+		return nil, err
+	}
+	if err := c.readSecrets(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readFile decodes the json file, refusing settings it doesn't know
+func (c *Config) readFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("config: %s", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		var syntax *json.SyntaxError
+		var typ *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntax):
+			return fmt.Errorf("config %s line %d: %s", file, lineOf(b, syntax.Offset), syntax)
+		case errors.As(err, &typ):
+			return fmt.Errorf("config %s line %d: %s should be a %s, not a %s", file, lineOf(b, typ.Offset), typ.Field, typ.Type, typ.Value)
+		}
+		return fmt.Errorf("config %s: %s", file, err)
+	}
+	return nil
+}
+
+// lineOf is the line holding offset
+func lineOf(b []byte, offset int64) int {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	return bytes.Count(b[:offset], []byte("\n")) + 1
+}
+
+// setFromEnv sets each field of v from the environment variable named
+// after its json path
+func setFromEnv(v reflect.Value, prefix string, env func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.SplitN(v.Type().Field(i).Tag.Get("json"), ",", 2)[0]
+		if len(name) == 0 || name == "-" {
+			continue
+		}
+		key := prefix + "_" + strings.ToUpper(name)
+		f := v.Field(i)
+
+		if f.Kind() == reflect.Struct && f.Type() != reflect.TypeOf(Duration{}) {
+			if err := setFromEnv(f, key, env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok := env(key)
+		if !ok {
+			continue
+		}
+		if err := setValue(f, s); err != nil {
+			return fmt.Errorf("config %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// setValue parses s into a config field
+func setValue(f reflect.Value, s string) error {
+	if d, ok := f.Addr().Interface().(*Duration); ok {
+		return d.set(s)
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("bad bool (%s), use true or false", s)
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("bad number (%s)", s)
+		}
+		f.SetInt(int64(n))
+	case reflect.Slice:
+		list := make([]string, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				list = append(list, item)
+			}
+		}
+		f.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		m := make(map[string]string)
+		for _, pair := range strings.Split(s, ",") {
+			if pair = strings.TrimSpace(pair); len(pair) == 0 {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || len(kv[0]) == 0 {
+				return fmt.Errorf("bad pair (%s), use name=value", pair)
+			}
+			m[kv[0]] = kv[1]
+		}
+		f.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("can't be set from the environment")
+	}
+	return nil
+}
+
+// readSecrets fills in secrets from their files
+func (c *Config) readSecrets() error {
+	read := func(setting, file string, both bool) (string, error) {
+		if both {
+			return "", fmt.Errorf("config: set only one of %s and %s_file", setting, setting)
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("config %s_file: %s", setting, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	var err error
+	if len(c.DB.DSNFile) > 0 {
+		if c.DB.DSN, err = read("db.dsn", c.DB.DSNFile, len(c.DB.DSN) > 0); err != nil {
+			return err
+		}
+	}
+	if len(c.DB.PasswordFile) > 0 {
+		if c.DB.Password, err = read("db.password", c.DB.PasswordFile, len(c.DB.Password) > 0); err != nil {
+			return err
+		}
+	}
+	if len(c.Auth.TokensFile) > 0 {
+		tokens, err := read("auth.tokens", c.Auth.TokensFile, len(c.Auth.Tokens) > 0)
+		if err != nil {
+			return err
+		}
+		for _, t := range strings.Split(tokens, "\n") {
+			if t = strings.TrimSpace(t); len(t) > 0 {
+				c.Auth.Tokens = append(c.Auth.Tokens, t)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks every setting, listing everything that's wrong
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		add("listen (%s) should be host:port or :port", c.Listen)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		add("listen (%s) has a bad port", c.Listen)
+	}
+
+	if len(c.DB.DSN) > 0 {
+		if !strings.Contains(c.DB.DSN, "/") {
+			add("db.dsn should look like user:password@tcp(host:port)/dbname")
+		}
+	} else {
+		if len(c.DB.Name) == 0 {
+			add("db.name is required without db.dsn")
+		}
+		if len(c.DB.Port) > 0 {
+			if n, err := strconv.Atoi(c.DB.Port); err != nil || n <= 0 || n > 65535 {
+				add("db.port (%s) should be a number from 1 to 65535", c.DB.Port)
+			}
+		}
+	}
+	for _, s := range c.DB.Schemas {
+		if strings.ContainsAny(s, "`./ ") {
+			add("db.schemas has a bad schema name (%s)", s)
+		}
+	}
+
+	for name, n := range map[string]int{
+		"db.max_open_conns":    c.DB.MaxOpenConns,
+		"db.max_idle_conns":    c.DB.MaxIdleConns,
+		"api.max_transactions": c.API.MaxTransactions,
+	} {
+		if n < 0 {
+			add("%s (%d) can't be negative", name, n)
+		}
+	}
+	if c.ShutdownTimeout.Duration < 0 {
+		add("shutdown_timeout (%s) can't be negative", c.ShutdownTimeout)
+	}
+	if c.DB.ConnMaxLifetime.Duration < 0 {
+		add("db.conn_max_lifetime (%s) can't be negative", c.DB.ConnMaxLifetime)
+	}
+	if c.API.TransactionTimeout.Duration < 0 {
+		add("api.transaction_timeout (%s) can't be negative", c.API.TransactionTimeout)
+	}
+	for name, base := range c.API.Peers {
+		if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+			add("api.peers %s (%s) should be a url such as http://host:9000", name, base)
+		}
+	}
+
+	for _, t := range c.Auth.Tokens {
+		if len(strings.TrimSpace(t)) == 0 {
+			add("auth.tokens can't have an empty token")
+			break
+		}
+	}
+
+	for _, o := range c.CORS.AllowedOrigins {
+		if o != "*" && !strings.Contains(o, "://") {
+			add("cors.allowed_origins (%s) should be * or an origin such as https://example.com", o)
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// DataSourceName is the connection to open
+func (c *Config) DataSourceName() *apid.DataSourceName {
+	return &apid.DataSourceName{
+		DBName:   c.DB.Name,
+		Host:     c.DB.Host,
+		Port:     c.DB.Port,
+		User:     c.DB.User,
+		Password: c.DB.Password,
+		Raw:      c.DB.DSN,
+	}
+}
+
+// Masked is a copy of the config with its secrets hidden, for printing
+func (c *Config) Masked() *Config {
+	m := *c
+	if len(m.DB.Password) > 0 {
+		m.DB.Password = masked
+	}
+	m.DB.DSN = maskDSN(m.DB.DSN)
+	tokens := make([]string, 0, len(m.Auth.Tokens))
+	for range m.Auth.Tokens {
+		tokens = append(tokens, masked)
+	}
+	m.Auth.Tokens = tokens
+	return &m
+}
+
+// maskDSN hides the password in user:password@tcp(host)/dbname
+func maskDSN(dsn string) string {
+	at := strings.LastIndex(dsn, "@")
+	if at < 0 {
+		return dsn
+	}
+	colon := strings.Index(dsn[:at], ":")
+	if colon < 0 {
+		return dsn
+	}
+	return dsn[:colon+1] + masked + dsn[at:]
+}
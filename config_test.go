@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writes a file in a temp dir and returns its path
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// an environment of just the given variables
+func testEnv(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := writeFile(t, "dapi.json", `{
+		"listen": ":8080",
+		"db": {"host": "db", "port": "3306", "user": "dapi", "name": "shop", "max_open_conns": 10},
+		"api": {"transaction_timeout": "1m"},
+		"policy": {"hidden": ["*.password_hash"]}
+	}`)
+	password := writeFile(t, "password", "s3cret\n")
+
+	c, err := LoadConfig(file, testEnv(map[string]string{
+		"DAPI_LISTEN":               ":9090",
+		"DAPI_DB_PASSWORD_FILE":     password,
+		"DAPI_DB_SCHEMAS":           "shop, crm",
+		"DAPI_DB_CONN_MAX_LIFETIME": "5m",
+		"DAPI_API_WRITABLE_VIEWS":   "true",
+		"DAPI_API_PEERS":            "a=http://a:9000,b=http://b:9000",
+		"DAPI_POLICY_EXCLUDE":       "audit_*",
+		"DAPI_NOT_A_SETTING":        "ignored",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"listen", c.Listen, ":9090"},
+		{"db.host", c.DB.Host, "db"},
+		{"db.password", c.DB.Password, "s3cret"},
+		{"db.schemas", c.DB.Schemas, []string{"shop", "crm"}},
+		{"db.max_open_conns", c.DB.MaxOpenConns, 10},
+		{"db.conn_max_lifetime", c.DB.ConnMaxLifetime.Duration, 5 * time.Minute},
+		{"api.transaction_timeout", c.API.TransactionTimeout.Duration, time.Minute},
+		{"api.writable_views", c.API.WritableViews, true},
+		{"api.peers", c.API.Peers, map[string]string{"a": "http://a:9000", "b": "http://b:9000"}},
+		{"policy.hidden", c.Policy.Hidden, []string{"*.password_hash"}},
+		{"policy.exclude", c.Policy.Exclude, []string{"audit_*"}},
+	} {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s - got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+	if g, w := c.DataSourceName().String(), "dapi:s3cret@tcp(db:3306)/shop"; g != w {
+		t.Errorf("got dsn (%s), want (%s)", g, w)
+	}
+
+	// defaults with no file
+	c, err = LoadConfig("", testEnv(nil))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if c.Listen != ":9000" || c.DB.Name != "test_db" {
+		t.Errorf("got listen (%s) and db.name (%s), want the defaults", c.Listen, c.DB.Name)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	var tests = []struct {
+		file string
+		env  map[string]string
+		want []string
+	}{
+		{`{"listen": ":9000",}`, nil, []string{"line 1", "invalid character"}},
+		{"{\n\"db\": {\n\"max_open_conns\": \"ten\"}}", nil, []string{"line 3", "db.max_open_conns should be a int"}},
+		{`{"db": {"nmae": "shop"}}`, nil, []string{`unknown field "nmae"`}},
+		{`{"api": {"transaction_timeout": 30}}`, nil, []string{`durations are strings`}},
+		{`{}`, map[string]string{"DAPI_DB_PORT": "abc", "DAPI_LISTEN": "9000"}, []string{"db.port (abc)", "listen (9000)"}},
+		{`{}`, map[string]string{"DAPI_DB_MAX_IDLE_CONNS": "-1"}, []string{"db.max_idle_conns (-1) can't be negative"}},
+		{`{}`, map[string]string{"DAPI_API_MAX_NESTING": "two"}, []string{"DAPI_API_MAX_NESTING", "bad number (two)"}},
+		{`{}`, map[string]string{"DAPI_API_TRANSACTION_TIMEOUT": "30"}, []string{"DAPI_API_TRANSACTION_TIMEOUT", "bad duration (30)"}},
+		{`{}`, map[string]string{"DAPI_API_PEERS": "a"}, []string{"DAPI_API_PEERS", "bad pair (a)"}},
+		{`{}`, map[string]string{"DAPI_API_PEERS": "a=b:9000"}, []string{"api.peers a (b:9000)"}},
+		{`{}`, map[string]string{"DAPI_CORS_ALLOWED_ORIGINS": "example.com"}, []string{"cors.allowed_origins (example.com)"}},
+		{`{}`, map[string]string{"DAPI_DB_NAME": ""}, []string{"db.name is required"}},
+		{`{"auth": {"tokens": ["t0ken", ""]}}`, nil, []string{"auth.tokens can't have an empty token"}},
+		{`{"db": {"password": "x"}}`, map[string]string{"DAPI_DB_PASSWORD_FILE": "/nope"}, []string{"set only one of db.password and db.password_file"}},
+		{`{}`, map[string]string{"DAPI_DB_DSN_FILE": "/no/such/file"}, []string{"db.dsn_file", "no such file"}},
+	}
+
+	for _, test := range tests {
+		_, err := LoadConfig(writeFile(t, "dapi.json", test.file), testEnv(test.env))
+		if err == nil {
+			t.Errorf("%s %v - expected an error", test.file, test.env)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s %v - got error (%s), want it to mention (%s)", test.file, test.env, err, want)
+			}
+		}
+	}
+
+	if _, err := LoadConfig("/no/such/dapi.json", testEnv(nil)); err == nil {
+		t.Errorf("a missing config file should be an error")
+	}
+}
+
+func TestMaskedConfig(t *testing.T) {
+	c := DefaultConfig()
+	c.DB.Password = "s3cret"
+	c.DB.DSN = "dapi:s3cret@tcp(db:3306)/shop?parseTime=true"
+	c.Auth.Tokens = []string{"t0ken"}
+
+	j, err := json.Marshal(c.Masked())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(j), "s3cret") || strings.Contains(string(j), "t0ken") {
+		t.Errorf("secrets should be masked, got %s", j)
+	}
+	if !strings.Contains(string(j), `dapi:********@tcp(db:3306)/shop?parseTime=true`) {
+		t.Errorf("the dsn should only have its password masked, got %s", j)
+	}
+	if c.DB.Password != "s3cret" || c.Auth.Tokens[0] != "t0ken" {
+		t.Errorf("masking should leave the config alone")
+	}
+}
+
+func TestAuthAndCORS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := withCORS([]string{"https://example.com"}, withAuth([]string{"t0ken"}, ok))
+
+	for _, test := range []struct {
+		method, auth, origin string
+		code                 int
+		allowOrigin          string
+	}{
+		{"GET", "", "", http.StatusUnauthorized, ""},
+		{"GET", "Bearer nope", "", http.StatusUnauthorized, ""},
+		{"GET", "t0ken", "", http.StatusUnauthorized, ""},
+		{"GET", "Basic t0ken", "", http.StatusUnauthorized, ""},
+		{"GET", "Bearer ", "", http.StatusUnauthorized, ""},
+		{"GET", "Bearer t0ken", "", http.StatusOK, ""},
+		{"GET", "bearer t0ken", "", http.StatusOK, ""},
+		{"GET", "Bearer t0ken", "https://example.com", http.StatusOK, "https://example.com"},
+		{"GET", "Bearer t0ken", "https://evil.com", http.StatusOK, ""},
+		{"OPTIONS", "", "https://example.com", http.StatusNoContent, "https://example.com"},
+	} {
+		req, _ := http.NewRequest(test.method, "/api/v1/crud/user", nil)
+		if len(test.auth) > 0 {
+			req.Header.Set("Authorization", test.auth)
+		}
+		if len(test.origin) > 0 {
+			req.Header.Set("Origin", test.origin)
+			req.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != test.code {
+			t.Errorf("%s %s %s - got status %d, want %d", test.method, test.auth, test.origin, rw.Code, test.code)
+		}
+		if test.code == http.StatusUnauthorized {
+			if g, w := rw.Header().Get("Content-Type"), "application/problem+json"; g != w {
+				t.Errorf("%s %s - got content type (%s), want (%s)", test.method, test.auth, g, w)
+			}
+			if g := rw.Header().Get("WWW-Authenticate"); g != "Bearer" {
+				t.Errorf("%s %s - got WWW-Authenticate (%s), want (Bearer)", test.method, test.auth, g)
+			}
+			if !strings.Contains(rw.Body.String(), `"status":401`) {
+				t.Errorf("%s %s - got body %s, want a 401 problem", test.method, test.auth, rw.Body.String())
+			}
+		}
+		if g := rw.Header().Get("Access-Control-Allow-Origin"); g != test.allowOrigin {
+			t.Errorf("%s %s %s - got allowed origin (%s), want (%s)", test.method, test.auth, test.origin, g, test.allowOrigin)
+		}
+	}
+
+	// without settings nothing is wrapped
+	if g := withCORS(nil, withAuth(nil, ok)); reflect.ValueOf(g).Pointer() != reflect.ValueOf(ok).Pointer() {
+		t.Errorf("no tokens and no origins should leave the handler alone")
+	}
+}
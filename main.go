@@ -1,45 +1,87 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
+	"os"
 
 	"vendored/apid"
 )
 
-var dbName, host, port, password, user, raw string
+var configFile string
+var printConfig bool
 
 func init() {
-	flag.StringVar(&dbName, "db_name", "test_db", "Mysql Database Name")
-	flag.StringVar(&host, "db_host", "", "Mysql Database Host")
-	flag.StringVar(&port, "db_port", "", "Mysql Database Port, usually 3306")
-	flag.StringVar(&password, "db_pw", "", "Mysql Database Password")
-	flag.StringVar(&user, "db_user", "", "Mysql Database Username")
-	flag.StringVar(&raw, "db_datasource", "", "Mysql Database Resource, overrides other settings: username:password@protocol(address)/dbname")
+	flag.StringVar(&configFile, "config", os.Getenv("DAPI_CONFIG"), "JSON config file. Any setting can be overridden with DAPI_ environment variables")
+	flag.BoolVar(&printConfig, "print-config", false, "Print the effective config, with secrets masked, and exit")
 }
 
 func main() {
 	flag.Parse()
+
+	config, err := LoadConfig(configFile, os.LookupEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		j, _ := json.MarshalIndent(config.Masked(), "", "    ")
+		os.Stdout.Write(append(j, '\n'))
+		return
+	}
+
+	if len(config.Log.File) > 0 {
+		f, err := os.OpenFile(config.Log.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
 	log.Println("Attempting to connect to DB...")
 
-	conn := &apid.DataSourceName{DBName: dbName, Host: host, Port: port, Password: password, User: user, Raw: raw}
+	conn := config.DataSourceName()
 	DB := apid.OpenDB(conn)
+	DB.SetMaxOpenConns(config.DB.MaxOpenConns)
+	if config.DB.MaxIdleConns > 0 {
+		// zero would mean none rather than the default
+		DB.SetMaxIdleConns(config.DB.MaxIdleConns)
+	}
+	DB.SetConnMaxLifetime(config.DB.ConnMaxLifetime.Duration)
 
 	log.Print("Connected to " + conn.DBName)
 
-	// grab all the table data. We can now easily remove any tables if we want
-	// we will prolly want to use this differently. This should prolly be done
-	// behind the scenes by having a NewApid() method
-	tables := apid.GetTables(DB)
-
-	// container object to expose the db and the tables at endpoints
-	myApid := &apid.Apid{DB: DB, Tables: tables}
+	opts := []apid.Option{
+		apid.WithPolicy(&config.Policy),
+		apid.WithTransactions(config.API.MaxTransactions, config.API.TransactionTimeout.Duration),
+		apid.WithMaxNesting(config.API.MaxNesting),
+		apid.WithMaxBodyBytes(int64(config.API.MaxBodyBytes)),
+		apid.WithPeers(config.API.NodeName, config.API.Peers),
+		apid.WithMiddleware(
+			func(h http.Handler) http.Handler { return withCORS(config.CORS.AllowedOrigins, h) },
+			func(h http.Handler) http.Handler { return withAuth(config.Auth.Tokens, h) },
+		),
+	}
+	// several schemas are keyed by schema.table
+	if len(config.DB.Schemas) > 0 {
+		opts = append(opts, apid.WithSchemas(config.DB.Schemas...))
+	}
+	if config.API.DecimalsAsNumbers {
+		opts = append(opts, apid.WithDecimalsAsNumbers())
+	}
+	if config.API.WritableViews {
+		opts = append(opts, apid.WithWritableViews())
+	}
 
-	// routing. how would we add custom endpoints from here?
-	router := myApid.NewRouter()
+	myApid, err := apid.New(DB, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// could wrap this and use a recover() to prevent
-	// panics from taking down the server?
-	http.ListenAndServe(":9000", router)
+	// serves until SIGTERM, then lets open transactions finish
+	if err := myApid.Run(config.Listen, config.ShutdownTimeout.Duration); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"vendored/apid"
+)
+
+// withAuth refuses requests without one of the bearer tokens. CORS
+// preflights carry no credentials, so they go through.
+func withAuth(tokens []string, next http.Handler) http.Handler {
+	if len(tokens) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" {
+			given, ok := bearerToken(r), false
+			for _, t := range tokens {
+				if len(given) > 0 && subtle.ConstantTimeCompare([]byte(given), []byte(t)) == 1 {
+					ok = true
+				}
+			}
+			if !ok {
+				status := http.StatusUnauthorized
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				apid.WriteProblem(w, r, &apid.Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: "a valid bearer token is required"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bearerToken is the token in an `Authorization: Bearer <token>` header,
+// empty for any other scheme
+func bearerToken(r *http.Request) string {
+	const scheme = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) {
+		return ""
+	}
+	return auth[len(scheme):]
+}
+
+// withCORS lets browsers on the allowed origins call the api
+func withCORS(origins []string, next http.Handler) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origin) > 0 && (allowed["*"] || allowed[origin]) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, Link, "+apid.TransactionHeader)
+			if r.Method == "OPTIONS" && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept, "+apid.TransactionHeader)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
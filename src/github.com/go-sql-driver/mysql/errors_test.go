@@ -10,6 +10,7 @@ package mysql
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"testing"
 )
@@ -40,3 +41,21 @@ func TestErrorsStrictIgnoreNotes(t *testing.T) {
 		dbt.mustExec("DROP TABLE IF EXISTS does_not_exist")
 	})
 }
+
+func TestMySQLErrIs(t *testing.T) {
+	infraErr := &MySQLError{Number: 1234, Message: "the server is on fire"}
+	otherInfraErr := &MySQLError{Number: 1234, Message: "the datacenter is flooded"}
+	if !errors.Is(infraErr, otherInfraErr) {
+		t.Errorf("expected errors to be the same: %+v %+v", infraErr, otherInfraErr)
+	}
+
+	differentCodeErr := &MySQLError{Number: 5678, Message: "the server is on fire"}
+	if errors.Is(infraErr, differentCodeErr) {
+		t.Fatalf("expected errors to be different: %+v %+v", infraErr, differentCodeErr)
+	}
+
+	nonMysqlErr := errors.New("not a mysql error")
+	if errors.Is(infraErr, nonMysqlErr) {
+		t.Fatalf("expected errors to be different: %+v %+v", infraErr, nonMysqlErr)
+	}
+}
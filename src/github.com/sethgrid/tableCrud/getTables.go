@@ -9,6 +9,9 @@ import (
 type Table struct {
 	Name string
 	Cols []*TableSchema
+
+	// Primary is the primary key in key order
+	Primary []string
 }
 
 type TableSchema struct {
@@ -95,6 +98,48 @@ func GetTables(db *sql.DB) map[string]*Table {
 			info := &TableSchema{TABLE_CATALOG, TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, ORDINAL_POSITION, COLUMN_DEFAULT, IS_NULLABLE, DATA_TYPE, CHARACTER_MAXIMUM_LENGTH, CHARACTER_OCTET_LENGTH, NUMERIC_PRECISION, NUMERIC_SCALE, DATETIME_PRECISION, CHARACTER_SET_NAME, COLLATION_NAME, COLUMN_TYPE, COLUMN_KEY, EXTRA, PRIVILEGES, COLUMN_COMMENT}
 			allTables[t].Cols = append(allTables[t].Cols, info)
 		}
+
+		if len(nextTable.Cols) > 0 {
+			nextTable.Primary = getPrimaryKey(db, nextTable.Cols[0].TABLE_SCHEMA.String, t)
+		}
 	}
 	return allTables
 }
+
+// getPrimaryKey returns the ordered primary key columns of a table
+func getPrimaryKey(db *sql.DB, schema, table string) []string {
+	r, err := db.Query(
+		"select COLUMN_NAME from information_schema.KEY_COLUMN_USAGE "+
+			"where TABLE_SCHEMA=? and TABLE_NAME=? and CONSTRAINT_NAME=\"PRIMARY\" "+
+			"order by ORDINAL_POSITION", schema, table)
+	if err != nil {
+		log.Fatal("unable to query primary key ", table, err)
+	}
+	defer r.Close()
+
+	pKeys := make([]string, 0)
+	for r.Next() {
+		var name string
+		if err := r.Scan(&name); err != nil {
+			log.Print("error scanning primary key ", err)
+			continue
+		}
+		pKeys = append(pKeys, name)
+	}
+	return pKeys
+}
+
+// primaryKeys returns the primary key columns, falling back to the PRI
+// columns in table order if the key was not introspected
+func (t *Table) primaryKeys() []string {
+	if len(t.Primary) > 0 {
+		return t.Primary
+	}
+	pKeys := make([]string, 0)
+	for _, col := range t.Cols {
+		if col.COLUMN_KEY.String == "PRI" {
+			pKeys = append(pKeys, col.COLUMN_NAME.String)
+		}
+	}
+	return pKeys
+}
@@ -146,20 +146,15 @@ func insertHelper(t *Table) string {
 	)
 }
 
-// Helper function to generate insert query
+// Helper function to generate update query
 func updateHelper(t *Table) string {
 	set := make([]string, 0)
 	val := make([]string, 0)
-	whereQ := ""
-	whereV := ""
 	for _, col := range t.Cols {
-		if col.COLUMN_KEY.String == "PRI" {
-			whereQ = col.COLUMN_NAME.String + "=?"
-			whereV = "u." + strings.Title(col.COLUMN_NAME.String)
-		}
 		set = append(set, col.COLUMN_NAME.String+"=?")
 		val = append(val, "u."+strings.Title(col.COLUMN_NAME.String))
 	}
+	whereQ, whereV := whereHelper(t)
 	return fmt.Sprintf(
 		"\"update %s set %s where %s\", %s, %s",
 		t.Name,
@@ -170,16 +165,9 @@ func updateHelper(t *Table) string {
 	)
 }
 
-// Helper function to generate insert query
+// Helper function to generate delete query
 func deleteHelper(t *Table) string {
-	whereQ := ""
-	whereV := ""
-	for _, col := range t.Cols {
-		if col.COLUMN_KEY.String == "PRI" {
-			whereQ = col.COLUMN_NAME.String + "=?"
-			whereV = "u." + strings.Title(col.COLUMN_NAME.String)
-		}
-	}
+	whereQ, whereV := whereHelper(t)
 	return fmt.Sprintf(
 		"\"delete from %s where %s\", %s",
 		t.Name,
@@ -188,6 +176,17 @@ func deleteHelper(t *Table) string {
 	)
 }
 
+// Helper function to match every primary key column, in key order
+func whereHelper(t *Table) (string, string) {
+	whereQ := make([]string, 0)
+	whereV := make([]string, 0)
+	for _, pKey := range t.primaryKeys() {
+		whereQ = append(whereQ, pKey+"=?")
+		whereV = append(whereV, "u."+strings.Title(pKey))
+	}
+	return strings.Join(whereQ, " and "), strings.Join(whereV, ",")
+}
+
 // Helper function to populate Scan arguments in template
 func joinComma(cols []*TableSchema) string {
 	conversion := make([]string, 0)
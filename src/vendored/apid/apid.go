@@ -5,7 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/julienschmidt/httprouter"
@@ -17,54 +21,214 @@ import (
 
 // the apid struct allows us to use the db at different endpoints
 type Apid struct {
-	DB     *sql.DB
-	Tables map[string]*Table
+	DB       *sql.DB
+	Tables   map[string]*Table
+	Routines map[string]*Routine
+
+	// DecimalsAsNumbers writes decimal columns as json numbers rather
+	// than strings. Either way the digits are exact.
+	DecimalsAsNumbers bool
+
+	// MaxTransactions caps how many transactions can be open at once.
+	// Zero uses DefaultMaxTransactions.
+	MaxTransactions int
+
+	// TransactionTimeout is how long an open transaction can sit idle
+	// before it is rolled back. Zero uses DefaultTransactionTimeout.
+	TransactionTimeout time.Duration
+
+	// MultiSchema serves the tables of several schemas at
+	// /api/v1/crud/:schema/:table, and their routines at
+	// /api/v1/rpc/:schema/:routine. Both are then keyed by schema.name, as
+	// GetSchemaTables and GetSchemaRoutines load them.
+	MultiSchema bool
+
+	// WritableViews lets updatable views take POST, PUT, PATCH, and
+	// DELETE. Other views are always read only.
+	WritableViews bool
+
+	// MaxNesting is how many relationships deep nested routes such as
+	// /api/v1/crud/user/:id/settings go. Zero uses DefaultMaxNesting and
+	// a negative number turns them off.
+	MaxNesting int
+
+	// NodeName identifies this instance in transaction tokens. Zero uses
+	// the hostname.
+	NodeName string
+
+	// Peers maps the node names of other instances to their base url
+	// (http://host:port) so transaction requests can be forwarded to the
+	// instance that owns the transaction.
+	Peers map[string]string
+
+	// Prefix is where the api is served. Zero uses DefaultPrefix.
+	Prefix string
+
+	// MaxBodyBytes is the largest request body taken. Larger bodies get a
+	// 413. Zero uses DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+
+	// set by New's options
+	schemas    []string
+	policy     *Policy
+	middleware []func(http.Handler) http.Handler
+	custom     []customRoute
+	logger     *log.Logger
+
+	serverMu sync.Mutex
+	server   *http.Server
+	listener net.Listener
+	served   chan error
+	draining int32
+
+	txOnce sync.Once
+	txs    *txRegistry
+
+	routesOnce sync.Once
+	routes     map[string]*nestedRoute
 }
 
 // returns all routing
 func (a *Apid) NewRouter() http.Handler {
 	// routing
 	router := httprouter.New()
-	router.GET("/", RootHandler)
+	router.GET("/", a.RootHandler)
 	router.GET("/favicon.ico", NullHandler) // chrome browser handler
-	router.GET("/api/v1/crud/:table/_meta", a.TableMetaHandler)
-
-	router.GET("/api/v1/crud/:table", a.GetTable)
-	router.POST("/api/v1/crud/:table", a.PostTable)
-	router.PUT("/api/v1/crud/:table", a.PutTable)
-	router.DELETE("/api/v1/crud/:table", a.DeleteTable)
-
-	router.GET("/api/v1/transaction", GetTransaction)
-	router.POST("/api/v1/transaction", PostTransaction)
-	router.PUT("/api/v1/transaction", PutTransaction)
-	router.DELETE("/api/v1/transaction", DeleteTransaction)
+	api := a.prefix()
+	crud := api + "/crud/:table"
+	if a.MultiSchema {
+		// GetSchema serves /api/v1/crud/_meta
+		router.GET(api+"/crud/:schema", a.GetSchema)
+		crud = api + "/crud/:schema/:table"
+	}
+	router.GET(crud, a.GetTable)
+	router.POST(crud, a.PostTable)
+	router.PUT(crud, a.PutTable)
+	router.DELETE(crud, a.DeleteTable)
+
+	// GetRecord also serves /api/v1/crud/:table/_meta
+	router.GET(crud+"/:id", a.GetRecord)
+	router.PUT(crud+"/:id", a.PutRecord)
+	router.PATCH(crud+"/:id", a.PatchRecord)
+	router.DELETE(crud+"/:id", a.DeleteRecord)
+
+	// child rows through relationships, /api/v1/crud/user/26/settings
+	router.GET(crud+"/:id/*path", a.GetNested)
+	router.POST(crud+"/:id/*path", a.PostNested)
+
+	// GetRoutine also serves /api/v1/rpc/_meta
+	rpc := api + "/rpc/:routine"
+	if a.MultiSchema {
+		// GetRoutineSchema serves /api/v1/rpc/_meta
+		router.GET(api+"/rpc/:schema", a.GetRoutineSchema)
+		rpc = api + "/rpc/:schema/:routine"
+	}
+	router.GET(rpc, a.GetRoutine)
+	router.GET(rpc+"/_meta", a.RoutineMetaHandler)
+	router.POST(rpc, a.PostRoutine)
+
+	router.GET(api+"/transaction", a.GetTransaction)
+	router.POST(api+"/transaction", a.PostTransaction)
+	router.PUT(api+"/transaction", a.PutTransaction)
+	router.DELETE(api+"/transaction", a.DeleteTransaction)
+
+	// endpoints added with WithRoute
+	for _, c := range a.custom {
+		router.Handle(c.method, c.path, c.handle)
+	}
 
 	// use our own NotFound Handler
 	router.NotFound = NotFound
 	router.RedirectTrailingSlash = true
 
-	return router
+	// send requests for transactions we don't own to the owning instance,
+	// and keep serving through a panic
+	return a.withLogger(recoverPanics(a.routeTransactions(router)))
+}
+
+// tableKey is the key in Tables for the table named in the url
+func (a *Apid) tableKey(t httprouter.Params) string {
+	return tableKey(t.ByName("schema"), t.ByName("table"), a.MultiSchema)
+}
+
+// tableParams are the url params naming a table, the reverse of tableKey
+func (a *Apid) tableParams(key string) httprouter.Params {
+	t := a.Tables[key]
+	if a.MultiSchema {
+		return httprouter.Params{{Key: "schema", Value: t.Schema}, {Key: "table", Value: t.baseName()}}
+	}
+	return httprouter.Params{{Key: "table", Value: key}}
+}
+
+// tablePath is the url of a table
+func (a *Apid) tablePath(t *Table) string {
+	if a.MultiSchema {
+		return a.prefix() + "/crud/" + t.Schema + "/" + t.baseName()
+	}
+	return a.prefix() + "/crud/" + t.Name
+}
+
+// GetSchema serves /api/v1/crud/_meta in multi-schema mode, where it
+// shares a route with the schema
+func (a *Apid) GetSchema(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	if t.ByName("schema") != "_meta" {
+		NotFound(w, r)
+		return
+	}
+	a.MetaHandler(w, r, nil)
+}
+
+// GetRoutineSchema serves /api/v1/rpc/_meta in multi-schema mode, where it
+// shares a route with the schema
+func (a *Apid) GetRoutineSchema(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	if t.ByName("schema") != "_meta" {
+		NotFound(w, r)
+		return
+	}
+	a.GetRoutine(w, r, httprouter.Params{{Key: "routine", Value: "_meta"}})
 }
 
 // specifically used for handling chrome browser seeking the favicon
 func NullHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}
 
 // just handles the `/` endpoint
-func RootHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	log.Print("index handler")
-	w.Write([]byte("Root. Available paths: /api/v1/crud/_meta, /api/v1/crud/:table, /api/v1/crud/:table/_meta"))
+func (a *Apid) RootHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a.log().Print("index handler")
+	api := a.prefix()
+	crud, rpc := api+"/crud/:table", api+"/rpc/:routine"
+	if a.MultiSchema {
+		crud, rpc = api+"/crud/:schema/:table", api+"/rpc/:schema/:routine"
+	}
+	paths := []string{api + "/crud/_meta", crud, crud + "/_meta", crud + "/:id"}
+	paths = append(paths, a.routePaths("")...)
+	paths = append(paths, api+"/rpc/_meta", rpc, rpc+"/_meta")
+	w.Write([]byte("Root. Available paths: " + strings.Join(paths, ", ")))
 }
 
-// standard 404 page
-func NotFound(w http.ResponseWriter, r *http.Request) {
-	log.Printf("404 - %s %s", r.Method, r.RequestURI)
-	http.Error(w, "resource does not exist", http.StatusNotFound)
+// writable is false for read only tables, which includes views unless
+// WritableViews is set and the view is updatable
+func (a *Apid) writable(t *Table) bool {
+	if a.WritableViews && t.View && t.Updatable {
+		return true
+	}
+	return !t.ReadOnly
 }
 
-// 404 page to which we can pass a message string
-func NotFoundWithParams(w http.ResponseWriter, r *http.Request, e string) {
-	log.Printf("404 - %s %s", r.Method, r.RequestURI)
-	http.Error(w, e, http.StatusNotFound)
+// methods are the methods a table is served with
+func (a *Apid) methods(t *Table) []string {
+	if !a.writable(t) {
+		return []string{"GET"}
+	}
+	return []string{"GET", "POST", "PUT", "DELETE"}
+}
+
+// refuseWrite sends a 405 for writes to read only tables
+func (a *Apid) refuseWrite(w http.ResponseWriter, r *http.Request, t *Table) bool {
+	if a.writable(t) {
+		return false
+	}
+	MethodNotAllowed(w, r, a.methods(t))
+	return true
 }
 
 // GetTable forwards _meta requests onward. Otherwise, it checks
@@ -73,13 +237,13 @@ func NotFoundWithParams(w http.ResponseWriter, r *http.Request, e string) {
 func (a *Apid) GetTable(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
 	// forward to MetaHandler
 	if t.ByName("table") == "_meta" {
-		log.Print("loading meta handler")
-		a.MetaHandler(w, r, nil)
+		a.log().Print("loading meta handler")
+		a.MetaHandler(w, r, t)
 		return
 	}
 
 	// verify table name validity
-	tableName := t.ByName("table")
+	tableName := a.tableKey(t)
 	if _, ok := a.Tables[tableName]; !ok {
 		NotFoundWithParams(w, r, fmt.Sprintf("table (%s) not found", tableName))
 		return
@@ -87,57 +251,75 @@ func (a *Apid) GetTable(w http.ResponseWriter, r *http.Request, t httprouter.Par
 
 	// query the table
 	table := a.Tables[tableName]
-	query, args := a.SelectQueryComposer(table.Name, r)
-
-	rows, err := a.DB.Query(query, args...)
-
+	query, args, err := a.SelectQueryComposer(table.Name, r)
 	if err != nil {
-		log.Printf("Error querying GET on %s", table.Name)
-		NotFoundWithParams(w, r, fmt.Sprintf("GET request failed on %s", table.Name))
+		sendError(w, r, err)
 		return
 	}
 
-	// grab all the column names returned and prepare them
-	// to receive data
-	columnNames, err := rows.Columns()
+	db, release, err := a.conn(r)
 	if err != nil {
-		log.Fatalln(err) // or 500, whatever error handling is appropriate
+		sendError(w, r, err)
+		return
 	}
-	columns := make([]interface{}, len(columnNames))
-	columnPointers := make([]interface{}, len(columnNames))
-	for i := 0; i < len(columnNames); i++ {
-		columnPointers[i] = &columns[i]
+	defer release()
+
+	// unpaged results can be any size, so they are written as they are read
+	if !isPaged(r.URL.Query()) {
+		a.streamTable(w, r, db, table, query, args)
+		return
+	}
+
+	// the query is cancelled if the client goes away
+	rows, err := db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+		return
 	}
+	defer rows.Close()
 
 	// to become the json response object
-	responses := make([]map[string]interface{}, 0)
+	responses, err := a.scanRows(rows, table)
+	if err != nil {
+		sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+		return
+	}
 
-	// populate json object from rows
-	for rows.Next() {
-		resp := make(map[string]interface{})
-		if err := rows.Scan(columnPointers...); err != nil {
-			log.Fatalln(err)
-		}
+	// nest any related rows asked for
+	if err := a.expand(r.Context(), db, table.Name, r.URL.Query(), responses); err != nil {
+		sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+		return
+	}
 
-		for i, data := range columns {
-			// Here we could do some type checking to get
-			// int, bool, etc. Defaulting always to string.
-			if v, ok := data.(int64); ok {
-				resp[columnNames[i]] = v
-			} else if v, ok := data.([]byte); ok {
-				resp[columnNames[i]] = string(v)
+	// counts, cursors, and links for the page
+	p, err := a.paginate(db, r, table.Name, responses)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	p.setHeaders(w)
+
+	if wantsNDJSON(r) {
+		a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+		rw := newRowWriter(w, true)
+		for _, row := range responses {
+			if err := rw.write(row); err != nil {
+				a.log().Printf("Error writing GET on %s: %s", table.Name, err)
+				return
 			}
 		}
-		responses = append(responses, resp)
+		rw.end()
+		return
 	}
 
-	j, err := json.Marshal(responses)
+	j, err := json.Marshal(p.body(r.URL.Query()))
 	if err != nil {
-		log.Fatal(err)
+		sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+		return
 	}
 
 	// this should be pulled out into a function. We should have success and fail handlers.
-	log.Printf("200 - %s %s", r.Method, r.RequestURI)
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(j))
 
@@ -145,30 +327,40 @@ func (a *Apid) GetTable(w http.ResponseWriter, r *http.Request, t httprouter.Par
 
 // PostTable inserts a record
 func (a *Apid) PostTable(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
-	tableName := t.ByName("table")
+	tableName := a.tableKey(t)
 	if _, ok := a.Tables[tableName]; !ok {
 		NotFoundWithParams(w, r, fmt.Sprintf("table (%s) not found", tableName))
 		return
 	}
 	table := a.Tables[tableName]
+	if a.refuseWrite(w, r, table) {
+		return
+	}
 
 	// should we look for the primary key and weed it out?
-	q, args, err := InsertQueryComposer(table.Name, r)
+	q, args, err := a.InsertQueryComposer(table.Name, r)
 	if err != nil {
-		NotFoundWithParams(w, r, err.Error())
+		sendError(w, r, err)
 		return
 	}
 
-	res, err := a.DB.Exec(q, args...)
+	db, release, err := a.conn(r)
 	if err != nil {
-		NotFoundWithParams(w, r, err.Error()+" :: "+q)
+		sendError(w, r, err)
+		return
+	}
+	defer release()
+
+	res, err := db.Exec(q, args...)
+	if err != nil {
+		sendError(w, r, withQuery(err, q))
 		return
 	}
 	insertId, err := res.LastInsertId()
 	if err != nil {
-		log.Printf("error ", err)
+		a.log().Print("error ", err)
 	}
-	log.Printf("200 - %s %s", r.Method, r.RequestURI)
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(fmt.Sprintf("{\"message\":\"success\", \"inserted_id\":%d}", insertId)))
@@ -176,41 +368,46 @@ func (a *Apid) PostTable(w http.ResponseWriter, r *http.Request, t httprouter.Pa
 
 // PutTable looks for the primary key and errors if missing. Updates records.
 func (a *Apid) PutTable(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
-	tableName := t.ByName("table")
+	tableName := a.tableKey(t)
 
 	if _, ok := a.Tables[tableName]; !ok {
 		NotFoundWithParams(w, r, fmt.Sprintf("table (%s) not found", tableName))
 		return
 	}
 	table := a.Tables[tableName]
+	if a.refuseWrite(w, r, table) {
+		return
+	}
 
-	pKey := ""
-	for _, c := range table.Cols {
-		if c.COLUMN_KEY.String == "PRI" {
-			pKey = c.COLUMN_NAME.String
-		}
+	pKeys := table.PrimaryKeys()
+	if len(pKeys) == 0 {
+		sendError(w, r, noPrimaryKey(tableName))
+		return
 	}
-	if len(pKey) == 0 {
-		NotFoundWithParams(w, r, fmt.Sprintf("Update table (%s), no primary key on table", tableName))
+
+	q, args, err := a.UpdateQueryComposer(table.Name, pKeys, r)
+	if err != nil {
+		sendError(w, r, err)
 		return
 	}
 
-	q, args, err := UpdateQueryComposer(table.Name, pKey, r)
+	db, release, err := a.conn(r)
 	if err != nil {
-		NotFoundWithParams(w, r, err.Error())
+		sendError(w, r, err)
 		return
 	}
+	defer release()
 
-	res, err := a.DB.Exec(q, args...)
+	res, err := db.Exec(q, args...)
 	if err != nil {
-		NotFoundWithParams(w, r, err.Error()+" :: "+q)
+		sendError(w, r, withQuery(err, q))
 		return
 	}
 	rowsAffected, err := res.RowsAffected()
 	if err != nil {
-		log.Printf("error ", err)
+		a.log().Print("error ", err)
 	}
-	log.Printf("200 - %s %s", r.Method, r.RequestURI)
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(fmt.Sprintf("{\"message\":\"success\", \"rows_affected\":%d}", rowsAffected)))
@@ -218,31 +415,96 @@ func (a *Apid) PutTable(w http.ResponseWriter, r *http.Request, t httprouter.Par
 
 // Delete table looks for a limit key. Deletes records.
 func (a *Apid) DeleteTable(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
-	tableName := t.ByName("table")
+	tableName := a.tableKey(t)
 
 	if _, ok := a.Tables[tableName]; !ok {
 		NotFoundWithParams(w, r, fmt.Sprintf("table (%s) not found", tableName))
 		return
 	}
 	table := a.Tables[tableName]
+	if a.refuseWrite(w, r, table) {
+		return
+	}
+
+	q, args, err := a.DeleteQueryComposer(table.Name, r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
 
-	q, args, err := DeleteQueryComposer(table.Name, r)
+	db, release, err := a.conn(r)
 	if err != nil {
-		NotFoundWithParams(w, r, err.Error())
+		sendError(w, r, err)
 		return
 	}
+	defer release()
 
-	res, err := a.DB.Exec(q, args...)
+	res, err := db.Exec(q, args...)
 	if err != nil {
-		NotFoundWithParams(w, r, err.Error()+" :: "+q)
+		sendError(w, r, withQuery(err, q))
 		return
 	}
 	rowsAffected, err := res.RowsAffected()
 	if err != nil {
-		log.Printf("error ", err)
+		a.log().Print("error ", err)
 	}
-	log.Printf("200 - %s %s", r.Method, r.RequestURI)
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(fmt.Sprintf("{\"message\":\"success\", \"rows_affected\":%d}", rowsAffected)))
 }
+
+// scanRows reads every row into a map of column name to json value, using
+// the table's column types. The caller is still responsible for closing rows.
+func (a *Apid) scanRows(rows *sql.Rows, table *Table) ([]map[string]interface{}, error) {
+	// to become the json response object
+	responses := make([]map[string]interface{}, 0)
+	err := a.eachRow(rows, table, func(resp map[string]interface{}) error {
+		responses = append(responses, resp)
+		return nil
+	})
+	return responses, err
+}
+
+// eachRow calls fn with each row as a map of column name to json value,
+// stopping at the first error
+func (a *Apid) eachRow(rows *sql.Rows, table *Table, fn func(map[string]interface{}) error) error {
+	// grab all the column names returned and prepare them
+	// to receive data
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	columns := make([]interface{}, len(columnNames))
+	columnPointers := make([]interface{}, len(columnNames))
+	for i := 0; i < len(columnNames); i++ {
+		columnPointers[i] = &columns[i]
+	}
+
+	// the schema for each returned column, nil if it isn't on the table
+	schemas := make([]*TableSchema, len(columnNames))
+	for i, name := range columnNames {
+		schemas[i] = table.Col(name)
+	}
+
+	// populate json object from rows
+	for rows.Next() {
+		resp := make(map[string]interface{})
+		if err := rows.Scan(columnPointers...); err != nil {
+			return err
+		}
+
+		for i, data := range columns {
+			v, err := jsonValue(schemas[i], data, a.DecimalsAsNumbers)
+			if err != nil {
+				return fmt.Errorf("%s: %s", columnNames[i], err)
+			}
+			resp[columnNames[i]] = v
+		}
+		if err := fn(resp); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
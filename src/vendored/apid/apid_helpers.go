@@ -3,7 +3,6 @@ package apid
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -20,60 +19,82 @@ type Meta struct {
 	SchemaType  string              `json:"type"`
 	Properties  map[string]Property `json:"properties"`
 	Required    []string            `json:"required"`
-	Primary     string              `json:"primary"`
+	Primary     []string            `json:"primary"`
+	Relations   []*Relation         `json:"relations"`
+	Routes      []string            `json:"routes"`
+	Parameters  []*Parameter        `json:"parameters,omitempty"`
 	Location    string              `json:"location"`
 	Method      string              `json:"method"`
 	Title       string              `json:"title"`
 	Notes       string              `json:"notes"`
 }
 
-// properties are each column on a table
+// describes the filter grammar in the meta notes
+const filterNotes = "Filter with col=val or col[op]=val, where op is one of eq, ne, gt, gte, lt, lte, like, nlike, in, between, or null. " +
+	"Prefix filters with or. (or orX., orY., ...) to OR them together."
+
+// properties are each column on a table, as json schema. Columns get the
+// same rules writes are validated with.
 type Property struct {
-	Description string `json:"description"`
-	DataType    string `json:"type"`
+	Description string      `json:"description"`
+	DataType    interface{} `json:"type"`
+	ColumnType  string      `json:"column_type,omitempty"`
+
+	MaxLength int           `json:"maxLength,omitempty"`
+	Minimum   json.Number   `json:"minimum,omitempty"`
+	Maximum   json.Number   `json:"maximum,omitempty"`
+	Enum      []interface{} `json:"enum,omitempty"`
+	Pattern   string        `json:"pattern,omitempty"`
+	Format    string        `json:"format,omitempty"`
 }
 
 // displayes the meta data for a single table
 func (a *Apid) TableMetaHandler(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
-	tableName := t.ByName("table")
+	tableName := a.tableKey(t)
 	if _, ok := a.Tables[tableName]; !ok {
 		NotFoundWithParams(w, r, fmt.Sprintf("No table (%s) found for _meta", tableName))
 		return
 	}
 
-	log.Printf("200 - %s %s", r.Method, r.RequestURI)
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
 	w.Header().Set("Content-Type", "application/json")
 
 	location := r.RequestURI[:len(r.RequestURI)-len("_meta")]
-	methods := []string{"GET", "POST", "PUT", "DELETE"}
 	schema := make([]Meta, 0)
-	for _, method := range methods {
-		schema = append(schema, GenMeta(a.Tables[tableName], location, method))
+	for _, method := range a.methods(a.Tables[tableName]) {
+		m := GenMeta(a.Tables[tableName], location, method)
+		m.Routes = a.routePaths(tableName)
+		schema = append(schema, m)
 	}
 	j, err := json.Marshal(schema)
 	if err != nil {
-		log.Printf("error making json schema ", err)
+		a.log().Print("error making json schema ", err)
 	}
 	w.Write(j)
 }
 
-// displays the meta data for the whole database
-func (a *Apid) MetaHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	log.Print("metaHandler")
+// displays the meta data for the whole database, or a single schema in
+// multi-schema mode
+func (a *Apid) MetaHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	a.log().Print("metaHandler")
 	wholeSchema := make([]Meta, 0)
-	methods := []string{"GET", "POST", "PUT", "DELETE"}
 
 	for _, t := range a.Tables {
-		for _, method := range methods {
-			location := r.RequestURI[:len(r.RequestURI)-len("_meta")] + t.Name
-			wholeSchema = append(wholeSchema, GenMeta(t, location, method))
+		if schema := p.ByName("schema"); len(schema) > 0 && t.Schema != schema {
+			continue
+		}
+		for _, method := range a.methods(t) {
+			location := a.tablePath(t)
+			m := GenMeta(t, location, method)
+			m.Routes = a.routePaths(t.Name)
+			wholeSchema = append(wholeSchema, m)
 		}
 	}
-	log.Printf("200 - %s %s", r.Method, r.RequestURI)
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
 	w.Header().Set("Content-Type", "application/json")
 	j, err := json.Marshal(wholeSchema)
 	if err != nil {
-		log.Printf("error making json whole schema ", err)
+		a.log().Print("error making json whole schema ", err)
 	}
 	w.Write(j)
 }
@@ -83,25 +104,41 @@ func GenMeta(table *Table, location, method string) Meta {
 	// this could all be initialized at startup, as oppposed to each call
 	properties := make(map[string]Property)
 	required := make([]string, 0)
-	primary := ""
 	schemaType := "object"
 	notes := ""
 
-	// get column info for properties
+	// get column info for properties, leaving out what the policy won't
+	// return (GET, DELETE) or accept (POST, PUT)
 	for _, c := range table.Cols {
+		name := c.COLUMN_NAME.String
+		switch method {
+		case "GET", "DELETE":
+			if table.WriteOnlyCols[name] {
+				continue
+			}
+		case "POST", "PUT":
+			if table.ReadOnlyCols[name] && !(method == "PUT" && c.COLUMN_KEY.String == "PRI") {
+				continue
+			}
+		}
+
 		p := Property{}
-		p.DataType = c.DATA_TYPE.String
 		p.Description = c.COLUMN_COMMENT.String
-
-		if c.COLUMN_KEY.String == "PRI" {
-			primary = c.COLUMN_NAME.String
+		p.ColumnType = c.COLUMN_TYPE.String
+		r := columnRule(c)
+		r.schema(&p)
+		if p.DataType == nil {
+			p.DataType = c.DATA_TYPE.String
 		}
 
-		if c.IS_NULLABLE.String == "NO" {
-			// TODO: refactor to get this POST logic down into the switch
-			if !((method == "POST" || method == "GET") && c.COLUMN_KEY.String == "PRI") {
-				required = append(required, c.COLUMN_NAME.String)
+		// POST requires what an insert is validated to need
+		switch {
+		case method == "POST":
+			if r.required {
+				required = append(required, name)
 			}
+		case c.IS_NULLABLE.String == "NO" && !(method == "GET" && c.COLUMN_KEY.String == "PRI"):
+			required = append(required, name)
 		}
 
 		properties[c.COLUMN_NAME.String] = p
@@ -110,12 +147,22 @@ func GenMeta(table *Table, location, method string) Meta {
 	switch method {
 	case "GET":
 		properties["limit"] = Property{DataType: "int", Description: "Used to limit the number of results returned"}
-		properties["offset"] = Property{DataType: "int", Description: "Used to offset results returned"}
+		properties["offset"] = Property{DataType: "int", Description: "Used to offset results returned, with a limit"}
+		properties["orderby"] = Property{DataType: "string", Description: "Comma separated columns to order results by, prefix with - for descending. Defaults to the primary key"}
+		properties["fields"] = Property{DataType: "string", Description: "Comma separated columns to return. Defaults to all columns"}
+		properties["exclude"] = Property{DataType: "string", Description: "Comma separated columns to leave out of results"}
+		properties["count"] = Property{DataType: "string", Description: "exact or estimated. Returns the number of matching records in the X-Total-Count header"}
+		properties["envelope"] = Property{DataType: "bool", Description: "Wrap results in an object with data, meta, and links"}
+		properties["cursor"] = Property{DataType: "string", Description: "Opaque keyset paging token. Send it empty for the first page, then send the next_cursor of each page"}
+		properties["expand"] = Property{DataType: "string", Description: "Comma separated relationships to nest in each result. Limit their fields with relationship.column in fields and exclude"}
+		notes = filterNotes
 	case "POST":
 	case "PUT":
+		notes = "Without the primary key, records matching the query string filters are updated. " + filterNotes
 	case "DELETE":
 		properties["limit"] = Property{DataType: "int", Description: "Used to limit the number of records deleted"}
 		required = append(required, "limit")
+		notes = filterNotes
 	}
 
 	// init schema struct
@@ -123,8 +170,16 @@ func GenMeta(table *Table, location, method string) Meta {
 	schema.Title = table.Name
 	schema.Properties = properties
 	schema.Description = "MySQL Table " + table.Name
+	if table.View {
+		schema.Description = "MySQL View " + table.Name
+	}
 	schema.Location = location
-	schema.Primary = primary
+	schema.Primary = table.PrimaryKeys()
+	schema.Relations = table.Relations
+	if schema.Relations == nil {
+		schema.Relations = make([]*Relation, 0)
+	}
+	schema.Routes = make([]string, 0)
 	schema.Required = required
 	schema.SchemaType = schemaType
 	schema.Method = method
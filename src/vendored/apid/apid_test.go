@@ -62,22 +62,84 @@ func TestServer(t *testing.T) {
 	}()
 
 	// set up apid and routes
-	tables := GetTables(db)
-	apid := &Apid{DB: db, Tables: tables}
+	tables := GetTables(db, dbName)
+	apid := &Apid{DB: db, Tables: tables, Routines: GetRoutines(db), NodeName: "test"}
 	router := apid.NewRouter()
 
 	// test cases
 	var tests = []Test{
 		{"GET", "/api/v1/crud/user/_meta", ReqBody{}, "MySQL Table user", 200},
 		{"GET", "/api/v1/crud/settings/_meta", ReqBody{}, "MySQL Table settings", 200},
+		{"GET", "/api/v1/crud/user_group/_meta", ReqBody{}, "\"primary\":[\"group_id\",\"user_id\"]", 200},
 		{"GET", "/api/v1/crud/unknown_table/_meta", ReqBody{}, "No table", 404},
 		{"POST", "/api/v1/crud/user/", ReqBody{}, "", 307}, // trailing slash redirects
 		{"POST", "/api/v1/crud/user", ReqBody{`{"name":"jack","email":"jack@example.com"}`}, "inserted_id", 200},
 		{"GET", "/api/v1/crud/user", ReqBody{}, "jack", 200},
 		{"GET", "/api/v1/crud/user?name=jack", ReqBody{}, "jack@example.com", 200},
-		{"POST", "/api/v1/crud/user", ReqBody{`{"id":26,"name":"jack","email":"jack-n-jill@example.com"}`}, "Duplicate", 404},
+		{"POST", "/api/v1/crud/settings", ReqBody{`{"user_id":26,"setting":"dark mode","enabled":1}`}, "inserted_id", 200},
+		{"GET", "/api/v1/crud/settings?user_id=26", ReqBody{}, "\"enabled\":true", 200},
+		{"GET", "/api/v1/crud/settings/_meta", ReqBody{}, "\"kind\":\"many-to-one\"", 200},
+		{"GET", "/api/v1/crud/settings?expand=user", ReqBody{}, "\"user\":{\"email\":\"jack@example.com\",\"id\":26,\"name\":\"jack\"}", 200},
+		{"GET", "/api/v1/crud/user/26?expand=settings&fields=name,settings.setting", ReqBody{}, "\"settings\":[{\"setting\":\"dark mode\",\"user_id\":26}]", 200},
+		{"GET", "/api/v1/crud/user?expand=nope", ReqBody{}, "unknown relationship", 400},
+		{"GET", "/", ReqBody{}, "/api/v1/crud/user/:id/settings", 200},
+		{"GET", "/api/v1/crud/user/_meta", ReqBody{}, "\"routes\":[\"/api/v1/crud/user/:id/settings\"]", 200},
+		{"GET", "/api/v1/crud/user/26/settings", ReqBody{}, "dark mode", 200},
+		{"POST", "/api/v1/crud/user/26/settings", ReqBody{`{"setting":"beta","enabled":0}`}, "inserted_id", 200},
+		{"GET", "/api/v1/crud/user/26/settings?setting=beta&fields=setting,user_id", ReqBody{}, "[{\"setting\":\"beta\",\"user_id\":26}]", 200},
+		{"POST", "/api/v1/crud/user/26/settings", ReqBody{`{"user_id":27,"setting":"beta"}`}, "does not match the url", 400},
+		{"GET", "/api/v1/crud/user/999/settings", ReqBody{}, "record (999) not found in user", 404},
+		{"GET", "/api/v1/crud/user/26/nope", ReqBody{}, "resource does not exist", 404},
+		{"GET", "/api/v1/crud/user/26/", ReqBody{}, "", 301},
+		{"POST", "/api/v1/rpc/add_one", ReqBody{`{"n":41}`}, "\"result\":42", 200},
+		{"POST", "/api/v1/rpc/count_users", ReqBody{`{"prefix":"ja"}`}, "\"out\":{\"total\":1}", 200},
+		{"POST", "/api/v1/rpc/count_users", ReqBody{`{}`}, "missing parameter (prefix)", 400},
+		{"POST", "/api/v1/rpc/find_users", ReqBody{`{"prefix":"ja"}`}, "\"out\":{\"total\":1},\"result_sets\":[[{\"id\":26,\"name\":\"jack\"}]]", 200},
+		{"GET", "/api/v1/rpc/_meta", ReqBody{}, "MySQL Procedure count_users", 200},
+		{"GET", "/api/v1/crud/user_emails?id=26", ReqBody{}, "jack@example.com", 200},
+		{"GET", "/api/v1/crud/user_emails/_meta", ReqBody{}, "MySQL View user_emails", 200},
+		{"POST", "/api/v1/crud/user_emails", ReqBody{`{"email":"x@example.com"}`}, "POST not allowed, use GET", 405},
+		{"DELETE", "/api/v1/crud/user_emails", ReqBody{`{"id":26,"limit":1}`}, "DELETE not allowed", 405},
+		{"GET", "/api/v1/crud/user/26", ReqBody{}, "{\"email\":\"jack@example.com\",\"id\":26,\"name\":\"jack\"}", 200},
+		{"GET", "/api/v1/crud/user/999", ReqBody{}, "record (999) not found", 404},
+		{"PATCH", "/api/v1/crud/user/26", ReqBody{`{"email":"jack@example.net"}`}, "success", 200},
+		{"PATCH", "/api/v1/crud/user/26", ReqBody{`{"email":"jack@example.net"}`}, "rows_affected\":0", 200}, // unchanged but found
+		{"PUT", "/api/v1/crud/user/26", ReqBody{`{"id":27,"name":"jack"}`}, "does not match", 400},
+		{"PATCH", "/api/v1/crud/user/999", ReqBody{`{"email":"x@example.net"}`}, "record (999) not found", 404},
+		{"DELETE", "/api/v1/crud/user/999", ReqBody{}, "record (999) not found", 404},
+		{"POST", "/api/v1/crud/user_group", ReqBody{`{"user_id":26,"group_id":1,"role":"member"}`}, "success", 200},
+		{"PUT", "/api/v1/crud/user_group", ReqBody{`{"user_id":26,"group_id":1,"role":"admin"}`}, "rows_affected\":1", 200},
+		{"GET", "/api/v1/crud/user_group/1,26", ReqBody{}, "admin", 200},
+		{"GET", "/api/v1/crud/user_group/1", ReqBody{}, "needs a value for each of group_id,user_id", 400},
+		{"GET", "/api/v1/crud/user?id[in]=1,26&or.name[like]=ja%25&or.email[null]=true", ReqBody{}, "jack@example.com", 200},
+		{"GET", "/api/v1/crud/user?unknown=1", ReqBody{}, "unknown column", 400},
+		{"GET", "/api/v1/crud/user?orderby=-id,name&limit=1", ReqBody{}, "jack", 200},
+		{"GET", "/api/v1/crud/user?orderby=password", ReqBody{}, "unknown orderby column", 400},
+		{"GET", "/api/v1/crud/user?fields=id,name&name=jack", ReqBody{}, "[{\"id\":26,\"name\":\"jack\"}]", 200},
+		{"GET", "/api/v1/crud/user?exclude=email&name=jack", ReqBody{}, "[{\"id\":26,\"name\":\"jack\"}]", 200},
+		{"GET", "/api/v1/crud/user?fields=password", ReqBody{}, "unknown field", 400},
+		{"GET", "/api/v1/crud/user?cursor=&limit=1", ReqBody{}, "next_cursor\":\"", 200},
+		{"GET", "/api/v1/crud/user?cursor=&limit=1&offset=1", ReqBody{}, "offset and cursor", 400},
+		{"GET", "/api/v1/crud/user?offset=1", ReqBody{}, "needs a limit", 400},
+		{"GET", "/api/v1/crud/user?count=exact&limit=1&envelope=true", ReqBody{}, "\"total\":1", 200},
+		{"GET", "/api/v1/crud/user?count=maybe", ReqBody{}, "count must be exact or estimated", 400},
+		{"POST", "/api/v1/crud/user", ReqBody{`{"id":26,"name":"jack","email":"jack-n-jill@example.com"}`}, "Duplicate", 409},
+		{"POST", "/api/v1/crud/settings", ReqBody{`{"user_id":999,"setting":"beta"}`}, "foreign key constraint fails", 422},
+		{"POST", "/api/v1/crud/user", ReqBody{`{"name":"a name far longer than twenty","email":7}`}, `{"column":"name","detail":"must be at most 20 characters"},{"column":"email","detail":"must be a string"}`, 422},
+		{"POST", "/api/v1/crud/user", ReqBody{`{"name":"jack","name=name":1}`}, `"column":"name=name"`, 400},
+		{"POST", "/api/v1/crud/user", ReqBody{}, "empty body", 400},
+		{"PATCH", "/api/v1/crud/user/26", ReqBody{`{}`}, "nothing to update", 400},
 		{"PUT", "/api/v1/crud/user", ReqBody{`{"id":26,"name":"jack","email":"jack-n-jill@example.com"}`}, "success", 200},
 		{"DELETE", "/api/v1/crud/user", ReqBody{`{"id":26,"limit":1}`}, "rows_affected\":1", 200}, // not sure why id 26 is first yet
+		{"POST", "/api/v1/transaction", ReqBody{`{"operations":[{"method":"insert","table":"user","values":{"name":"jill","email":"jill@example.com"}},{"method":"select","table":"user","values":{"name":"jill"}}]}`}, "jill@example.com", 200},
+		{"POST", "/api/v1/transaction", ReqBody{`{"operations":[{"method":"insert","table":"user","values":{"name":"bob"}},{"method":"insert","table":"nope","values":{"name":"bob"}}]}`}, "step 1", 404},
+		{"GET", "/api/v1/crud/user?name=bob", ReqBody{}, "[]", 200}, // rolled back
+		{"PUT", "/api/v1/crud/user?name[like]=ji%25", ReqBody{`{"email":"jill@example.org"}`}, "rows_affected\":1", 200},
+		{"DELETE", "/api/v1/crud/user", ReqBody{`{"email[like]":"%.org","limit":5}`}, "rows_affected\":1", 200},
+		{"POST", "/api/v1/transaction", ReqBody{}, "token", 200},
+		{"GET", "/api/v1/transaction", ReqBody{}, "age_seconds", 200},
+		{"GET", "/api/v1/crud/user?token=test::unknown", ReqBody{}, "unknown column", 400}, // a filter, not a transaction
+		{"PUT", "/api/v1/transaction?token=test::unknown", ReqBody{}, "missing transaction token", 400},
 	}
 
 	// test runner
@@ -122,11 +184,40 @@ func setUp(dbName string, db *sql.DB) error {
 		"`user_id` int(11) DEFAULT NULL," +
 		"`setting` varchar(255) DEFAULT NULL," +
 		"`enabled` tinyint(1) DEFAULT NULL," +
-		"PRIMARY KEY (`id`)" +
+		"PRIMARY KEY (`id`)," +
+		"CONSTRAINT `settings_user` FOREIGN KEY (`user_id`) REFERENCES `user` (`id`) ON DELETE CASCADE" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8;")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE TABLE `user_group` (" +
+		"`user_id` int(11) NOT NULL," +
+		"`group_id` int(11) NOT NULL," +
+		"`role` varchar(20) DEFAULT NULL," +
+		"PRIMARY KEY (`group_id`,`user_id`)" +
 		") ENGINE=InnoDB DEFAULT CHARSET=utf8;")
 	if err != nil {
 		return err
 	}
+	_, err = db.Exec("CREATE VIEW `user_emails` AS SELECT `id`, `email` FROM `user`")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE FUNCTION `add_one`(n INT) RETURNS INT DETERMINISTIC RETURN n + 1")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE PROCEDURE `count_users`(IN prefix VARCHAR(20), OUT total INT) " +
+		"SELECT count(*) INTO total FROM `user` WHERE name LIKE CONCAT(prefix, '%')")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE PROCEDURE `find_users`(IN prefix VARCHAR(20), OUT total INT) BEGIN " +
+		"SELECT `id`, `name` FROM `user` WHERE name LIKE CONCAT(prefix, '%'); " +
+		"SELECT count(*) INTO total FROM `user` WHERE name LIKE CONCAT(prefix, '%'); END")
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -0,0 +1,164 @@
+package apid
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"vendored/apid/query"
+)
+
+/************************
+ *   Keyset Pagination  *
+ ************************/
+
+/*
+offset paging gets slower the deeper you go and rows shift as data changes.
+instead, `?cursor=` (empty for the first page) pages on the order columns:
+each page ends with a cursor holding the last row's key values, and the next
+page picks up after them with `where (c1 > ?) or (c1 = ? and c2 > ?) ...`.
+the primary key columns are always added last so keys are unique.
+
+a nullable order column can end a page on a null, and the cursor keeps it.
+mysql sorts nulls first, so the next page's condition matches a null key
+with `is null`, and takes in the nulls that follow the values of a
+descending column.
+*/
+
+// DefaultPageSize is the page size when paging by cursor without a limit
+const DefaultPageSize = 100
+
+// cursor is the decoded form of a `?cursor=` token
+type cursor struct {
+	OrderBy string        `json:"o"`
+	Keys    []interface{} `json:"k"`
+}
+
+// isCursorPaging is true when the client asked for keyset paging
+func isCursorPaging(params url.Values) bool {
+	_, ok := params["cursor"]
+	return ok
+}
+
+// cursorTerms are the order terms for the page, ending in the primary key
+func (a *Apid) cursorTerms(table string, params url.Values) ([]query.Order, error) {
+	terms, err := a.parseOrderBy(table, params.Get("orderby"))
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		ordered[t.Col] = true
+	}
+	for _, pKey := range a.Tables[table].PrimaryKeys() {
+		if !ordered[pKey] {
+			terms = append(terms, query.Order{Col: pKey})
+		}
+	}
+	if len(terms) == 0 {
+		return nil, errorf(http.StatusBadRequest, "cursor paging needs a primary key or orderby on %s", table)
+	}
+	for i, t := range terms {
+		if col := a.Tables[table].Col(t.Col); col != nil {
+			terms[i].Nullable = col.IS_NULLABLE.String == "YES"
+		}
+	}
+	return terms, nil
+}
+
+// cursorKeys are the order column values of the row the cursor was made
+// after, ready to bind. The cursor must have been made for the same orderby.
+func (a *Apid) cursorKeys(table string, terms []query.Order, token, orderby string) ([]interface{}, error) {
+	if len(token) == 0 {
+		return nil, nil
+	}
+
+	c, err := decodeCursor(token)
+	if err != nil {
+		return nil, err
+	}
+	if c.OrderBy != orderby || len(c.Keys) != len(terms) {
+		return nil, errorf(http.StatusBadRequest, "cursor does not match orderby")
+	}
+
+	// datetimes were returned as RFC 3339
+	for i, t := range terms {
+		if col := a.Tables[table].Col(t.Col); col != nil && c.Keys[i] != nil {
+			c.Keys[i] = columnRule(col).bind(c.Keys[i])
+		}
+	}
+	return c.Keys, nil
+}
+
+// nextCursor makes the cursor for the page after rows. It is empty when
+// rows is the last page.
+func (a *Apid) nextCursor(table string, params url.Values, rows []map[string]interface{}) (string, error) {
+	limit := DefaultPageSize
+	if l := params.Get("limit"); len(l) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			return "", errorf(http.StatusBadRequest, "bad limit %s", l)
+		}
+	}
+	if len(rows) == 0 || len(rows) < limit {
+		return "", nil
+	}
+
+	terms, err := a.cursorTerms(table, params)
+	if err != nil {
+		return "", err
+	}
+
+	last := rows[len(rows)-1]
+	c := cursor{OrderBy: params.Get("orderby"), Keys: make([]interface{}, 0, len(terms))}
+	for _, t := range terms {
+		v, ok := last[t.Col]
+		if !ok {
+			return "", errorf(http.StatusBadRequest, "can not page without %s", t.Col)
+		}
+		c.Keys = append(c.Keys, v)
+	}
+
+	j, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(j), nil
+}
+
+// decodeCursor unpacks a `?cursor=` token
+func decodeCursor(token string) (cursor, error) {
+	c := cursor{}
+	j, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, errorf(http.StatusBadRequest, "malformed cursor")
+	}
+
+	// UseNumber keeps the keys exactly as they were
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	if err := dec.Decode(&c); err != nil {
+		return c, errorf(http.StatusBadRequest, "malformed cursor")
+	}
+	return c, nil
+}
+
+// linkURL is the request url with its query params replaced by params
+func linkURL(r *http.Request, params url.Values) string {
+	u := *r.URL
+	u.RawQuery = params.Encode()
+	return u.RequestURI()
+}
+
+// copyParams copies params so they can be changed safely
+func copyParams(params url.Values) url.Values {
+	c := make(url.Values, len(params))
+	for k, v := range params {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
@@ -0,0 +1,128 @@
+package apid
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// walks two pages and checks the queries built from the cursors
+func TestCursorPaging(t *testing.T) {
+	a := testApid("user", "id", "name", "email")
+
+	params, _ := url.ParseQuery("cursor=&limit=2&orderby=-name")
+	q, args, err := a.selectQuery("user", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := "select * from `user` order by `name` desc, `id` limit ?"; q != w {
+		t.Errorf("first page got (%s), want (%s)", q, w)
+	}
+	if w := []interface{}{2}; !reflect.DeepEqual(args, w) {
+		t.Errorf("first page got args %v, want %v", args, w)
+	}
+
+	rows := []map[string]interface{}{{"id": int64(7), "name": "zed"}, {"id": int64(3), "name": "amy"}}
+	next, err := a.nextCursor("user", params, rows)
+	if err != nil || len(next) == 0 {
+		t.Fatalf("expected a next cursor, got (%s) %v", next, err)
+	}
+
+	params.Set("cursor", next)
+	q, args, err = a.selectQuery("user", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := "select * from `user` where ((`name` < ?) or (`name` = ? and `id` > ?)) order by `name` desc, `id` limit ?"; q != w {
+		t.Errorf("second page got (%s), want (%s)", q, w)
+	}
+	if w := []interface{}{"amy", "amy", json.Number("3"), 2}; !reflect.DeepEqual(args, w) {
+		t.Errorf("second page got args %v, want %v", args, w)
+	}
+
+	// a short page is the last page
+	if next, _ := a.nextCursor("user", params, rows[:1]); next != "" {
+		t.Errorf("expected no cursor after the last page, got (%s)", next)
+	}
+
+	// key columns are always selected
+	params.Set("fields", "email")
+	if q, _, _ := a.selectQuery("user", params); !strings.HasPrefix(q, "select `id`, `name`, `email` from") {
+		t.Errorf("expected key columns selected, got (%s)", q)
+	}
+
+	for _, query := range []string{
+		"cursor=&offset=2&limit=2",
+		"cursor=" + next + "&limit=2", // made for a different orderby
+		"cursor=not-a-cursor",
+	} {
+		params, _ := url.ParseQuery(query)
+		if q, _, err := a.selectQuery("user", params); err == nil {
+			t.Errorf("%s - expected error, got (%s)", query, q)
+		}
+	}
+}
+
+// datetimes come back RFC 3339, and go back in as mysql takes them
+func TestCursorDateTimes(t *testing.T) {
+	a := testApid("event", "id", "at")
+	a.Tables["event"].Col("at").DATA_TYPE = sql.NullString{String: "datetime", Valid: true}
+
+	params, _ := url.ParseQuery("cursor=&limit=1&orderby=at")
+	next, err := a.nextCursor("event", params, []map[string]interface{}{{"id": int64(3), "at": "2014-06-14T23:01:41.5Z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Set("cursor", next)
+	_, args, err := a.selectQuery("event", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := []interface{}{"2014-06-14 23:01:41.5", "2014-06-14 23:01:41.5", json.Number("3"), 1}; !reflect.DeepEqual(args, w) {
+		t.Errorf("got args %v, want %v", args, w)
+	}
+}
+
+// a page can end on a null, and the walk goes on past the nulls
+func TestCursorNulls(t *testing.T) {
+	a := testApid("user", "id", "name")
+	a.Tables["user"].Col("name").IS_NULLABLE = sql.NullString{String: "YES", Valid: true}
+
+	var tests = []struct {
+		orderby string
+		last    map[string]interface{}
+		where   string
+		args    []interface{}
+	}{
+		{"name", map[string]interface{}{"id": int64(3), "name": nil},
+			"((`name` is not null) or (`name` is null and `id` > ?))", []interface{}{json.Number("3"), 1}},
+		{"-name", map[string]interface{}{"id": int64(3), "name": "amy"},
+			"((`name` < ? or `name` is null) or (`name` = ? and `id` > ?))", []interface{}{"amy", "amy", json.Number("3"), 1}},
+		{"-name", map[string]interface{}{"id": int64(3), "name": nil},
+			"((`name` is null and `id` > ?))", []interface{}{json.Number("3"), 1}},
+	}
+
+	for _, test := range tests {
+		params := url.Values{"cursor": {""}, "limit": {"1"}, "orderby": {test.orderby}}
+		next, err := a.nextCursor("user", params, []map[string]interface{}{test.last})
+		if err != nil {
+			t.Errorf("%s %v - unexpected error %s", test.orderby, test.last, err)
+			continue
+		}
+		params.Set("cursor", next)
+		q, args, err := a.selectQuery("user", params)
+		if err != nil {
+			t.Errorf("%s %v - unexpected error %s", test.orderby, test.last, err)
+			continue
+		}
+		if !strings.Contains(q, " where "+test.where+" order by ") {
+			t.Errorf("%s %v - got (%s), want where (%s)", test.orderby, test.last, q, test.where)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s %v - got args %v, want %v", test.orderby, test.last, args, test.args)
+		}
+	}
+}
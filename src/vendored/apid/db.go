@@ -3,7 +3,6 @@ package apid
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -25,7 +24,7 @@ func (d *DataSourceName) String() string {
 		// mutate the DataSourceObject for logging elsewhere
 		// we could populate the whole object, but yagni
 		s := strings.Split(d.Raw, "/")
-		d.DBName = s[len(s)-1]
+		d.DBName = strings.SplitN(s[len(s)-1], "?", 2)[0]
 
 		return d.Raw
 	}
@@ -50,56 +49,185 @@ func OpenDB(d *DataSourceName) *sql.DB {
 	db, err := sql.Open("mysql", d.String())
 
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 	return db
 }
 
 type Table struct {
-	Name string
-	Cols []*TableSchema
+	// Name is the key in Apid.Tables and how queries name the table:
+	// schema.table in multi-schema mode, otherwise just the table
+	Name   string
+	Schema string
+	Cols   []*TableSchema
+
+	// Primary is the primary key in key order. It may hold several
+	// columns, as join tables often do.
+	Primary []string
+
+	// ForeignKeys are the foreign keys on this table's columns
+	ForeignKeys []*ForeignKey
+
+	// Relations are the relationships to other tables, both ways, from
+	// the foreign keys of every table
+	Relations []*Relation
+
+	// View is set for database views rather than base tables
+	View bool
+
+	// ReadOnly tables are only served with GET. Views are read only.
+	ReadOnly bool
+
+	// Updatable views can take writes when Apid.WritableViews is set
+	Updatable bool
+
+	// set by a Policy: Hidden columns are left out of Cols, ReadOnlyCols
+	// are never written, and WriteOnlyCols are never returned
+	Hidden        []string
+	ReadOnlyCols  map[string]bool
+	WriteOnlyCols map[string]bool
+}
+
+// PrimaryKeys returns the primary key columns in key order, if any. Tables
+// that were not introspected fall back to the PRI columns in table order.
+func (t *Table) PrimaryKeys() []string {
+	if len(t.Primary) > 0 {
+		return t.Primary
+	}
+	pKeys := make([]string, 0)
+	for _, c := range t.Cols {
+		if c.COLUMN_KEY.String == "PRI" {
+			pKeys = append(pKeys, c.COLUMN_NAME.String)
+		}
+	}
+	return pKeys
+}
+
+// baseName is the table name without its schema
+func (t *Table) baseName() string {
+	return strings.TrimPrefix(t.Name, t.Schema+".")
+}
+
+// Col finds a column by name, nil if there is none
+func (t *Table) Col(name string) *TableSchema {
+	for _, c := range t.Cols {
+		if c.COLUMN_NAME.String == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// colSet is the set of column names that can be read, for validating user
+// input
+func (t *Table) colSet() map[string]bool {
+	cols := make(map[string]bool, len(t.Cols))
+	for _, c := range t.Cols {
+		if !t.WriteOnlyCols[c.COLUMN_NAME.String] {
+			cols[c.COLUMN_NAME.String] = true
+		}
+	}
+	return cols
 }
 
 type TableSchema struct {
 	TABLE_CATALOG, TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, ORDINAL_POSITION, COLUMN_DEFAULT, IS_NULLABLE, DATA_TYPE, CHARACTER_MAXIMUM_LENGTH, CHARACTER_OCTET_LENGTH, NUMERIC_PRECISION, NUMERIC_SCALE, CHARACTER_SET_NAME, COLLATION_NAME, COLUMN_TYPE, COLUMN_KEY, EXTRA, PRIVILEGES, COLUMN_COMMENT sql.NullString
 }
 
-// populates map of table information
-func GetTables(db *sql.DB) map[string]*Table {
+// populates map of table information for a single schema, keyed by table
+// name. An empty schema is the database in the connection string.
+func GetTables(db *sql.DB, schema string) map[string]*Table {
+	return mustTables(getTables(db, []string{schema}, false))
+}
+
+// GetSchemaTables populates map of table information for several schemas,
+// keyed by schema.table, for an Apid in MultiSchema mode
+func GetSchemaTables(db *sql.DB, schemas ...string) map[string]*Table {
+	return mustTables(getTables(db, schemas, true))
+}
+
+// mustTables stops the program if the tables couldn't be loaded
+func mustTables(tables map[string]*Table, err error) map[string]*Table {
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return tables
+}
+
+// tableKey is the key for a table, and how queries name it. It is
+// qualified by schema when several schemas are served.
+func tableKey(schema, table string, multiSchema bool) string {
+	if multiSchema {
+		return schema + "." + table
+	}
+	return table
+}
+
+// resolveSchemas is a copy of schemas with an empty name replaced by the
+// connection's database
+func resolveSchemas(db *sql.DB, schemas []string) ([]string, error) {
+	resolved := append([]string(nil), schemas...)
+	for i, schema := range resolved {
+		if len(schema) > 0 {
+			continue
+		}
+		if err := db.QueryRow("select database()").Scan(&resolved[i]); err != nil || len(resolved[i]) == 0 {
+			return nil, fmt.Errorf("no database selected to introspect %v", err)
+		}
+	}
+	return resolved, nil
+}
+
+// getTables loads every table and view in schemas
+func getTables(db *sql.DB, schemas []string, multiSchema bool) (map[string]*Table, error) {
 	allTables := make(map[string]*Table)
 
-	// could also get TABLE_SCHEMA if it is important for future use
-	r, err := db.Query("select table_name from information_schema.tables where table_type=\"BASE TABLE\"")
+	schemas, err := resolveSchemas(db, schemas)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, 0, len(schemas))
+	for _, schema := range schemas {
+		args = append(args, schema)
+	}
+
+	r, err := db.Query("select t.TABLE_SCHEMA, t.TABLE_NAME, t.TABLE_TYPE, v.IS_UPDATABLE from information_schema.tables t "+
+		"left join information_schema.views v on v.TABLE_SCHEMA=t.TABLE_SCHEMA and v.TABLE_NAME=t.TABLE_NAME "+
+		"where t.TABLE_TYPE in (\"BASE TABLE\", \"VIEW\") and t.TABLE_SCHEMA in ("+placeholders(len(schemas))+")", args...)
 	if err != nil {
-		log.Fatal("unable to reach information schema ", err)
+		return nil, fmt.Errorf("unable to reach information schema %s", err)
 	}
 
 	// get all the tables, one at a time
 	tables := make([]string, 0)
 	for r.Next() {
-		var name string
-		err = r.Scan(&name)
+		var schema, name, tableType string
+		var updatable sql.NullString
+		err = r.Scan(&schema, &name, &tableType, &updatable)
 		if err != nil {
-			log.Print("error scanning schema ", err)
+			logger.Print("error scanning schema ", err)
+			continue
 		}
-		tables = append(tables, name)
+		key := tableKey(schema, name, multiSchema)
+		tables = append(tables, key)
+
+		view := tableType == "VIEW"
+		allTables[key] = &Table{Name: key, Schema: schema, View: view, ReadOnly: view, Updatable: updatable.String == "YES"}
 	}
+	r.Close()
 
 	// query each table's structure
 	for _, t := range tables {
-		nextTable := &Table{Name: t}
-		allTables[t] = nextTable
+		nextTable := allTables[t]
 		r, err := db.Query(
-			fmt.Sprintf(
-				"select "+
-					"TABLE_CATALOG, TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, ORDINAL_POSITION, COLUMN_DEFAULT, IS_NULLABLE, DATA_TYPE, CHARACTER_MAXIMUM_LENGTH, CHARACTER_OCTET_LENGTH, NUMERIC_PRECISION, NUMERIC_SCALE, CHARACTER_SET_NAME, COLLATION_NAME, COLUMN_TYPE, COLUMN_KEY, EXTRA, PRIVILEGES, COLUMN_COMMENT "+
-					"from information_schema.columns where "+
-					"table_name=\"%s\"", t))
+			"select "+
+				"TABLE_CATALOG, TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, ORDINAL_POSITION, COLUMN_DEFAULT, IS_NULLABLE, DATA_TYPE, CHARACTER_MAXIMUM_LENGTH, CHARACTER_OCTET_LENGTH, NUMERIC_PRECISION, NUMERIC_SCALE, CHARACTER_SET_NAME, COLLATION_NAME, COLUMN_TYPE, COLUMN_KEY, EXTRA, PRIVILEGES, COLUMN_COMMENT "+
+				"from information_schema.columns where "+
+				"TABLE_SCHEMA=? and TABLE_NAME=? order by ORDINAL_POSITION", nextTable.Schema, nextTable.baseName())
 
 		if err != nil {
-			log.Fatal("unable to query table ", t, err)
+			return nil, fmt.Errorf("unable to query table %s %s", t, err)
 		}
-
 		for r.Next() {
 			var TABLE_CATALOG sql.NullString
 			var TABLE_SCHEMA sql.NullString
@@ -142,12 +270,171 @@ func GetTables(db *sql.DB) map[string]*Table {
 				&PRIVILEGES,
 				&COLUMN_COMMENT)
 			if err != nil {
-				log.Fatal("error scanning column schema ", err)
+				r.Close()
+				return nil, fmt.Errorf("error scanning column schema %s", err)
 			}
 			info := &TableSchema{TABLE_CATALOG, TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, ORDINAL_POSITION, COLUMN_DEFAULT, IS_NULLABLE, DATA_TYPE, CHARACTER_MAXIMUM_LENGTH, CHARACTER_OCTET_LENGTH, NUMERIC_PRECISION, NUMERIC_SCALE, CHARACTER_SET_NAME, COLLATION_NAME, COLUMN_TYPE, COLUMN_KEY, EXTRA, PRIVILEGES, COLUMN_COMMENT}
 			allTables[t].Cols = append(allTables[t].Cols, info)
 		}
+
+		r.Close()
+
+		// the full primary key, in key order
+		if nextTable.Primary, err = getPrimaryKey(db, nextTable.Schema, nextTable.baseName()); err != nil {
+			return nil, err
+		}
+		if nextTable.ForeignKeys, err = getForeignKeys(db, nextTable.Schema, nextTable.baseName(), multiSchema); err != nil {
+			return nil, err
+		}
 	}
 
-	return allTables
+	// relationships need every table loaded
+	relate(allTables)
+
+	return allTables, nil
+}
+
+// getPrimaryKey returns the ordered primary key columns of a table
+func getPrimaryKey(db *sql.DB, schema, table string) ([]string, error) {
+	r, err := db.Query(
+		"select COLUMN_NAME from information_schema.KEY_COLUMN_USAGE "+
+			"where TABLE_SCHEMA=? and TABLE_NAME=? and CONSTRAINT_NAME=\"PRIMARY\" "+
+			"order by ORDINAL_POSITION", schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query primary key %s %s", table, err)
+	}
+	defer r.Close()
+
+	pKeys := make([]string, 0)
+	for r.Next() {
+		var name string
+		if err := r.Scan(&name); err != nil {
+			logger.Print("error scanning primary key ", err)
+			continue
+		}
+		pKeys = append(pKeys, name)
+	}
+	return pKeys, nil
+}
+
+// getForeignKeys returns the foreign keys of a table with their columns in
+// key order. Keys to other schemas are only kept in multi-schema mode.
+func getForeignKeys(db *sql.DB, schema, table string, multiSchema bool) ([]*ForeignKey, error) {
+	r, err := db.Query(
+		"select k.CONSTRAINT_NAME, k.COLUMN_NAME, k.REFERENCED_TABLE_SCHEMA, k.REFERENCED_TABLE_NAME, k.REFERENCED_COLUMN_NAME "+
+			"from information_schema.KEY_COLUMN_USAGE k "+
+			"join information_schema.REFERENTIAL_CONSTRAINTS c "+
+			"on c.CONSTRAINT_SCHEMA=k.CONSTRAINT_SCHEMA and c.TABLE_NAME=k.TABLE_NAME and c.CONSTRAINT_NAME=k.CONSTRAINT_NAME "+
+			"where k.TABLE_SCHEMA=? and k.TABLE_NAME=? "+
+			"order by k.CONSTRAINT_NAME, k.ORDINAL_POSITION", schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query foreign keys %s %s", table, err)
+	}
+	defer r.Close()
+
+	fKeys := make([]*ForeignKey, 0)
+	var last *ForeignKey
+	for r.Next() {
+		var name, col, refSchema, refTable, refCol string
+		if err := r.Scan(&name, &col, &refSchema, &refTable, &refCol); err != nil {
+			logger.Print("error scanning foreign key ", err)
+			continue
+		}
+		if refSchema != schema && !multiSchema {
+			continue
+		}
+		if last == nil || last.Name != name {
+			last = &ForeignKey{Name: name, RefTable: tableKey(refSchema, refTable, multiSchema)}
+			fKeys = append(fKeys, last)
+		}
+		last.Cols = append(last.Cols, col)
+		last.RefCols = append(last.RefCols, refCol)
+	}
+	return fKeys, nil
+}
+
+// populates map of stored procedures and functions in the current database
+func GetRoutines(db *sql.DB) map[string]*Routine {
+	return mustRoutines(getRoutines(db, []string{""}, false))
+}
+
+// GetSchemaRoutines populates map of routines for several schemas, keyed
+// by schema.routine, for an Apid in MultiSchema mode
+func GetSchemaRoutines(db *sql.DB, schemas ...string) map[string]*Routine {
+	return mustRoutines(getRoutines(db, schemas, true))
+}
+
+// mustRoutines stops the program if the routines couldn't be loaded
+func mustRoutines(routines map[string]*Routine, err error) map[string]*Routine {
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return routines
+}
+
+// getRoutines loads the routines in schemas and their parameters
+func getRoutines(db *sql.DB, schemas []string, multiSchema bool) (map[string]*Routine, error) {
+	routines := make(map[string]*Routine)
+
+	schemas, err := resolveSchemas(db, schemas)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, 0, len(schemas))
+	for _, schema := range schemas {
+		args = append(args, schema)
+	}
+
+	// routines without parameters still get a row from the left join
+	r, err := db.Query(
+		"select r.ROUTINE_SCHEMA, r.ROUTINE_NAME, r.ROUTINE_TYPE, p.ORDINAL_POSITION, p.PARAMETER_MODE, p.PARAMETER_NAME, p.DATA_TYPE, p.DTD_IDENTIFIER, p.NUMERIC_SCALE "+
+			"from information_schema.ROUTINES r "+
+			"left join information_schema.PARAMETERS p "+
+			"on p.SPECIFIC_SCHEMA=r.ROUTINE_SCHEMA and p.SPECIFIC_NAME=r.SPECIFIC_NAME and p.ROUTINE_TYPE=r.ROUTINE_TYPE "+
+			"where r.ROUTINE_SCHEMA in ("+placeholders(len(schemas))+") "+
+			"order by r.ROUTINE_SCHEMA, r.ROUTINE_NAME, r.ROUTINE_TYPE, p.ORDINAL_POSITION", args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query routines %s", err)
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var schema, name, routineType string
+		var position sql.NullInt64
+		var mode, paramName, dataType, columnType, scale sql.NullString
+		if err := r.Scan(&schema, &name, &routineType, &position, &mode, &paramName, &dataType, &columnType, &scale); err != nil {
+			logger.Print("error scanning routine ", err)
+			continue
+		}
+
+		key := tableKey(schema, name, multiSchema)
+		routine, ok := routines[key]
+		if !ok {
+			routine = &Routine{Name: name, Schema: schema, Type: routineType, Params: make([]*Parameter, 0)}
+			routines[key] = routine
+		}
+		if routine.Type != routineType {
+			// procedures and functions can share a name, but not a url
+			logger.Printf("skipping %s %s, a %s has the same name", routineType, name, routine.Type)
+			continue
+		}
+		if !position.Valid {
+			continue
+		}
+
+		p := &Parameter{Name: paramName.String, Mode: mode.String, DataType: dataType.String, ColumnType: columnType.String, Scale: scale.String}
+		if position.Int64 == 0 {
+			// position 0 is a function's return value
+			p.Name = "result"
+			routine.Returns = p
+			continue
+		}
+		routine.Params = append(routine.Params, p)
+	}
+	return routines, nil
+}
+
+// placeholders makes `?,?,?` for n args
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
 }
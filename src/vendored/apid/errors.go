@@ -0,0 +1,209 @@
+package apid
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+/**************
+ *   Errors   *
+ **************/
+
+/*
+every failure is sent as an rfc 7807 problem, application/problem+json:
+    {"type":"about:blank","title":"Conflict","status":409,"detail":"..."}
+with table and column members when the problem is with one of them.
+
+an *Error carries its status. anything else is classified by what caused it:
+    mysql errors                 by number, see mysqlStatuses
+    lost connections, timeouts   503
+    anything else                500
+an *Error without a status wraps a cause and takes the cause's status.
+
+the detail is written for the client. the cause, including any sql, only
+goes to the log.
+*/
+
+// Error is a failure and the status it is sent with
+type Error struct {
+	// Status is the http status, zero to take the status of Err
+	Status int
+
+	// Detail says what went wrong, for the client
+	Detail string
+
+	// Table and Column are set when the problem is with one of them
+	Table  string
+	Column string
+
+	// Fields are each value a write was refused for
+	Fields []FieldError
+
+	// Err is the cause. It is logged, never sent.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Detail + ": " + e.Err.Error()
+	}
+	return e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// errorf makes an *Error with a status and detail
+func errorf(status int, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Detail: fmt.Sprintf(format, args...)}
+}
+
+// wrapf makes an *Error that takes the status of err, adding detail to
+// err's own
+func wrapf(err error, format string, args ...interface{}) *Error {
+	return &Error{Detail: fmt.Sprintf(format, args...), Err: err}
+}
+
+// queryError is a failed query. The sql is only ever logged.
+type queryError struct {
+	err error
+	q   string
+}
+
+func (e *queryError) Error() string {
+	return e.err.Error() + " :: " + e.q
+}
+
+func (e *queryError) Unwrap() error {
+	return e.err
+}
+
+// withQuery notes the sql of a failed query for the log
+func withQuery(err error, q string) error {
+	return &queryError{err: err, q: q}
+}
+
+// mysqlStatuses are the statuses of mysql errors that are the client's
+// doing. Their messages are safe to send. Other mysql errors are a 500.
+var mysqlStatuses = map[uint16]int{
+	1062: http.StatusConflict,            // duplicate entry
+	1451: http.StatusConflict,            // row is still referred to by a foreign key
+	1213: http.StatusConflict,            // deadlock, try again
+	1452: http.StatusUnprocessableEntity, // foreign key refers to nothing
+	1048: http.StatusUnprocessableEntity, // column can't be null
+	1364: http.StatusUnprocessableEntity, // no value and no default
+	1366: http.StatusUnprocessableEntity, // incorrect value for the column
+	1292: http.StatusUnprocessableEntity, // incorrect date or number
+	1264: http.StatusUnprocessableEntity, // out of range
+	1406: http.StatusUnprocessableEntity, // too long for the column
+	3819: http.StatusUnprocessableEntity, // check constraint
+	1153: http.StatusRequestEntityTooLarge,
+	1040: http.StatusServiceUnavailable, // too many connections
+	1053: http.StatusServiceUnavailable, // server shutting down
+	1205: http.StatusServiceUnavailable, // lock wait timeout
+}
+
+// classify is the status and client detail for err
+func classify(err error) (int, string) {
+	var e *Error
+	if errors.As(err, &e) {
+		if e.Status != 0 {
+			return e.Status, e.Detail
+		}
+		status, detail := classify(e.Err)
+		return status, e.Detail + ": " + detail
+	}
+
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		if status, ok := mysqlStatuses[me.Number]; ok && status < 500 {
+			return status, me.Message
+		} else if ok {
+			return status, "database unavailable"
+		}
+		return http.StatusInternalServerError, "internal error"
+	}
+
+	var ne net.Error
+	switch {
+	case errors.Is(err, mysql.ErrPktTooLarge):
+		return http.StatusRequestEntityTooLarge, "request too large for the database"
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.Is(err, mysql.ErrInvalidConn),
+		errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled), errors.As(err, &ne):
+		return http.StatusServiceUnavailable, "database unavailable"
+	}
+	return http.StatusInternalServerError, "internal error"
+}
+
+// Problem is an rfc 7807 problem details body
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Table  string `json:"table,omitempty"`
+	Column string `json:"column,omitempty"`
+
+	// Errors are each field a write was refused for
+	Errors []FieldError `json:"errors,omitempty"`
+
+	// RequestID is set on a 500 from a panic, and on a stream that failed
+	// part way, to find the cause in the log
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// sendError logs err and sends it as a problem
+func sendError(w http.ResponseWriter, r *http.Request, err error) {
+	p := problem(err)
+	requestLogger(r).Printf("%d - %s %s: %s", p.Status, r.Method, r.RequestURI, err)
+	WriteProblem(w, r, p)
+}
+
+// problem is what the client is told about err
+func problem(err error) *Problem {
+	status, detail := classify(err)
+	p := &Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail}
+	var e *Error
+	if errors.As(err, &e) {
+		p.Table, p.Column, p.Errors = e.Table, e.Column, e.Fields
+	}
+	return p
+}
+
+// WriteProblem sends p as application/problem+json
+func WriteProblem(w http.ResponseWriter, r *http.Request, p *Problem) {
+	j, err := json.Marshal(p)
+	if err != nil {
+		requestLogger(r).Print("error making json problem ", err)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(j)
+}
+
+// standard 404 page
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	sendError(w, r, errorf(http.StatusNotFound, "resource does not exist"))
+}
+
+// 404 page to which we can pass a message string
+func NotFoundWithParams(w http.ResponseWriter, r *http.Request, e string) {
+	sendError(w, r, errorf(http.StatusNotFound, "%s", e))
+}
+
+// 405 page listing the methods the resource does allow
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request, allow []string) {
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	sendError(w, r, errorf(http.StatusMethodNotAllowed, "%s not allowed, use %s", r.Method, strings.Join(allow, ", ")))
+}
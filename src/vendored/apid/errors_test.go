@@ -0,0 +1,82 @@
+package apid
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		err    error
+		status int
+		detail string
+	}{
+		{"our own", errorf(http.StatusBadRequest, "bad limit x"), 400, "bad limit x"},
+		{"duplicate", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '26' for key 'PRIMARY'"}, 409, "Duplicate entry '26' for key 'PRIMARY'"},
+		{"foreign key", &mysql.MySQLError{Number: 1452, Message: "a foreign key constraint fails"}, 422, "a foreign key constraint fails"},
+		{"too many connections", &mysql.MySQLError{Number: 1040, Message: "Too many connections"}, 503, "database unavailable"},
+		{"syntax", &mysql.MySQLError{Number: 1064, Message: "You have an error in your SQL syntax near 'secret'"}, 500, "internal error"},
+		{"packet too large", mysql.ErrPktTooLarge, 413, "request too large for the database"},
+		{"bad connection", driver.ErrBadConn, 503, "database unavailable"},
+		{"anything else", errors.New("what happened"), 500, "internal error"},
+		{"with a query", withQuery(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, "insert into `user`"), 409, "Duplicate entry"},
+		{"wrapped", wrapf(&mysql.MySQLError{Number: 1452, Message: "fk"}, "step %d failed", 1), 422, "step 1 failed: fk"},
+		{"wrapped status", &Error{Status: http.StatusServiceUnavailable, Detail: "unreachable", Err: errors.New("bad url")}, 503, "unreachable"},
+	} {
+		status, detail := classify(test.err)
+		if status != test.status || detail != test.detail {
+			t.Errorf("%s - got %d (%s), want %d (%s)", test.name, status, detail, test.status, test.detail)
+		}
+	}
+}
+
+// the client gets a problem, the log gets the sql
+func TestSendError(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/api/v1/crud/user", nil)
+	rw := httptest.NewRecorder()
+	sendError(rw, req, withQuery(errors.New("connection reset"), "insert into `user` (`password`) values (?)"))
+
+	if g, w := rw.Code, http.StatusInternalServerError; g != w {
+		t.Errorf("got status %d, want %d", g, w)
+	}
+	if g, w := rw.Header().Get("Content-Type"), "application/problem+json"; g != w {
+		t.Errorf("got content type (%s), want (%s)", g, w)
+	}
+	var p Problem
+	if err := json.Unmarshal(rw.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if w := (Problem{Type: "about:blank", Title: "Internal Server Error", Status: 500, Detail: "internal error"}); !reflect.DeepEqual(p, w) {
+		t.Errorf("got %+v, want %+v", p, w)
+	}
+	if b := rw.Body.String(); strings.Contains(b, "password") || strings.Contains(b, "connection reset") {
+		t.Errorf("got (%s), the sql and cause should only be logged", b)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	a := testApid("user", "id", "name")
+	a.MaxBodyBytes = 16
+	router := a.NewRouter()
+
+	for body, status := range map[string]int{
+		`{"nope":1}`:                           http.StatusBadRequest, // read, then refused
+		`{"name":"jack and a very long name"}`: http.StatusRequestEntityTooLarge,
+	} {
+		req, _ := http.NewRequest("POST", "/api/v1/crud/user", strings.NewReader(body))
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		if rw.Code != status {
+			t.Errorf("%s - got status %d, want %d", body, rw.Code, status)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package apid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"vendored/apid/query"
+)
+
+/***************
+ *   Filters   *
+ ***************/
+
+/*
+filters are the conditions for GET, DELETE, and bulk PUT.
+    col=val              col = val (repeat the key for col in (...))
+    col[op]=val          op is one of the filterOps below
+    col[in]=1,2,3        col in (1,2,3)
+    col[between]=1,9     col between 1 and 9
+    col[null]=true       col is null (false for is not null)
+    or.col[op]=val       conditions under the same or prefix are OR'd
+    orX.col[op]=val      together. Use orX, orY, etc. for several groups.
+all conditions and groups are AND'd together.
+*/
+
+// the comparison operators and their sql
+var filterOps = map[string]string{
+	"eq":    "=",
+	"ne":    "<>",
+	"gt":    ">",
+	"gte":   ">=",
+	"lt":    "<",
+	"lte":   "<=",
+	"like":  "like",
+	"nlike": "not like",
+}
+
+// reservedParams are query params that are never treated as filters
+var reservedParams = map[string]bool{
+	"limit":    true,
+	"offset":   true,
+	"orderby":  true,
+	"fields":   true,
+	"exclude":  true,
+	"cursor":   true,
+	"count":    true,
+	"envelope": true,
+	"expand":   true,
+}
+
+// [or<group>.]column[[op]]
+var filterKey = regexp.MustCompile(`^(?:(or[A-Za-z0-9_]*)\.)?([^\[\].]+)(?:\[([a-z]+)\])?$`)
+
+// filters turns the filters in params into conditions. Unknown operators
+// are errors here, unknown columns when the query is built.
+func (a *Apid) filters(table string, params url.Values) ([]query.Cond, error) {
+	// sorted so the same params always make the same query
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if !reservedParams[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	conds := make([]query.Cond, 0)
+	for _, k := range keys {
+		m := filterKey.FindStringSubmatch(k)
+		if m == nil {
+			return nil, errorf(http.StatusBadRequest, "bad filter (%s) on %s", k, table)
+		}
+		group, col, op := m[1], m[2], m[3]
+		if len(op) == 0 {
+			op = "eq"
+		}
+
+		newConds, err := filterConditions(col, op, params[k])
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "bad filter (%s) on %s: %s", k, table, err)
+		}
+		for _, c := range newConds {
+			c.Group = group
+			conds = append(conds, c)
+		}
+	}
+	return conds, nil
+}
+
+// filterConditions makes the conditions for one filter key
+func filterConditions(col, op string, values []string) ([]query.Cond, error) {
+	conds := make([]query.Cond, 0)
+
+	// repeated equality is the same as `in`
+	if op == "eq" && len(values) > 1 {
+		op = "in"
+	}
+
+	switch op {
+	case "in":
+		list := splitValues(values)
+		if len(list) == 0 {
+			return nil, fmt.Errorf("in needs at least one value")
+		}
+		conds = append(conds, query.Cond{Col: col, Op: "in", Values: anyValues(list)})
+	case "between":
+		list := splitValues(values)
+		if len(list) != 2 {
+			return nil, fmt.Errorf("between needs exactly two values")
+		}
+		conds = append(conds, query.Cond{Col: col, Op: "between", Values: anyValues(list)})
+	case "null":
+		for _, v := range values {
+			isNull, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("null takes true or false")
+			}
+			if isNull {
+				conds = append(conds, query.Cond{Col: col, Op: "is null"})
+			} else {
+				conds = append(conds, query.Cond{Col: col, Op: "is not null"})
+			}
+		}
+	default:
+		sqlOp, ok := filterOps[op]
+		if !ok {
+			return nil, fmt.Errorf("unknown operator %s", op)
+		}
+		for _, v := range values {
+			conds = append(conds, query.Cond{Col: col, Op: sqlOp, Values: []interface{}{v}})
+		}
+	}
+
+	return conds, nil
+}
+
+// anyValues makes strings arguments
+func anyValues(list []string) []interface{} {
+	values := make([]interface{}, 0, len(list))
+	for _, v := range list {
+		values = append(values, v)
+	}
+	return values
+}
+
+// splitValues flattens comma separated values
+func splitValues(values []string) []string {
+	list := make([]string, 0, len(values))
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if len(s) > 0 {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// bodyToParams lets a json body be used as filters. Arrays become
+// repeated values.
+func bodyToParams(v map[string]interface{}) url.Values {
+	params := url.Values{}
+	for k, val := range v {
+		if list, ok := val.([]interface{}); ok {
+			for _, item := range list {
+				params.Add(k, paramString(item))
+			}
+			continue
+		}
+		params.Add(k, paramString(val))
+	}
+	return params
+}
+
+// paramString formats a json value the way it would appear in a query string
+func paramString(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
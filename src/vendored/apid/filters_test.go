@@ -0,0 +1,94 @@
+package apid
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"vendored/apid/query"
+)
+
+// builds an Apid with a single table and no db. The first column is the primary key.
+func testApid(table string, cols ...string) *Apid {
+	t := &Table{Name: table}
+	for i, c := range cols {
+		col := &TableSchema{COLUMN_NAME: sql.NullString{String: c, Valid: true}}
+		if i == 0 {
+			col.COLUMN_KEY = sql.NullString{String: "PRI", Valid: true}
+		}
+		t.Cols = append(t.Cols, col)
+	}
+	return &Apid{Tables: map[string]*Table{table: t}}
+}
+
+func TestFilters(t *testing.T) {
+	a := testApid("user", "id", "name", "age", "deleted_at", "token")
+
+	// the where clause the filters make
+	where := func(params url.Values) (string, []interface{}, error) {
+		conds, err := a.filters("user", params)
+		if err != nil {
+			return "", nil, err
+		}
+		q, args, err := built(dialect.Count(a.queryTable("user"), &query.Request{Where: conds}))
+		return strings.TrimPrefix(strings.TrimPrefix(q, "select count(*) from `user`"), " where "), args, err
+	}
+
+	var tests = []struct {
+		query string
+		where string
+		args  []interface{}
+	}{
+		{"", "", []interface{}{}},
+		{"name=jack&limit=1&offset=2", "`name` = ?", []interface{}{"jack"}},
+		{"token=x::y", "`token` = ?", []interface{}{"x::y"}},
+		{"name=jack&name=jill", "`name` in (?,?)", []interface{}{"jack", "jill"}},
+		{"age[gt]=30&name[like]=jo%25", "`age` > ? and `name` like ?", []interface{}{"30", "jo%"}},
+		{"id[in]=1,2,3", "`id` in (?,?,?)", []interface{}{"1", "2", "3"}},
+		{"age[between]=1,9", "`age` between ? and ?", []interface{}{"1", "9"}},
+		{"deleted_at[null]=true&name[null]=false", "`deleted_at` is null and `name` is not null", []interface{}{}},
+		{"id[ne]=4&age[gte]=1&age[lte]=9&age[lt]=10", "`age` >= ? and `age` < ? and `age` <= ? and `id` <> ?", []interface{}{"1", "10", "9", "4"}},
+		{"or.name=jack&or.age[gt]=30&id=1", "`id` = ? and (`age` > ? or `name` = ?)", []interface{}{"1", "30", "jack"}},
+		{"orA.id=1&orA.id[gt]=5&orB.name=a&orB.name=b", "(`id` = ? or `id` > ?) and (`name` in (?,?))", []interface{}{"1", "5", "a", "b"}},
+	}
+
+	for _, test := range tests {
+		params, _ := url.ParseQuery(test.query)
+		got, args, err := where(params)
+		if err != nil {
+			t.Errorf("%s - unexpected error %s", test.query, err)
+			continue
+		}
+		if g, w := got, test.where; g != w {
+			t.Errorf("%s - got where (%s), want (%s)", test.query, g, w)
+		}
+		if g, w := args, test.args; !reflect.DeepEqual(g, w) {
+			t.Errorf("%s - got args %v, want %v", test.query, g, w)
+		}
+	}
+
+	// bad input is an error, never part of the query
+	for _, q := range []string{
+		"nope=1",
+		"name[drop]=1",
+		"id[between]=1",
+		"id[in]=",
+		"deleted_at[null]=maybe",
+		"name%3Bdrop%20table%20user=1",
+		"or.x.name=1",
+	} {
+		params, _ := url.ParseQuery(q)
+		if got, _, err := where(params); err == nil {
+			t.Errorf("%s - expected error, got where (%s)", q, got)
+		}
+	}
+
+	// unknown columns are 400s naming the column
+	_, _, err := where(url.Values{"or.nope[gt]": {"1"}})
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusBadRequest || e.Column != "nope" {
+		t.Errorf("got %v, want a 400 for nope", err)
+	}
+}
@@ -0,0 +1,302 @@
+package apid
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"vendored/apid/query"
+)
+
+/*********************
+ *   Nested Routes   *
+ *********************/
+
+/*
+each one-to-many relationship gives a route to the child rows of a record:
+GET /api/v1/crud/user/26/settings lists user 26's settings, and a POST to the
+same url creates a setting with user_id filled in. routes keep nesting
+through the child's own one-to-many relationships
+(/api/v1/crud/user/:id/settings/:id/history) up to Apid.MaxNesting
+relationships deep, and each record along the way has to belong to the one
+before it. GETs take all the usual params.
+
+httprouter can't mix table names with the :table wildcard, so nested
+requests all arrive on /api/v1/crud/:table/:id/*path (with :schema first in
+multi-schema mode) and are matched against the routes generated from the
+relationships.
+*/
+
+// DefaultMaxNesting is how many relationships deep nested routes go
+const DefaultMaxNesting = 2
+
+// nestedRoute reaches a table through one-to-many relationships from a
+// record of the root table
+type nestedRoute struct {
+	path  string
+	root  string
+	steps []*Relation
+}
+
+// table is the table at the end of the route
+func (n *nestedRoute) table() string {
+	return n.steps[len(n.steps)-1].Table
+}
+
+// maxNesting is the configured depth. Negative turns nested routes off.
+func (a *Apid) maxNesting() int {
+	if a.MaxNesting == 0 {
+		return DefaultMaxNesting
+	}
+	return a.MaxNesting
+}
+
+// nestedRoutes generates the routes from the relationships, keyed by path
+func (a *Apid) nestedRoutes() map[string]*nestedRoute {
+	a.routesOnce.Do(func() {
+		a.routes = make(map[string]*nestedRoute)
+
+		var walk func(root, base, table string, steps []*Relation)
+		walk = func(root, base, table string, steps []*Relation) {
+			if len(steps) >= a.maxNesting() {
+				return
+			}
+			for _, rel := range a.Tables[table].Relations {
+				if rel.Kind != OneToMany {
+					continue
+				}
+				path := base + "/:id/" + rel.Name
+				next := append(append([]*Relation(nil), steps...), rel)
+				a.routes[path] = &nestedRoute{path: path, root: root, steps: next}
+				walk(root, path, rel.Table, next)
+			}
+		}
+		for name, t := range a.Tables {
+			walk(name, a.tablePath(t), name, nil)
+		}
+	})
+	return a.routes
+}
+
+// routePaths lists the nested routes starting at table, or every nested
+// route if table is empty
+func (a *Apid) routePaths(table string) []string {
+	paths := make([]string, 0)
+	for path, route := range a.nestedRoutes() {
+		if len(table) == 0 || route.root == table {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// matchNested finds the route for a request and the record ids along it
+func (a *Apid) matchNested(t httprouter.Params) (*nestedRoute, []string, bool) {
+	segments := strings.Split(strings.Trim(t.ByName("path"), "/"), "/")
+	if len(segments)%2 == 0 {
+		return nil, nil, false
+	}
+
+	table, ok := a.Tables[a.tableKey(t)]
+	if !ok {
+		return nil, nil, false
+	}
+	path := a.tablePath(table)
+	ids := []string{t.ByName("id")}
+	for i, s := range segments {
+		if i%2 == 1 {
+			ids = append(ids, s)
+			continue
+		}
+		path += "/:id/" + s
+	}
+
+	route, ok := a.nestedRoutes()[path]
+	return route, ids, ok
+}
+
+// findNested matches the request to a route, redirecting /:table/:id/ and
+// sending a 404 for anything else that isn't a route
+func (a *Apid) findNested(w http.ResponseWriter, r *http.Request, t httprouter.Params) (*nestedRoute, []string, bool) {
+	// the catch-all gets these before the router can redirect them
+	if t.ByName("path") == "/" {
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" {
+			code = http.StatusTemporaryRedirect
+		}
+		http.Redirect(w, r, strings.TrimSuffix(r.URL.Path, "/"), code)
+		return nil, nil, false
+	}
+
+	route, ids, ok := a.matchNested(t)
+	if !ok {
+		NotFound(w, r)
+	}
+	return route, ids, ok
+}
+
+// nestedFilters walks the route from the root record, checking that each
+// record belongs to the one before it. It returns the foreign key values
+// that pick out the child rows.
+func (a *Apid) nestedFilters(r *http.Request, route *nestedRoute, ids []string) (url.Values, error) {
+	db, release, err := a.conn(r)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	table := route.root
+	filters := url.Values{}
+	for i, rel := range route.steps {
+		pKeys := a.Tables[table].PrimaryKeys()
+		if len(pKeys) == 0 {
+			return nil, noPrimaryKey(table)
+		}
+		parts, err := recordKey(table, pKeys, ids[i])
+		if err != nil {
+			return nil, err
+		}
+
+		// the record, limited to the one it must belong to
+		notFound := errorf(http.StatusNotFound, "record (%s) not found in %s", ids[i], table)
+		keys := make([]interface{}, len(pKeys))
+		for j, k := range pKeys {
+			if v, ok := filters[k]; ok && v[0] != parts[j] {
+				return nil, notFound
+			}
+			keys[j] = parts[j]
+		}
+		req := &query.Request{Fields: rel.Cols, KeyCols: pKeys, Keys: [][]interface{}{keys}}
+		cols := make([]string, 0, len(filters))
+		for c := range filters {
+			cols = append(cols, c)
+		}
+		sort.Strings(cols)
+		for _, c := range cols {
+			req.Where = append(req.Where, query.Cond{Col: c, Op: "=", Values: []interface{}{filters.Get(c)}})
+		}
+
+		// the lookup is ours, so it isn't held to the columns the client
+		// can read
+		qt := a.queryTable(table)
+		qt.WriteOnly = nil
+		q, args, err := built(dialect.Select(qt, req))
+		if err != nil {
+			return nil, err
+		}
+		a.log().Print(q, " ", args)
+		rows, err := db.QueryContext(r.Context(), q, args...)
+		if err != nil {
+			return nil, err
+		}
+		found, err := a.scanRows(rows, a.Tables[table])
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return nil, notFound
+		}
+
+		filters = url.Values{}
+		for j, c := range rel.RefCols {
+			v := found[0][rel.Cols[j]]
+			if v == nil {
+				return nil, notFound
+			}
+			filters.Set(c, paramString(v))
+		}
+		table = rel.Table
+	}
+	return filters, nil
+}
+
+// GetNested lists the child rows at the end of a nested route
+func (a *Apid) GetNested(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	route, ids, ok := a.findNested(w, r, t)
+	if !ok {
+		return
+	}
+
+	filters, err := a.nestedFilters(r, route, ids)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	// a GET on the child table with the foreign key as a filter
+	params := r.URL.Query()
+	for k, v := range filters {
+		params[k] = v
+	}
+	u := *r.URL
+	u.RawQuery = params.Encode()
+	child := new(http.Request)
+	*child = *r
+	child.URL = &u
+
+	a.GetTable(w, child, a.tableParams(route.table()))
+}
+
+// PostNested creates a child row with its foreign key taken from the url
+func (a *Apid) PostNested(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	route, ids, ok := a.findNested(w, r, t)
+	if !ok {
+		return
+	}
+
+	if a.refuseWrite(w, r, a.Tables[route.table()]) {
+		return
+	}
+
+	v, err := a.readJSONBody(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	filters, err := a.nestedFilters(r, route, ids)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	for k := range filters {
+		if bodyVal, ok := v[k]; ok && paramString(bodyVal) != filters.Get(k) {
+			sendError(w, r, errorf(http.StatusBadRequest, "%s in body (%s) does not match the url (%s)", k, paramString(bodyVal), filters.Get(k)))
+			return
+		}
+		v[k] = filters.Get(k)
+	}
+
+	q, args, err := a.insertQuery(route.table(), v)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	db, release, err := a.conn(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	defer release()
+
+	res, err := db.Exec(q, args...)
+	if err != nil {
+		sendError(w, r, withQuery(err, q))
+		return
+	}
+	insertId, err := res.LastInsertId()
+	if err != nil {
+		a.log().Print("error ", err)
+	}
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"message\":\"success\", \"inserted_id\":%d}", insertId)))
+}
@@ -0,0 +1,121 @@
+package apid
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// the related test tables, plus a history of each setting
+func testNested(maxNesting int) *Apid {
+	a := testRelated()
+	a.MaxNesting = maxNesting
+	a.Tables["history"] = testApid("history", "id", "settings_id", "changed_at").Tables["history"]
+	a.Tables["history"].ForeignKeys = []*ForeignKey{{Name: "history_settings", Cols: []string{"settings_id"}, RefTable: "settings", RefCols: []string{"id"}}}
+	relate(a.Tables)
+	return a
+}
+
+func TestNestedRoutes(t *testing.T) {
+	a := testNested(0)
+
+	want := []string{"/api/v1/crud/user/:id/settings", "/api/v1/crud/user/:id/settings/:id/history"}
+	if got := a.routePaths("user"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// self references stop at the depth limit
+	if got := a.routePaths("employee"); len(got) != 6 {
+		t.Errorf("got %d employee routes, want 6: %v", len(got), got)
+	}
+
+	// depth is configurable, and negative turns them off
+	if got := testNested(1).routePaths("user"); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("depth 1 - got %v, want %v", got, want[:1])
+	}
+	if got := testNested(-1).routePaths(""); len(got) != 0 {
+		t.Errorf("disabled - got %v, want none", got)
+	}
+
+	var tests = []struct {
+		id, path string
+		route    string
+		ids      []string
+	}{
+		{"26", "/settings", "/api/v1/crud/user/:id/settings", []string{"26"}},
+		{"26", "/settings/3/history", "/api/v1/crud/user/:id/settings/:id/history", []string{"26", "3"}},
+		{"26", "/settings/", "/api/v1/crud/user/:id/settings", []string{"26"}},
+	}
+	for _, test := range tests {
+		params := httprouter.Params{{Key: "table", Value: "user"}, {Key: "id", Value: test.id}, {Key: "path", Value: test.path}}
+		route, ids, ok := a.matchNested(params)
+		if !ok {
+			t.Errorf("%s - no route", test.path)
+			continue
+		}
+		if route.path != test.route || !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s - got %s %v, want %s %v", test.path, route.path, ids, test.route, test.ids)
+		}
+	}
+
+	for _, path := range []string{"/settings/3", "/nope", "/settings/3/nope", "/settings/3/history/4/history"} {
+		params := httprouter.Params{{Key: "table", Value: "user"}, {Key: "id", Value: "26"}, {Key: "path", Value: path}}
+		if route, _, ok := a.matchNested(params); ok {
+			t.Errorf("%s - expected no route, got %s", path, route.path)
+		}
+	}
+}
+
+// the records along the route are looked up whatever the client can read
+func TestNestedWriteOnlyKey(t *testing.T) {
+	a := testNested(0)
+	a.Tables["settings"].WriteOnlyCols = map[string]bool{"user_id": true}
+	queries := make(chan string, 10)
+	a.DB = stubDB(func(q string, args []driver.Value) ([]string, [][]driver.Value) {
+		queries <- q
+		return []string{"id"}, [][]driver.Value{{int64(3)}}
+	})
+
+	req, _ := http.NewRequest("GET", "/api/v1/crud/user/26/settings/3/history", nil)
+	rw := httptest.NewRecorder()
+	a.NewRouter().ServeHTTP(rw, req)
+	if g, w := rw.Code, http.StatusOK; g != w {
+		t.Errorf("got status %d, want %d: %s", g, w, rw.Body.String())
+	}
+
+	want := []string{"select `id` from `user` where `id` = ?", "select `id` from `settings` where `user_id` = ? and `id` = ?"}
+	for _, w := range want {
+		select {
+		case g := <-queries:
+			if g != w {
+				t.Errorf("got query (%s), want (%s)", g, w)
+			}
+		default:
+			t.Errorf("no query, want (%s)", w)
+		}
+	}
+}
+
+// a foreign key in the body has to agree with the url
+func TestNestedMismatch(t *testing.T) {
+	a := testNested(0)
+	a.DB = stubDB(func(q string, args []driver.Value) ([]string, [][]driver.Value) {
+		return []string{"id"}, [][]driver.Value{{int64(26)}}
+	})
+	router := a.NewRouter()
+
+	req, _ := http.NewRequest("POST", "/api/v1/crud/user/26/settings", strings.NewReader(`{"user_id":27}`))
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	if g, w := rw.Code, http.StatusBadRequest; g != w {
+		t.Errorf("got status %d, want %d: %s", g, w, rw.Body.String())
+	}
+	if g, w := rw.Body.String(), "does not match the url"; !strings.Contains(g, w) {
+		t.Errorf("got (%s), want it to contain (%s)", g, w)
+	}
+}
@@ -0,0 +1,200 @@
+package apid
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"vendored/apid/query"
+)
+
+/**************
+ *   Paging   *
+ **************/
+
+// the order links are written in the Link header
+var linkRels = []string{"first", "prev", "next", "last"}
+
+// page describes where a GET response sits among all matching records
+type page struct {
+	rows       []map[string]interface{}
+	total      *int64
+	limit      int
+	offset     int
+	nextCursor string
+	links      map[string]string
+}
+
+// paginate works out the count, cursor, and links for a page of rows
+func (a *Apid) paginate(db queryer, r *http.Request, table string, rows []map[string]interface{}) (*page, error) {
+	var total *int64
+	if mode := r.URL.Query().Get("count"); len(mode) > 0 {
+		n, err := a.count(db, table, r.URL.Query(), mode)
+		if err != nil {
+			return nil, err
+		}
+		total = &n
+	}
+	return a.newPage(r, table, rows, total)
+}
+
+// newPage works out the cursor and links for a page of rows given the
+// total, if it was counted
+func (a *Apid) newPage(r *http.Request, table string, rows []map[string]interface{}, total *int64) (*page, error) {
+	params := r.URL.Query()
+	p := &page{rows: rows, total: total, links: make(map[string]string)}
+
+	if isCursorPaging(params) {
+		next, err := a.nextCursor(table, params, rows)
+		if err != nil {
+			return nil, err
+		}
+		p.nextCursor = next
+
+		params.Set("cursor", "")
+		p.links["first"] = linkURL(r, params)
+		if len(next) > 0 {
+			params.Set("cursor", next)
+			p.links["next"] = linkURL(r, params)
+		}
+		return p, nil
+	}
+
+	// offset paging only makes sense with a limit
+	if len(params.Get("limit")) == 0 {
+		return p, nil
+	}
+	var err error
+	if p.limit, err = strconv.Atoi(params.Get("limit")); err != nil || p.limit <= 0 {
+		return p, nil
+	}
+	if o := params.Get("offset"); len(o) > 0 {
+		if p.offset, err = strconv.Atoi(o); err != nil || p.offset < 0 {
+			p.offset = 0
+		}
+	}
+
+	at := func(offset int) string {
+		params.Set("offset", strconv.Itoa(offset))
+		return linkURL(r, params)
+	}
+
+	p.links["first"] = at(0)
+	if p.offset > 0 {
+		prev := p.offset - p.limit
+		if prev < 0 {
+			prev = 0
+		}
+		p.links["prev"] = at(prev)
+	}
+	if p.total != nil {
+		if int64(p.offset+p.limit) < *p.total {
+			p.links["next"] = at(p.offset + p.limit)
+		}
+		last := 0
+		if *p.total > 0 {
+			last = int((*p.total - 1) / int64(p.limit) * int64(p.limit))
+		}
+		p.links["last"] = at(last)
+	} else if len(rows) == p.limit {
+		// without a count, a full page may have more after it
+		p.links["next"] = at(p.offset + p.limit)
+	}
+
+	return p, nil
+}
+
+// count is the number of matching records. Exact counts use the same
+// filters as the select, estimated counts use the table statistics.
+func (a *Apid) count(db queryer, table string, params url.Values, mode string) (int64, error) {
+	var q string
+	var args []interface{}
+
+	switch mode {
+	case "exact":
+		conds, err := a.filters(table, params)
+		if err != nil {
+			return 0, err
+		}
+		if q, args, err = built(dialect.Count(a.queryTable(table), &query.Request{Where: conds})); err != nil {
+			return 0, err
+		}
+	case "estimated":
+		t := a.Tables[table]
+		q = "select TABLE_ROWS from information_schema.tables where TABLE_SCHEMA = ? and TABLE_NAME = ?"
+		args = []interface{}{t.Schema, t.baseName()}
+		if len(t.Schema) == 0 {
+			q = "select TABLE_ROWS from information_schema.tables where TABLE_SCHEMA = database() and TABLE_NAME = ?"
+			args = []interface{}{table}
+		}
+	default:
+		return 0, errorf(http.StatusBadRequest, "count must be exact or estimated")
+	}
+
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	// TABLE_ROWS can be null
+	var total sql.NullInt64
+	if rows.Next() {
+		if err := rows.Scan(&total); err != nil {
+			return 0, err
+		}
+	}
+	return total.Int64, rows.Err()
+}
+
+// setHeaders writes the X-Total-Count and Link headers
+func (p *page) setHeaders(w http.ResponseWriter) {
+	if p.total != nil {
+		w.Header().Set("X-Total-Count", strconv.FormatInt(*p.total, 10))
+	}
+
+	links := make([]string, 0, len(p.links))
+	for _, rel := range linkRels {
+		if link, ok := p.links[rel]; ok {
+			links = append(links, fmt.Sprintf("<%s>; rel=%q", link, rel))
+		}
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// body is what gets marshalled for the response. Plain requests get a bare
+// array, cursor requests get the next cursor, and `?envelope=true` wraps
+// everything in data, meta, and links.
+func (p *page) body(params url.Values) interface{} {
+	if envelope, _ := strconv.ParseBool(params.Get("envelope")); envelope {
+		meta := map[string]interface{}{"count": len(p.rows)}
+		if p.total != nil {
+			meta["total"] = *p.total
+		}
+		if isCursorPaging(params) {
+			meta["next_cursor"] = nullable(p.nextCursor)
+		} else if p.limit > 0 {
+			meta["limit"] = p.limit
+			meta["offset"] = p.offset
+		}
+		return map[string]interface{}{"data": p.rows, "meta": meta, "links": p.links}
+	}
+
+	if isCursorPaging(params) {
+		return map[string]interface{}{"data": p.rows, "next_cursor": nullable(p.nextCursor)}
+	}
+	return p.rows
+}
+
+// nullable makes empty strings null in json
+func nullable(s string) interface{} {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,77 @@
+package apid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPaginateLinks(t *testing.T) {
+	a := testApid("user", "id", "name")
+	full := []map[string]interface{}{{"id": int64(5)}, {"id": int64(6)}}
+
+	var tests = []struct {
+		url   string
+		rows  []map[string]interface{}
+		total int64 // -1 for no count
+		links map[string]string
+	}{
+		{"/api/v1/crud/user", full, -1, map[string]string{}},
+		{"/api/v1/crud/user?limit=2&offset=2", full, -1, map[string]string{
+			"first": "/api/v1/crud/user?limit=2&offset=0",
+			"prev":  "/api/v1/crud/user?limit=2&offset=0",
+			"next":  "/api/v1/crud/user?limit=2&offset=4",
+		}},
+		{"/api/v1/crud/user?limit=2", full[:1], -1, map[string]string{
+			"first": "/api/v1/crud/user?limit=2&offset=0",
+		}},
+		{"/api/v1/crud/user?limit=2&offset=3", full, 7, map[string]string{
+			"first": "/api/v1/crud/user?limit=2&offset=0",
+			"prev":  "/api/v1/crud/user?limit=2&offset=1",
+			"next":  "/api/v1/crud/user?limit=2&offset=5",
+			"last":  "/api/v1/crud/user?limit=2&offset=6",
+		}},
+		{"/api/v1/crud/user?limit=2&offset=6", full[:1], 7, map[string]string{
+			"first": "/api/v1/crud/user?limit=2&offset=0",
+			"prev":  "/api/v1/crud/user?limit=2&offset=4",
+			"last":  "/api/v1/crud/user?limit=2&offset=6",
+		}},
+	}
+
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.url, nil)
+		var total *int64
+		if test.total >= 0 {
+			total = &test.total
+		}
+		p, err := a.newPage(r, "user", test.rows, total)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(p.links, test.links) {
+			t.Errorf("%s - got links %v, want %v", test.url, p.links, test.links)
+		}
+	}
+
+	// the headers and envelope
+	r, _ := http.NewRequest("GET", "/api/v1/crud/user?limit=2&envelope=true", nil)
+	total := int64(7)
+	p, _ := a.newPage(r, "user", full, &total)
+	w := httptest.NewRecorder()
+	p.setHeaders(w)
+	if g, want := w.Header().Get("X-Total-Count"), "7"; g != want {
+		t.Errorf("got X-Total-Count (%s), want (%s)", g, want)
+	}
+	if g, want := w.Header().Get("Link"), `</api/v1/crud/user?envelope=true&limit=2&offset=0>; rel="first", `+
+		`</api/v1/crud/user?envelope=true&limit=2&offset=2>; rel="next", `+
+		`</api/v1/crud/user?envelope=true&limit=2&offset=6>; rel="last"`; g != want {
+		t.Errorf("got Link (%s), want (%s)", g, want)
+	}
+	body := p.body(r.URL.Query()).(map[string]interface{})
+	meta := body["meta"].(map[string]interface{})
+	if meta["total"] != int64(7) || meta["count"] != 2 || meta["limit"] != 2 || meta["offset"] != 0 {
+		t.Errorf("unexpected meta %v", meta)
+	}
+}
@@ -0,0 +1,143 @@
+package apid
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+/***********************
+ *   Exposure Policy   *
+ ***********************/
+
+/*
+by default every table and column is served. a Policy narrows that down
+before the Apid is built:
+    include    tables to serve, every table if empty
+    exclude    tables never to serve, even if included
+    hidden     columns that can't be read, written, filtered, or seen in _meta
+    read_only  columns that are returned but never written
+    write_only columns that can be written but are never returned or filtered
+tables are matched by name (schema.table in multi-schema mode) and columns
+by table.column, either of which can be a glob such as `audit_*` or
+`*.password_hash`. primary key columns can't be hidden or write only since
+records are found by them, and foreign keys on columns that can't be read
+are dropped from the relationships.
+*/
+
+// Policy decides which tables and columns are exposed
+type Policy struct {
+	Include   []string `json:"include"`
+	Exclude   []string `json:"exclude"`
+	Hidden    []string `json:"hidden"`
+	ReadOnly  []string `json:"read_only"`
+	WriteOnly []string `json:"write_only"`
+}
+
+// LoadPolicy reads a policy from a json file
+func LoadPolicy(file string) (*Policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &Policy{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("bad policy %s: %s", file, err)
+	}
+	return p, nil
+}
+
+// matches is true if name matches any of the globs
+func matches(globs []string, name string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply removes the tables and columns the policy doesn't expose and
+// marks read only and write only columns. It changes tables in place.
+func (p *Policy) Apply(tables map[string]*Table) error {
+	for _, globs := range [][]string{p.Include, p.Exclude, p.Hidden, p.ReadOnly, p.WriteOnly} {
+		for _, g := range globs {
+			if _, err := path.Match(g, ""); err != nil {
+				return fmt.Errorf("bad pattern (%s) in policy", g)
+			}
+		}
+	}
+
+	for key := range tables {
+		if (len(p.Include) > 0 && !matches(p.Include, key)) || matches(p.Exclude, key) {
+			delete(tables, key)
+		}
+	}
+
+	for key, t := range tables {
+		t.ReadOnlyCols = make(map[string]bool)
+		t.WriteOnlyCols = make(map[string]bool)
+		pKeys := t.PrimaryKeys()
+		t.Primary = pKeys
+
+		cols := make([]*TableSchema, 0, len(t.Cols))
+		for _, c := range t.Cols {
+			name := c.COLUMN_NAME.String
+			switch column := key + "." + name; {
+			case matches(p.Hidden, column):
+				t.Hidden = append(t.Hidden, name)
+				continue
+			case matches(p.ReadOnly, column) && matches(p.WriteOnly, column):
+				return fmt.Errorf("column (%s) can't be both read only and write only", column)
+			case matches(p.ReadOnly, column):
+				t.ReadOnlyCols[name] = true
+			case matches(p.WriteOnly, column):
+				t.WriteOnlyCols[name] = true
+			}
+			cols = append(cols, c)
+		}
+		t.Cols = cols
+
+		for _, k := range pKeys {
+			if !t.readable(k) {
+				return fmt.Errorf("primary key column (%s.%s) can't be hidden or write only", key, k)
+			}
+		}
+	}
+
+	// relationships are only followed through columns that can be read
+	for _, t := range tables {
+		fKeys := make([]*ForeignKey, 0, len(t.ForeignKeys))
+		for _, fk := range t.ForeignKeys {
+			parent, ok := tables[fk.RefTable]
+			if ok && t.readable(fk.Cols...) && parent.readable(fk.RefCols...) {
+				fKeys = append(fKeys, fk)
+			}
+		}
+		t.ForeignKeys = fKeys
+	}
+	relate(tables)
+
+	return nil
+}
+
+// readable is true if every one of cols is on the table and can be returned
+func (t *Table) readable(cols ...string) bool {
+	for _, c := range cols {
+		if t.Col(c) == nil || t.WriteOnlyCols[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// restricted is true if the policy keeps any column from being read, so
+// `select *` can't be used
+func (t *Table) restricted() bool {
+	return len(t.Hidden) > 0 || len(t.WriteOnlyCols) > 0
+}
@@ -0,0 +1,159 @@
+package apid
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// builds an Apid with a user table and a couple of others, then applies p
+func testPolicy(p *Policy) (*Apid, error) {
+	a := testApid("user", "id", "name", "password_hash", "created_at", "api_key")
+	for name, t := range testApid("audit_log", "id", "entry").Tables {
+		a.Tables[name] = t
+	}
+	for name, t := range testApid("settings", "id", "user_id", "setting").Tables {
+		t.ForeignKeys = []*ForeignKey{{Name: "fk_settings_user", Cols: []string{"user_id"}, RefTable: "user", RefCols: []string{"id"}}}
+		a.Tables[name] = t
+	}
+	return a, p.Apply(a.Tables)
+}
+
+func TestPolicyTables(t *testing.T) {
+	var tests = []struct {
+		policy Policy
+		want   string
+	}{
+		{Policy{}, "audit_log,settings,user"},
+		{Policy{Include: []string{"user", "settings"}}, "settings,user"},
+		{Policy{Exclude: []string{"audit_*"}}, "settings,user"},
+		{Policy{Include: []string{"*"}, Exclude: []string{"user"}}, "audit_log,settings"},
+	}
+
+	for _, test := range tests {
+		a, err := testPolicy(&test.policy)
+		if err != nil {
+			t.Errorf("%+v - unexpected error %s", test.policy, err)
+			continue
+		}
+		names := make([]string, 0)
+		for _, name := range []string{"audit_log", "settings", "user"} {
+			if _, ok := a.Tables[name]; ok {
+				names = append(names, name)
+			}
+		}
+		if g, w := strings.Join(names, ","), test.want; g != w {
+			t.Errorf("%+v - got tables (%s), want (%s)", test.policy, g, w)
+		}
+	}
+
+	// relationships to tables that aren't served go with them
+	a, _ := testPolicy(&Policy{Exclude: []string{"user"}})
+	if g := len(a.Tables["settings"].Relations); g != 0 {
+		t.Errorf("got %d relations to an excluded table, want 0", g)
+	}
+}
+
+func TestPolicyColumns(t *testing.T) {
+	a, err := testPolicy(&Policy{
+		Hidden:    []string{"*.password_hash"},
+		ReadOnly:  []string{"user.created_at"},
+		WriteOnly: []string{"user.api_key", "settings.user_id"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// hidden and write only columns are never selected
+	for _, test := range []struct{ query, cols string }{
+		{"", "id, name, created_at"},
+		{"exclude=name", "id, created_at"},
+		{"fields=name", "name"},
+	} {
+		params, _ := url.ParseQuery(test.query)
+		fields, exclude := projection(params, "")
+		cols, err := a.selectColumns("user", fields, exclude, nil)
+		if err != nil {
+			t.Errorf("%s - unexpected error %s", test.query, err)
+			continue
+		}
+		if got := strings.Join(cols, ", "); got != test.cols {
+			t.Errorf("%s - got select list (%s), want (%s)", test.query, got, test.cols)
+		}
+	}
+	for _, query := range []string{"fields=api_key", "fields=password_hash", "api_key=x", "orderby=api_key"} {
+		params, _ := url.ParseQuery(query)
+		if _, _, err := a.selectQuery("user", params); err == nil {
+			t.Errorf("%s - expected an error reading a column the policy keeps back", query)
+		}
+	}
+
+	// read only and hidden columns are never written
+	if _, _, err := a.insertQuery("user", map[string]interface{}{"name": "x", "api_key": "k"}); err != nil {
+		t.Errorf("write only columns should be writable, got %s", err)
+	}
+	for _, v := range []map[string]interface{}{
+		{"name": "x", "created_at": "now"},
+		{"name": "x", "password_hash": "p"},
+	} {
+		if _, _, err := a.insertQuery("user", v); err == nil {
+			t.Errorf("%v - expected an error inserting", v)
+		}
+		if _, _, err := a.recordUpdateQuery("user", []string{"id"}, "1", v, false); err == nil {
+			t.Errorf("%v - expected an error updating", v)
+		}
+	}
+
+	// a full replace leaves read only and write only columns alone
+	q, _, err := a.recordUpdateQuery("user", []string{"id"}, "1", map[string]interface{}{"name": "x"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if strings.Contains(q, "created_at") || strings.Contains(q, "password_hash") || strings.Contains(q, "api_key") {
+		t.Errorf("replace should only reset readable, writable columns, got %s", q)
+	}
+	if q, _, _ := a.recordUpdateQuery("user", []string{"id"}, "1", map[string]interface{}{"name": "x", "api_key": "k"}, true); !strings.Contains(q, "api_key") {
+		t.Errorf("replace should write a write only column it's given, got %s", q)
+	}
+
+	// foreign keys through write only columns can't be followed
+	if g := len(a.Tables["user"].Relations); g != 0 {
+		t.Errorf("got %d relations through a write only column, want 0", g)
+	}
+
+	// _meta follows the policy too
+	get := GenMeta(a.Tables["user"], "/api/v1/crud/user/", "GET")
+	post := GenMeta(a.Tables["user"], "/api/v1/crud/user/", "POST")
+	put := GenMeta(a.Tables["user"], "/api/v1/crud/user/", "PUT")
+	for _, test := range []struct {
+		meta Meta
+		col  string
+		want bool
+	}{
+		{get, "password_hash", false},
+		{get, "api_key", false},
+		{get, "created_at", true},
+		{post, "password_hash", false},
+		{post, "api_key", true},
+		{post, "created_at", false},
+		{put, "id", true},
+		{put, "created_at", false},
+	} {
+		if _, ok := test.meta.Properties[test.col]; ok != test.want {
+			t.Errorf("%s _meta - got %s listed %t, want %t", test.meta.Method, test.col, ok, test.want)
+		}
+	}
+}
+
+func TestPolicyErrors(t *testing.T) {
+	for _, p := range []Policy{
+		{Include: []string{"[user"}},
+		{Hidden: []string{"user.id"}},
+		{WriteOnly: []string{"*.id"}},
+		{ReadOnly: []string{"user.name"}, WriteOnly: []string{"user.*"}},
+	} {
+		if _, err := testPolicy(&p); err == nil {
+			t.Errorf("%+v - expected an error", p)
+		}
+	}
+}
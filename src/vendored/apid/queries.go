@@ -1,192 +1,516 @@
 package apid
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+
+	"vendored/apid/query"
 )
 
 /***********************
  *   Query Composers   *
  ***********************/
 
-// TODO: these queries are all so similar. We can prolly make this way more DRY.
+/*
+the composers turn a request into a query.Request (filters, values to set,
+ordering, and paging) and leave the sql to the query package, which only
+takes identifiers that are columns of the table and quotes all of them.
+values are always placeholder arguments. the builder's column errors come
+back as 400s.
+*/
+
+// apid speaks mysql
+var dialect = query.MySQL
+
+// queryTable is the builder's model of a table
+func (a *Apid) queryTable(table string) *query.Table {
+	t := a.Tables[table]
+	qt := &query.Table{Name: table, ReadOnly: t.ReadOnlyCols, WriteOnly: t.WriteOnlyCols}
+	if a.MultiSchema {
+		qt.Name, qt.Schema = t.baseName(), t.Schema
+	}
+	for _, c := range t.Cols {
+		qt.Columns = append(qt.Columns, c.COLUMN_NAME.String)
+	}
+	return qt
+}
+
+// built passes on a built query, making column errors 400s
+func built(q string, args []interface{}, err error) (string, []interface{}, error) {
+	var ce *query.ColumnError
+	if errors.As(err, &ce) {
+		return "", nil, &Error{Status: http.StatusBadRequest, Detail: ce.Error(), Table: ce.Table, Column: ce.Column}
+	}
+	return q, args, err
+}
 
 // InsertQueryComposer creates a mysql update query
-func InsertQueryComposer(table string, r *http.Request) (string, []interface{}, error) {
-	body, err := ioutil.ReadAll(r.Body)
+func (a *Apid) InsertQueryComposer(table string, r *http.Request) (string, []interface{}, error) {
+	v, err := a.readJSONBody(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return a.insertQuery(table, v)
+}
 
+// insertQuery builds the insert for a set of column values
+func (a *Apid) insertQuery(table string, v map[string]interface{}) (string, []interface{}, error) {
+	if len(v) == 0 {
+		return "", nil, &Error{Status: http.StatusBadRequest, Detail: "nothing to insert into " + table, Table: table}
+	}
+	a.bindValues(table, v)
+	q, args, err := built(dialect.Insert(a.queryTable(table), &query.Request{Set: v}))
 	if err != nil {
-		log.Fatal(err)
+		return "", nil, err
+	}
+	if err := a.validate(table, v, true); err != nil {
+		return "", nil, err
 	}
+	return q, args, nil
+}
 
-	// the body should be key value pairs, populate them into `v`
-	v := make(map[string]interface{})
-	err = json.Unmarshal(body, &v)
+// DeleteQueryComposer creates a mysql delete query. Filters may be given
+// in the body, the query string, or both.
+func (a *Apid) DeleteQueryComposer(table string, r *http.Request) (string, []interface{}, error) {
+	v, err := a.readJSONBody(r)
 	if err != nil {
-		log.Print("error decoding json body to map ", err)
+		return "", nil, err
 	}
+	return a.deleteQuery(table, v, r.URL.Query())
+}
 
-	// set up the query
-	q := fmt.Sprintf("insert into %v set ", table)
-	set := ""
-	args := make([]interface{}, 0)
+// deleteQuery builds the delete for a set of filters and a limit
+func (a *Apid) deleteQuery(table string, v map[string]interface{}, filters url.Values) (string, []interface{}, error) {
+	limitArg, ok := v["limit"]
+	if !ok {
+		// if limit was not populated, then err out.
+		return "", nil, errorf(http.StatusBadRequest, "Missing limit key in delete query on %s", table)
+	}
+	limit, err := strconv.Atoi(paramString(limitArg))
+	if err != nil || limit <= 0 {
+		return "", nil, errorf(http.StatusBadRequest, "limit (%s) must be a positive number", paramString(limitArg))
+	}
 
-	for k, v := range v {
-		set += fmt.Sprintf("%v=?,", k) // better: strings.Join()
-		args = append(args, v)
+	params := bodyToParams(v)
+	for k, vals := range filters {
+		for _, val := range vals {
+			params.Add(k, val)
+		}
 	}
 
-	set = set[:len(set)-1] // remove trailing comma
+	conds, err := a.filters(table, params)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(conds) == 0 {
+		return "", nil, errorf(http.StatusBadRequest, "Missing filter in delete query on %s", table)
+	}
 
-	return q + set, args, nil
+	return built(dialect.Delete(a.queryTable(table), &query.Request{Where: conds, Limit: limit}))
 }
 
-// DeleteQueryComposer creates a mysql update query
-func DeleteQueryComposer(table string, r *http.Request) (string, []interface{}, error) {
-	body, err := ioutil.ReadAll(r.Body)
+// UpdateQueryComposer creates a mysql update query. The record is found by
+// the primary key in the body or, for bulk updates, the query string filters.
+func (a *Apid) UpdateQueryComposer(table string, pKeys []string, r *http.Request) (string, []interface{}, error) {
+	v, err := a.readJSONBody(r)
 	if err != nil {
-		log.Fatal(err)
+		return "", nil, err
 	}
+	return a.updateQuery(table, pKeys, v, r.URL.Query())
+}
 
-	// the body should be key value pairs, populate them into `v`
-	v := make(map[string]interface{})
-	err = json.Unmarshal(body, &v)
-	if err != nil {
-		log.Print("error decoding json body to map ", err)
+// updateQuery builds the update for a set of column values keyed on the
+// primary key, or on filters if no primary key columns are among the values
+func (a *Apid) updateQuery(table string, pKeys []string, v map[string]interface{}, filters url.Values) (string, []interface{}, error) {
+	isKey := make(map[string]bool, len(pKeys))
+	for _, k := range pKeys {
+		isKey[k] = true
 	}
 
-	// set up the query
-	q := fmt.Sprintf("delete from %v where ", table)
-	where := ""
-	limit := ""
-	var limitArg interface{}
-	args := make([]interface{}, 0)
+	req := &query.Request{Set: make(map[string]interface{}, len(v))}
+	for k, val := range v {
+		if !isKey[k] {
+			req.Set[k] = val
+		}
+	}
+	if len(req.Set) == 0 {
+		return "", nil, &Error{Status: http.StatusBadRequest, Detail: "nothing to update on " + table, Table: table}
+	}
 
-	for k, v := range v {
-		if k == "limit" {
-			limit = " limit ?"
-			limitArg = v
-			continue
+	// every key column, or none of them for a bulk update
+	key := make([]interface{}, 0, len(pKeys))
+	for _, k := range pKeys {
+		if kv, ok := v[k]; ok {
+			key = append(key, kv)
+		}
+	}
+	if len(key) > 0 {
+		if len(key) < len(pKeys) {
+			return "", nil, errorf(http.StatusBadRequest, "Missing part of primary key (%s) in query on %s", strings.Join(pKeys, ","), table)
 		}
-		where += fmt.Sprintf("%v=? and", k) // better: strings.Join()
-		args = append(args, v)
+		req.KeyCols, req.Keys, req.Limit = pKeys, [][]interface{}{key}, 1
+		return a.builtUpdate(table, req)
 	}
 
-	// if limit was not populated, then err out.
-	if len(limit) == 0 {
-		return "", nil, errors.New("Missing limit key in delete query on " + table)
+	// bulk update on the filters
+	conds, err := a.filters(table, filters)
+	if err != nil {
+		return "", nil, err
 	}
-	args = append(args, limitArg)
-	where = where[:len(where)-3] // remove trailing and
+	// if there are no conditions, then we were not given the primary key or filters.
+	if len(conds) == 0 {
+		return "", nil, errorf(http.StatusBadRequest, "Missing primary key or filter in query on %s", table)
+	}
+	req.Where = conds
 
-	return q + where + limit, args, nil
+	return a.builtUpdate(table, req)
 }
 
-// UpdateQueryComposer creates a mysql update query
-func UpdateQueryComposer(table, pKey string, r *http.Request) (string, []interface{}, error) {
-	body, err := ioutil.ReadAll(r.Body)
+// builtUpdate builds an update and validates the values it sets
+func (a *Apid) builtUpdate(table string, req *query.Request) (string, []interface{}, error) {
+	a.bindValues(table, req.Set)
+	q, args, err := built(dialect.Update(a.queryTable(table), req))
 	if err != nil {
-		log.Fatal(err)
+		return "", nil, err
+	}
+	if err := a.validate(table, req.Set, false); err != nil {
+		return "", nil, err
 	}
+	return q, args, nil
+}
 
-	// the body should be key value pairs, populate them into `v`
-	v := make(map[string]interface{})
-	err = json.Unmarshal(body, &v)
+// recordKey splits a `k1,k2` url id into a value for each primary key column
+func recordKey(table string, pKeys []string, id string) ([]string, error) {
+	parts := strings.Split(id, ",")
+	if len(parts) != len(pKeys) {
+		return nil, errorf(http.StatusBadRequest, "id (%s) on %s needs a value for each of %s", id, table, strings.Join(pKeys, ","))
+	}
+	return parts, nil
+}
+
+// recordSelectQuery selects a single record by primary key. Only the
+// fields and exclude params apply.
+func (a *Apid) recordSelectQuery(table string, pKeys []string, id string, params url.Values) (string, []interface{}, error) {
+	parts, err := recordKey(table, pKeys, id)
 	if err != nil {
-		log.Print("error decoding json body to map ", err)
+		return "", nil, err
+	}
+	recordParams := url.Values{}
+	for i, k := range pKeys {
+		recordParams.Set(k, parts[i])
 	}
+	for _, k := range []string{"fields", "exclude", "expand"} {
+		if v, ok := params[k]; ok {
+			recordParams[k] = v
+		}
+	}
+	return a.selectQuery(table, recordParams)
+}
 
-	// set up the query
-	q := fmt.Sprintf("update %v set ", table)
-	set := ""
-	where := ""
-	var whereArg interface{}
-	args := make([]interface{}, 0)
+// recordUpdateQuery updates a single record by primary key. With replace
+// (PUT), every column not in v is set back to its default, except the write
+// only ones: a client can't read them back, so leaving one out of a PUT
+// mustn't wipe it.
+func (a *Apid) recordUpdateQuery(table string, pKeys []string, id string, v map[string]interface{}, replace bool) (string, []interface{}, error) {
+	parts, err := recordKey(table, pKeys, id)
+	if err != nil {
+		return "", nil, err
+	}
+	for i, k := range pKeys {
+		if bodyId, ok := v[k]; ok && paramString(bodyId) != parts[i] {
+			return "", nil, errorf(http.StatusBadRequest, "%s in body (%s) does not match the url (%s)", k, paramString(bodyId), parts[i])
+		}
+		v[k] = parts[i]
+	}
 
-	for k, v := range v {
-		// it would be nice to have table.Cols as map rather than slice
-		if k == pKey {
-			where = fmt.Sprintf(" where %v=? limit 1", pKey)
-			whereArg = v
-			continue
+	if replace {
+		t := a.Tables[table]
+		for _, c := range t.Cols {
+			name, extra := c.COLUMN_NAME.String, strings.ToLower(c.EXTRA.String)
+			if _, ok := v[name]; ok || t.ReadOnlyCols[name] || t.WriteOnlyCols[name] || strings.Contains(extra, "auto_increment") || strings.Contains(extra, "generated") {
+				continue
+			}
+			v[name] = query.Default
 		}
-		set += fmt.Sprintf("%v=?,", k) // better: strings.Join()
-		args = append(args, v)
 	}
 
-	// if where was not populated, then we were not given the primary key in the query.
-	if len(where) == 0 {
-		return "", nil, errors.New("Missing primary key in query on " + table)
+	return a.updateQuery(table, pKeys, v, nil)
+}
+
+// recordDeleteQuery deletes a single record by primary key
+func (a *Apid) recordDeleteQuery(table string, pKeys []string, id string) (string, []interface{}, error) {
+	parts, err := recordKey(table, pKeys, id)
+	if err != nil {
+		return "", nil, err
+	}
+	key := make([]interface{}, 0, len(parts))
+	for _, p := range parts {
+		key = append(key, p)
+	}
+	return built(dialect.Delete(a.queryTable(table), &query.Request{KeyCols: pKeys, Keys: [][]interface{}{key}, Limit: 1}))
+}
+
+// DefaultMaxBodyBytes is the largest request body taken unless
+// Apid.MaxBodyBytes says otherwise
+const DefaultMaxBodyBytes = 8 << 20
+
+// readBody reads the request body, refusing bodies over MaxBodyBytes
+func (a *Apid) readBody(r *http.Request) ([]byte, error) {
+	max := a.MaxBodyBytes
+	if max <= 0 {
+		max = DefaultMaxBodyBytes
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, &Error{Status: http.StatusBadRequest, Detail: "unable to read body", Err: err}
+	}
+	if int64(len(body)) > max {
+		return nil, errorf(http.StatusRequestEntityTooLarge, "body is larger than %d bytes", max)
 	}
-	args = append(args, whereArg)
-	set = set[:len(set)-1] // remove trailing comma
+	return body, nil
+}
 
-	return q + set + where, args, nil
+// readJSONBody decodes a json object body
+func (a *Apid) readJSONBody(r *http.Request) (map[string]interface{}, error) {
+	v := make(map[string]interface{})
+	body, err := a.readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, errorf(http.StatusBadRequest, "empty body, expected a json object")
+	}
+	// UseNumber keeps numbers as they were sent, where a float64 would
+	// round anything past 2^53 and overflow an unsigned bigint
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, errorf(http.StatusBadRequest, "error decoding json body: %s", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errorf(http.StatusBadRequest, "error decoding json body: more than one value")
+	}
+	if v == nil {
+		// a body of null
+		v = make(map[string]interface{})
+	}
+	return v, nil
 }
 
 // refactor to take interface with methods *.URL.RawQuery
-func (a *Apid) SelectQueryComposer(table string, r *http.Request) (string, []interface{}) {
+func (a *Apid) SelectQueryComposer(table string, r *http.Request) (string, []interface{}, error) {
 	params, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
-		log.Print("error", err)
+		a.log().Print("error", err)
 	}
 
-	// init the query
-	q := fmt.Sprintf("select * from %v", table)
-	var where, limit, offset, orderby string
-	args := make([]interface{}, 0)
+	return a.selectQuery(table, params)
+}
 
-	// consider creating this at start time
-	cols := make(map[string]bool, 0)
-	for _, c := range a.Tables[table].Cols {
-		cols[c.COLUMN_NAME.String] = true
+// selectQuery builds the select for a set of search params
+func (a *Apid) selectQuery(table string, params url.Values) (string, []interface{}, error) {
+	req, err := a.selectRequest(table, params)
+	if err != nil {
+		return "", nil, err
+	}
+	q, args, err := built(dialect.Select(a.queryTable(table), req))
+	if err != nil {
+		return "", nil, err
 	}
+	a.log().Print(q, " ", args)
+	return q, args, nil
+}
 
-	for k, v := range params {
-		switch k {
-		case "limit":
-			// feels wrong. where are parameterized query builders?
-			l, err := strconv.Atoi(v[0])
-			if err != nil {
-				log.Printf("skipping limit ", err)
-			}
-			limit = fmt.Sprintf(" limit %d", l)
-		case "offset":
-			l, err := strconv.Atoi(v[0])
-			if err != nil {
-				log.Printf("skipping offset ", err)
+// selectRequest parses the search params: the fields, filters, order, and page
+func (a *Apid) selectRequest(table string, params url.Values) (*query.Request, error) {
+	req := &query.Request{}
+	var err error
+	if req.Fields, err = a.selectList(table, params); err != nil {
+		return nil, err
+	}
+	if req.Where, err = a.filters(table, params); err != nil {
+		return nil, err
+	}
+	if req.Order, err = a.parseOrderBy(table, params.Get("orderby")); err != nil {
+		return nil, err
+	}
+
+	// keyset paging replaces offset with a condition on the order columns
+	if isCursorPaging(params) {
+		if _, ok := params["offset"]; ok {
+			return nil, errorf(http.StatusBadRequest, "offset and cursor can not be used together")
+		}
+		if req.Order, err = a.cursorTerms(table, params); err != nil {
+			return nil, err
+		}
+		if req.After, err = a.cursorKeys(table, req.Order, params.Get("cursor"), params.Get("orderby")); err != nil {
+			return nil, err
+		}
+		req.Limit = DefaultPageSize
+	}
+
+	if v := params.Get("limit"); len(v) > 0 {
+		if req.Limit, err = strconv.Atoi(v); err != nil || req.Limit <= 0 {
+			return nil, errorf(http.StatusBadRequest, "limit (%s) must be a positive number", v)
+		}
+	}
+	if v := params.Get("offset"); len(v) > 0 {
+		if req.Offset, err = strconv.Atoi(v); err != nil || req.Offset < 0 {
+			return nil, errorf(http.StatusBadRequest, "offset (%s) must be a number", v)
+		}
+		// an offset pages, and there's no page without a limit
+		if req.Limit == 0 {
+			return nil, errorf(http.StatusBadRequest, "offset (%s) needs a limit", v)
+		}
+	}
+	return req, nil
+}
+
+// selectList turns the `fields` and `exclude` params into the columns to
+// select, in table order. Without either, it's empty and everything is
+// selected. Fields of expanded relationships are prefixed with the
+// relationship name (user.name) and are left to the expand query.
+func (a *Apid) selectList(table string, params url.Values) ([]string, error) {
+	// columns needed to page and expand always come back
+	must := make([]string, 0)
+	if isCursorPaging(params) {
+		terms, err := a.cursorTerms(table, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range terms {
+			must = append(must, t.Col)
+		}
+	}
+	rels, err := a.expansions(table, params)
+	if err != nil {
+		return nil, err
+	}
+	expanded := make(map[string]bool, len(rels))
+	for _, rel := range rels {
+		must = append(must, rel.Cols...)
+		expanded[rel.Name] = true
+	}
+
+	for _, col := range splitValues(append(params["fields"], params["exclude"]...)) {
+		if i := strings.Index(col, "."); i >= 0 && !expanded[col[:i]] {
+			return nil, &Error{Status: http.StatusBadRequest, Detail: fmt.Sprintf("unknown field (%s) on %s", col, table), Table: table, Column: col}
+		}
+	}
+
+	fields, exclude := projection(params, "")
+	return a.selectColumns(table, fields, exclude, must)
+}
+
+// selectColumns is the select list for the comma separated fields and
+// exclude lists, empty for everything. Columns in must are selected
+// whenever anything is.
+func (a *Apid) selectColumns(table, fields, exclude string, must []string) ([]string, error) {
+	// a policy that keeps columns back means naming the rest
+	if len(fields) == 0 && len(exclude) == 0 && !a.Tables[table].restricted() {
+		return nil, nil
+	}
+
+	cols := a.Tables[table].colSet()
+	parse := func(list string) (map[string]bool, error) {
+		set := make(map[string]bool)
+		for _, col := range splitValues([]string{list}) {
+			if !cols[col] {
+				return nil, &Error{Status: http.StatusBadRequest, Detail: fmt.Sprintf("unknown field (%s) on %s", col, table), Table: table, Column: col}
 			}
-			offset = fmt.Sprintf(" offset %d", l)
-		case "orderby":
-		default:
-			// prolly better to use strings.Join()
-			if ok := cols[k]; !ok {
-				log.Print("bad column ", k) // 404 to user?
-				continue
+			set[col] = true
+		}
+		return set, nil
+	}
+
+	include, err := parse(fields)
+	if err != nil {
+		return nil, err
+	}
+	omit, err := parse(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, col := range must {
+		if len(include) > 0 {
+			include[col] = true
+		}
+		delete(omit, col)
+	}
+
+	selected := make([]string, 0)
+	for _, c := range a.Tables[table].Cols {
+		name := c.COLUMN_NAME.String
+		if cols[name] && (len(include) == 0 || include[name]) && !omit[name] {
+			selected = append(selected, name)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, errorf(http.StatusBadRequest, "no fields left to select on %s", table)
+	}
+
+	return selected, nil
+}
+
+// projection picks the `fields` and `exclude` entries for an expanded
+// relationship, without the prefix. An empty prefix picks the entries for
+// the table itself.
+func projection(params url.Values, prefix string) (string, string) {
+	pick := func(values []string) string {
+		picked := make([]string, 0)
+		for _, col := range splitValues(values) {
+			i := strings.Index(col, ".")
+			switch {
+			case len(prefix) == 0 && i < 0:
+				picked = append(picked, col)
+			case len(prefix) > 0 && i >= 0 && col[:i] == prefix:
+				picked = append(picked, col[i+1:])
 			}
-			where += " " + k + "=? and"
-			args = append(args, v[0])
 		}
+		return strings.Join(picked, ",")
 	}
+	return pick(params["fields"]), pick(params["exclude"])
+}
 
-	// prep `where` and remove trailing 'and'
-	if len(where) > 6 {
-		where = " where " + where[:len(where)-4]
+// parseOrderBy turns `-created_at,name` into the order. A leading `-` sorts
+// descending and `+` (or nothing) ascending. Without an orderby, results are
+// in primary key order so offset paging is stable.
+func (a *Apid) parseOrderBy(table, orderby string) ([]query.Order, error) {
+	terms := make([]query.Order, 0)
+	if len(orderby) == 0 {
+		for _, pKey := range a.Tables[table].PrimaryKeys() {
+			terms = append(terms, query.Order{Col: pKey})
+		}
+		return terms, nil
 	}
 
-	// only allow offset if limit is present
-	if len(limit) == 0 && len(offset) > 0 {
-		offset = ""
-		log.Print("Removing offset because limit is missing")
+	cols := a.Tables[table].colSet()
+	for _, col := range strings.Split(orderby, ",") {
+		// a `+` in a query string arrives as a space
+		col = strings.TrimSpace(col)
+		term := query.Order{}
+		switch {
+		case strings.HasPrefix(col, "-"):
+			term.Desc = true
+			col = col[1:]
+		case strings.HasPrefix(col, "+"):
+			col = col[1:]
+		}
+		if !cols[col] {
+			return nil, &Error{Status: http.StatusBadRequest, Detail: fmt.Sprintf("unknown orderby column (%s) on %s", col, table), Table: table, Column: col}
+		}
+		term.Col = col
+		terms = append(terms, term)
 	}
 
-	q += where + orderby + limit + offset
-	log.Print(q, " ", args)
-	return q, args
+	return terms, nil
 }
@@ -0,0 +1,287 @@
+package apid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"vendored/apid/query"
+)
+
+func TestSelectList(t *testing.T) {
+	a := testApid("user", "id", "name", "email", "bio")
+
+	var tests = []struct {
+		query string
+		want  string
+	}{
+		{"", ""},                       // everything
+		{"fields=name,id", "id, name"}, // always table order
+		{"exclude=bio", "id, name, email"},
+		{"fields=id,bio&exclude=bio", "id"},
+	}
+	for _, test := range tests {
+		params, _ := url.ParseQuery(test.query)
+		list, err := a.selectList("user", params)
+		if err != nil {
+			t.Errorf("%s - unexpected error %s", test.query, err)
+		}
+		if got := strings.Join(list, ", "); got != test.want {
+			t.Errorf("%s - got (%s), want (%s)", test.query, got, test.want)
+		}
+	}
+
+	for _, q := range []string{"fields=nope", "exclude=id,nope", "fields=id&exclude=id", "fields=(select%20password)"} {
+		params, _ := url.ParseQuery(q)
+		if got, err := a.selectList("user", params); err == nil {
+			t.Errorf("%s - expected error, got %v", q, got)
+		}
+	}
+}
+
+func TestParseOrderBy(t *testing.T) {
+	a := testApid("user", "id", "name", "created_at")
+
+	var tests = []struct {
+		orderby string
+		want    []query.Order
+	}{
+		{"", []query.Order{{Col: "id"}}},
+		{"name", []query.Order{{Col: "name"}}},
+		{"-created_at,name", []query.Order{{Col: "created_at", Desc: true}, {Col: "name"}}},
+		{" name,+id", []query.Order{{Col: "name"}, {Col: "id"}}}, // `+` decodes to a space
+	}
+	for _, test := range tests {
+		got, err := a.parseOrderBy("user", test.orderby)
+		if err != nil {
+			t.Errorf("%s - unexpected error %s", test.orderby, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s - got %v, want %v", test.orderby, got, test.want)
+		}
+	}
+
+	for _, orderby := range []string{"nope", "name,", "-", "name desc", "id;drop table user"} {
+		if got, err := a.parseOrderBy("user", orderby); err == nil {
+			t.Errorf("%s - expected error, got %v", orderby, got)
+		}
+	}
+
+	// no primary key, no default order
+	b := testApid("log")
+	if got, _ := b.parseOrderBy("log", ""); len(got) != 0 {
+		t.Errorf("expected no default order, got %v", got)
+	}
+}
+
+// limit and offset are checked, and an offset needs a limit to page by
+func TestLimitOffset(t *testing.T) {
+	a := testApid("user", "id", "name")
+
+	for _, test := range []struct {
+		query string
+		ok    bool
+	}{
+		{"limit=2&offset=4", true},
+		{"limit=2", true},
+		{"offset=4", false},
+		{"limit=0", false},
+		{"limit=2&offset=-1", false},
+	} {
+		params, _ := url.ParseQuery(test.query)
+		_, _, err := a.selectQuery("user", params)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s - got error %v", test.query, err)
+		}
+	}
+}
+
+func TestCompositeKeyQueries(t *testing.T) {
+	a := testApid("user_group", "user_id", "group_id", "role")
+	a.Tables["user_group"].Primary = []string{"group_id", "user_id"}
+	pKeys := a.Tables["user_group"].PrimaryKeys()
+
+	// the whole key finds one record
+	q, args, err := a.updateQuery("user_group", pKeys, map[string]interface{}{"user_id": 26, "group_id": 1, "role": "admin"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := "update `user_group` set `role` = ? where `group_id` = ? and `user_id` = ? limit ?"; q != w {
+		t.Errorf("got (%s), want (%s)", q, w)
+	}
+	if w := []interface{}{"admin", 1, 26, 1}; !reflect.DeepEqual(args, w) {
+		t.Errorf("got args %v, want %v", args, w)
+	}
+
+	// part of the key is an error, not a bulk update
+	if q, _, err := a.updateQuery("user_group", pKeys, map[string]interface{}{"user_id": 26, "role": "admin"}, nil); err == nil {
+		t.Errorf("expected error for part of the key, got (%s)", q)
+	}
+
+	// url ids are in key order
+	q, args, err = a.recordDeleteQuery("user_group", pKeys, "1,26")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := "delete from `user_group` where `group_id` = ? and `user_id` = ? limit ?"; q != w {
+		t.Errorf("got (%s), want (%s)", q, w)
+	}
+	if w := []interface{}{"1", "26", 1}; !reflect.DeepEqual(args, w) {
+		t.Errorf("got args %v, want %v", args, w)
+	}
+	if _, _, err := a.recordDeleteQuery("user_group", pKeys, "1"); err == nil {
+		t.Errorf("expected error for an id missing part of the key")
+	}
+
+	q, _, err = a.recordSelectQuery("user_group", pKeys, "1,26", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := "select * from `user_group` where `group_id` = ? and `user_id` = ? order by `group_id`, `user_id`"; q != w {
+		t.Errorf("got (%s), want (%s)", q, w)
+	}
+}
+
+func TestWriteComposers(t *testing.T) {
+	a := testApid("user", "id", "name", "email")
+
+	var tests = []struct {
+		name  string
+		query func() (string, []interface{}, error)
+		want  string
+		args  []interface{}
+	}{
+		{"insert", func() (string, []interface{}, error) {
+			return a.insertQuery("user", map[string]interface{}{"name": "jack", "email": "j@example.com"})
+		}, "insert into `user` (`email`, `name`) values (?, ?)", []interface{}{"j@example.com", "jack"}},
+		{"update", func() (string, []interface{}, error) {
+			return a.updateQuery("user", []string{"id"}, map[string]interface{}{"id": 1, "name": "jack"}, nil)
+		}, "update `user` set `name` = ? where `id` = ? limit ?", []interface{}{"jack", 1, 1}},
+		{"bulk update", func() (string, []interface{}, error) {
+			return a.updateQuery("user", []string{"id"}, map[string]interface{}{"email": nil}, url.Values{"name": {"jack"}})
+		}, "update `user` set `email` = ? where `name` = ?", []interface{}{nil, "jack"}},
+		{"delete", func() (string, []interface{}, error) {
+			return a.deleteQuery("user", map[string]interface{}{"limit": 1, "name": "jack"}, nil)
+		}, "delete from `user` where `name` = ? limit ?", []interface{}{"jack", 1}},
+	}
+	for _, test := range tests {
+		q, args, err := test.query()
+		if err != nil {
+			t.Errorf("%s - unexpected error %s", test.name, err)
+			continue
+		}
+		if q != test.want {
+			t.Errorf("%s - got (%s), want (%s)", test.name, q, test.want)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s - got args %v, want %v", test.name, args, test.args)
+		}
+	}
+
+	// keys that aren't columns and empty bodies are 400s
+	for name, query := range map[string]func() (string, []interface{}, error){
+		"insert unknown": func() (string, []interface{}, error) {
+			return a.insertQuery("user", map[string]interface{}{"name=name,id": 1})
+		},
+		"insert empty": func() (string, []interface{}, error) { return a.insertQuery("user", map[string]interface{}{}) },
+		"update unknown": func() (string, []interface{}, error) {
+			return a.updateQuery("user", []string{"id"}, map[string]interface{}{"id": 1, "name`=1 -- ": 1}, nil)
+		},
+		"update empty": func() (string, []interface{}, error) {
+			return a.updateQuery("user", []string{"id"}, map[string]interface{}{"id": 1}, nil)
+		},
+		"delete unknown": func() (string, []interface{}, error) {
+			return a.deleteQuery("user", map[string]interface{}{"limit": 1, "1=1 or id": 1}, nil)
+		},
+	} {
+		q, _, err := query()
+		if e, ok := err.(*Error); !ok || e.Status != http.StatusBadRequest {
+			t.Errorf("%s - got (%s) and error %v, want a 400", name, q, err)
+		}
+	}
+
+	// a limit has to be a number
+	if q, _, err := a.deleteQuery("user", map[string]interface{}{"limit": "1; drop table user", "name": "jack"}, nil); err == nil {
+		t.Errorf("expected error for a bad limit, got (%s)", q)
+	}
+
+	// schema and table are quoted separately
+	a.MultiSchema = true
+	a.Tables["user"].Schema = "shop"
+	a.Tables["user"].Name = "shop.user"
+	if q, _, _ := a.insertQuery("user", map[string]interface{}{"name": "jack"}); !strings.HasPrefix(q, "insert into `shop`.`user` ") {
+		t.Errorf("got (%s), want the schema quoted", q)
+	}
+}
+
+// bad bodies get a 400 describing the problem before the db is touched
+func TestBadRequestBodies(t *testing.T) {
+	router := testApid("user", "id", "name").NewRouter()
+
+	for _, test := range []struct {
+		method, url, body string
+		column            string
+	}{
+		{"POST", "/api/v1/crud/user", `{"name":"jack","nope":1}`, "nope"},
+		{"POST", "/api/v1/crud/user", ``, ""},
+		{"POST", "/api/v1/crud/user", `{}`, ""},
+		{"POST", "/api/v1/crud/user", `[1]`, ""},
+		{"POST", "/api/v1/crud/user", `{"name":"jack"} {"name":"jill"}`, ""},
+		{"PUT", "/api/v1/crud/user", `{"id":1,"name; drop table user":1}`, "name; drop table user"},
+		{"PATCH", "/api/v1/crud/user/1", `{}`, ""},
+		{"DELETE", "/api/v1/crud/user", `{"limit":1,"nope":1}`, "nope"},
+	} {
+		req, _ := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+
+		if g, w := rw.Code, http.StatusBadRequest; g != w {
+			t.Errorf("%s %s %s - got status %d, want %d", test.method, test.url, test.body, g, w)
+			continue
+		}
+		var e Problem
+		if err := json.Unmarshal(rw.Body.Bytes(), &e); err != nil || e.Status != rw.Code || len(e.Detail) == 0 {
+			t.Errorf("%s %s %s - got body %s, want a problem", test.method, test.url, test.body, rw.Body.String())
+		}
+		if g, w := rw.Header().Get("Content-Type"), "application/problem+json"; g != w {
+			t.Errorf("%s %s %s - got content type (%s), want (%s)", test.method, test.url, test.body, g, w)
+		}
+		if e.Column != test.column {
+			t.Errorf("%s %s %s - got column (%s), want (%s)", test.method, test.url, test.body, e.Column, test.column)
+		}
+	}
+}
+
+// a table without a primary key has no records to name, which is the
+// request's fault whichever way it asks
+func TestNoPrimaryKey(t *testing.T) {
+	a := testApid("log", "entry")
+	a.Tables["log"].Cols[0].COLUMN_KEY.String = ""
+
+	for _, test := range []struct{ method, url, body string }{
+		{"PUT", "/api/v1/crud/log", `{"entry":"x"}`},
+		{"GET", "/api/v1/crud/log/1", ""},
+		{"PATCH", "/api/v1/crud/log/1", `{"entry":"x"}`},
+		{"DELETE", "/api/v1/crud/log/1", ""},
+	} {
+		req, _ := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		rw := httptest.NewRecorder()
+		a.NewRouter().ServeHTTP(rw, req)
+		if g, w := rw.Code, http.StatusBadRequest; g != w {
+			t.Errorf("%s %s - got status %d, want %d: %s", test.method, test.url, g, w, rw.Body.String())
+		}
+	}
+
+	_, err := a.runOperation(nil, Operation{Method: "update", Table: "log", Values: map[string]interface{}{"entry": "x"}})
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusBadRequest {
+		t.Errorf("transaction update - got %v, want a 400", err)
+	}
+	_, err = a.nestedFilters(httptest.NewRequest("GET", "/api/v1/crud/log/1/x", nil), &nestedRoute{root: "log", steps: []*Relation{{}}}, []string{"1"})
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusBadRequest {
+		t.Errorf("nested - got %v, want a 400", err)
+	}
+}
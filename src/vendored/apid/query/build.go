@@ -0,0 +1,516 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/******************
+ *   Statements   *
+ ******************/
+
+/*
+each statement is checked against the table before anything is written, then
+written front to back so numbered placeholders come out in order:
+    select <fields> from <table> where <conds> and <keys> and <after> order by <order> limit ? offset ?
+    select count(*) from <table> where <conds> and <keys>
+    insert into <table> (<cols>) values (?, ...)
+    update <table> set <col> = ?, ... where <conds> and <keys> limit ?
+    delete from <table> where <conds> and <keys> limit ?
+*/
+
+// writer accumulates a statement and its arguments
+type writer struct {
+	d    *Dialect
+	sql  []string
+	args []interface{}
+}
+
+func (w *writer) write(s ...string) {
+	w.sql = append(w.sql, s...)
+}
+
+// arg writes a placeholder for v
+func (w *writer) arg(v interface{}) {
+	w.args = append(w.args, v)
+	w.write(w.d.placeholder(len(w.args)))
+}
+
+// list writes each item with sep between them
+func (w *writer) list(n int, sep string, item func(i int)) {
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			w.write(sep)
+		}
+		item(i)
+	}
+}
+
+func (w *writer) done() (string, []interface{}, error) {
+	if w.args == nil {
+		w.args = make([]interface{}, 0)
+	}
+	return strings.Join(w.sql, ""), w.args, nil
+}
+
+// table writes the table name, with its schema if it has one
+func (w *writer) table(t *Table) {
+	if len(t.Schema) > 0 {
+		w.write(w.d.Quote(t.Schema), ".")
+	}
+	w.write(w.d.Quote(t.Name))
+}
+
+// Select selects the rows matching r
+func (d *Dialect) Select(t *Table, r *Request) (string, []interface{}, error) {
+	if err := checkRead(t, r); err != nil {
+		return "", nil, err
+	}
+	for _, col := range r.Fields {
+		if err := t.readable(col); err != nil {
+			return "", nil, err
+		}
+	}
+	for _, o := range r.Order {
+		if err := t.readable(o.Col); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(r.After) > 0 && len(r.After) != len(r.Order) {
+		return "", nil, errors.New("need a value to page after for each order column")
+	}
+
+	w := &writer{d: d}
+	w.write("select ")
+	if len(r.Fields) == 0 {
+		w.write("*")
+	}
+	w.list(len(r.Fields), ", ", func(i int) { w.write(d.Quote(r.Fields[i])) })
+	w.write(" from ")
+	w.table(t)
+	w.where(r, true)
+
+	if len(r.Order) > 0 {
+		w.write(" order by ")
+		w.list(len(r.Order), ", ", func(i int) {
+			w.write(d.Quote(r.Order[i].Col))
+			if r.Order[i].Desc {
+				w.write(" desc")
+			}
+		})
+	}
+	// an offset means nothing without a limit
+	if r.Limit > 0 {
+		w.write(" limit ")
+		w.arg(r.Limit)
+		if r.Offset > 0 {
+			w.write(" offset ")
+			w.arg(r.Offset)
+		}
+	}
+	return w.done()
+}
+
+// Count counts the rows matching r
+func (d *Dialect) Count(t *Table, r *Request) (string, []interface{}, error) {
+	if err := checkRead(t, r); err != nil {
+		return "", nil, err
+	}
+	w := &writer{d: d}
+	w.write("select count(*) from ")
+	w.table(t)
+	w.where(r, false)
+	return w.done()
+}
+
+// Insert inserts a row of the Set values
+func (d *Dialect) Insert(t *Table, r *Request) (string, []interface{}, error) {
+	cols, err := checkSet(t, r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	w := &writer{d: d}
+	w.write("insert into ")
+	w.table(t)
+	w.write(" (")
+	w.list(len(cols), ", ", func(i int) { w.write(d.Quote(cols[i])) })
+	w.write(") values (")
+	w.list(len(cols), ", ", func(i int) { w.value(r.Set[cols[i]]) })
+	w.write(")")
+	return w.done()
+}
+
+// Update sets the Set values on the rows matching r
+func (d *Dialect) Update(t *Table, r *Request) (string, []interface{}, error) {
+	cols, err := checkSet(t, r)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := checkWrite(d, t, r); err != nil {
+		return "", nil, err
+	}
+
+	w := &writer{d: d}
+	w.write("update ")
+	w.table(t)
+	w.write(" set ")
+	w.list(len(cols), ", ", func(i int) {
+		w.write(d.Quote(cols[i]), " = ")
+		w.value(r.Set[cols[i]])
+	})
+	w.where(r, false)
+	w.limit(r)
+	return w.done()
+}
+
+// Delete deletes the rows matching r
+func (d *Dialect) Delete(t *Table, r *Request) (string, []interface{}, error) {
+	if err := checkWrite(d, t, r); err != nil {
+		return "", nil, err
+	}
+
+	w := &writer{d: d}
+	w.write("delete from ")
+	w.table(t)
+	w.where(r, false)
+	w.limit(r)
+	return w.done()
+}
+
+// value writes a placeholder for v, or DEFAULT
+func (w *writer) value(v interface{}) {
+	if _, ok := v.(defaultValue); ok {
+		w.write("DEFAULT")
+		return
+	}
+	w.arg(v)
+}
+
+// limit writes the limit of an update or delete
+func (w *writer) limit(r *Request) {
+	if r.Limit > 0 {
+		w.write(" limit ")
+		w.arg(r.Limit)
+	}
+}
+
+/******************
+ *   Conditions   *
+ ******************/
+
+// checkRead checks the columns and operators of the conditions
+func checkRead(t *Table, r *Request) error {
+	for _, c := range r.Where {
+		if err := t.readable(c.Col); err != nil {
+			return err
+		}
+		n, ok := Ops[c.Op]
+		if !ok {
+			return fmt.Errorf("unknown operator (%s)", c.Op)
+		}
+		if (n < 0 && len(c.Values) == 0) || (n >= 0 && len(c.Values) != n) {
+			return fmt.Errorf("wrong number of values for %s %s", c.Col, c.Op)
+		}
+	}
+	for _, col := range r.KeyCols {
+		if err := t.readable(col); err != nil {
+			return err
+		}
+	}
+	for _, key := range r.Keys {
+		if len(key) != len(r.KeyCols) {
+			return fmt.Errorf("keys need a value for each of %s", strings.Join(r.KeyCols, ","))
+		}
+	}
+	if len(r.Keys) > 0 && len(r.KeyCols) == 0 {
+		return errors.New("keys without key columns")
+	}
+	return nil
+}
+
+// checkWrite checks an update or delete only touches the rows it means to
+func checkWrite(d *Dialect, t *Table, r *Request) error {
+	if err := checkRead(t, r); err != nil {
+		return err
+	}
+	if len(r.Where) == 0 && len(r.Keys) == 0 {
+		return ErrUnfiltered
+	}
+	if r.Limit > 0 && !d.writeLimit {
+		return fmt.Errorf("%s can not limit an update or delete", d.Name)
+	}
+	return nil
+}
+
+// checkSet checks the Set columns and puts them in order, so the same
+// values always make the same statement
+func checkSet(t *Table, r *Request) ([]string, error) {
+	cols := make([]string, 0, len(r.Set))
+	for col := range r.Set {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	for _, col := range cols {
+		if err := t.writable(col); err != nil {
+			return nil, err
+		}
+	}
+	if len(cols) == 0 {
+		return nil, ErrNothingToSet
+	}
+	return cols, nil
+}
+
+// where writes the where clause, if there are any conditions. The plain
+// conditions go first, then the groups in the order they first appear,
+// then the keys, and with after, the keyset condition.
+func (w *writer) where(r *Request, after bool) {
+	parts := make([]func(), 0)
+
+	groups := make(map[string][]Cond)
+	order := make([]string, 0)
+	for _, c := range r.Where {
+		c := c
+		if len(c.Group) == 0 {
+			parts = append(parts, func() { w.cond(c) })
+			continue
+		}
+		if _, ok := groups[c.Group]; !ok {
+			order = append(order, c.Group)
+		}
+		groups[c.Group] = append(groups[c.Group], c)
+	}
+	for _, g := range order {
+		conds := groups[g]
+		parts = append(parts, func() {
+			w.write("(")
+			w.list(len(conds), " or ", func(i int) { w.cond(conds[i]) })
+			w.write(")")
+		})
+	}
+	if len(r.Keys) > 0 {
+		parts = append(parts, func() { w.keys(r.KeyCols, r.Keys) })
+	}
+	if after && len(r.After) > 0 {
+		parts = append(parts, func() { w.after(r.Order, r.After) })
+	}
+
+	if len(parts) == 0 {
+		return
+	}
+	w.write(" where ")
+	w.list(len(parts), " and ", func(i int) { parts[i]() })
+}
+
+// cond writes a single condition
+func (w *writer) cond(c Cond) {
+	w.write(w.d.Quote(c.Col), " ", c.Op)
+	switch c.Op {
+	case "is null", "is not null":
+	case "in":
+		w.write(" (")
+		w.list(len(c.Values), ",", func(i int) { w.arg(c.Values[i]) })
+		w.write(")")
+	case "between":
+		w.write(" ")
+		w.arg(c.Values[0])
+		w.write(" and ")
+		w.arg(c.Values[1])
+	default:
+		w.write(" ")
+		w.arg(c.Values[0])
+	}
+}
+
+// keys matches cols against any of keys: `c1 = ? and c2 = ?` for one key,
+// `c in (?,?)` for a single column, and `(c1, c2) in ((?,?),(?,?))`
+func (w *writer) keys(cols []string, keys [][]interface{}) {
+	if len(keys) == 1 {
+		w.list(len(cols), " and ", func(i int) {
+			w.write(w.d.Quote(cols[i]), " = ")
+			w.arg(keys[0][i])
+		})
+		return
+	}
+
+	tuple := func(key []interface{}) {
+		w.list(len(key), ",", func(i int) { w.arg(key[i]) })
+	}
+	if len(cols) == 1 {
+		w.write(w.d.Quote(cols[0]), " in (")
+		w.list(len(keys), ",", func(i int) { tuple(keys[i]) })
+		w.write(")")
+		return
+	}
+
+	w.write("(")
+	w.list(len(cols), ", ", func(i int) { w.write(w.d.Quote(cols[i])) })
+	w.write(") in (")
+	w.list(len(keys), ",", func(i int) {
+		w.write("(")
+		tuple(keys[i])
+		w.write(")")
+	})
+	w.write(")")
+}
+
+// after selects the rows after values of the order columns:
+// `((c1 > ?) or (c1 = ? and c2 > ?))`, with `<` for descending columns.
+// nullable columns and null values take the nulls into account, where the
+// dialect sorts them.
+func (w *writer) after(order []Order, values []interface{}) {
+	w.write("(")
+	n := 0
+	for i, o := range order {
+		// nothing comes after a null that sorts last
+		if values[i] == nil && w.d.nullsAfter(o) {
+			continue
+		}
+		if n > 0 {
+			w.write(" or ")
+		}
+		n++
+
+		w.write("(")
+		for j := 0; j < i; j++ {
+			if values[j] == nil {
+				w.write(w.d.Quote(order[j].Col), " is null and ")
+				continue
+			}
+			w.write(w.d.Quote(order[j].Col), " = ")
+			w.arg(values[j])
+			w.write(" and ")
+		}
+		op := " > "
+		if o.Desc {
+			op = " < "
+		}
+		col := w.d.Quote(o.Col)
+		switch {
+		case values[i] == nil:
+			w.write(col, " is not null")
+		case o.Nullable && w.d.nullsAfter(o) && i == 0:
+			w.write(col, op)
+			w.arg(values[i])
+			w.write(" or ", col, " is null")
+		case o.Nullable && w.d.nullsAfter(o):
+			w.write("(", col, op)
+			w.arg(values[i])
+			w.write(" or ", col, " is null)")
+		default:
+			w.write(col, op)
+			w.arg(values[i])
+		}
+		w.write(")")
+	}
+	if n == 0 {
+		w.write("1 = 0")
+	}
+	w.write(")")
+}
+
+// nullsAfter is true when the dialect sorts nulls after values in o's order
+func (d *Dialect) nullsAfter(o Order) bool {
+	return d.nullsLast != o.Desc
+}
+
+/****************
+ *   Routines   *
+ ****************/
+
+// Arg is an argument to a routine: a value, or the session variable Var
+type Arg struct {
+	Value interface{}
+	Var   string
+}
+
+// Call calls a procedure, in schema when it's given
+func (d *Dialect) Call(schema, name string, args []Arg) (string, []interface{}, error) {
+	w := &writer{d: d}
+	w.write("call ")
+	w.table(&Table{Schema: schema, Name: name})
+	w.write("(")
+	if err := w.routineArgs(args); err != nil {
+		return "", nil, err
+	}
+	w.write(")")
+	return w.done()
+}
+
+// CallFunction selects the result of a function as the column as
+func (d *Dialect) CallFunction(schema, name string, args []Arg, as string) (string, []interface{}, error) {
+	w := &writer{d: d}
+	w.write("select ")
+	w.table(&Table{Schema: schema, Name: name})
+	w.write("(")
+	if err := w.routineArgs(args); err != nil {
+		return "", nil, err
+	}
+	w.write(") as ", d.Quote(as))
+	return w.done()
+}
+
+// SetVars sets each session variable Var to its Value
+func (d *Dialect) SetVars(vars []Arg) (string, []interface{}, error) {
+	w := &writer{d: d}
+	w.write("set ")
+	for i, v := range vars {
+		if i > 0 {
+			w.write(", ")
+		}
+		if err := w.variable(v.Var); err != nil {
+			return "", nil, err
+		}
+		w.write(" = ")
+		w.arg(v.Value)
+	}
+	return w.done()
+}
+
+// SelectVars selects each of the session variables vars as the column of
+// the same index in as
+func (d *Dialect) SelectVars(vars, as []string) (string, []interface{}, error) {
+	if len(vars) != len(as) {
+		return "", nil, errors.New("need a column for each variable")
+	}
+	w := &writer{d: d}
+	w.write("select ")
+	for i := range vars {
+		if i > 0 {
+			w.write(", ")
+		}
+		if err := w.variable(vars[i]); err != nil {
+			return "", nil, err
+		}
+		w.write(" as ", d.Quote(as[i]))
+	}
+	return w.done()
+}
+
+func (w *writer) routineArgs(args []Arg) error {
+	for i, a := range args {
+		if i > 0 {
+			w.write(", ")
+		}
+		if len(a.Var) == 0 {
+			w.arg(a.Value)
+			continue
+		}
+		if err := w.variable(a.Var); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// variable writes a session variable
+func (w *writer) variable(name string) error {
+	if !w.d.variables {
+		return fmt.Errorf("%s has no session variables", w.d.Name)
+	}
+	w.write("@", w.d.Quote(name))
+	return nil
+}
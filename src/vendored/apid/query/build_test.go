@@ -0,0 +1,248 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+)
+
+// a user table whose password is write only and created_at read only
+func testTable() *Table {
+	return &Table{
+		Name:      "user",
+		Columns:   []string{"id", "name", "email", "password", "created_at"},
+		ReadOnly:  map[string]bool{"created_at": true},
+		WriteOnly: map[string]bool{"password": true},
+	}
+}
+
+func TestStatements(t *testing.T) {
+	user := testTable()
+	shop := &Table{Name: "user", Schema: "shop", Columns: []string{"id", "group_id"}}
+
+	var tests = []struct {
+		name  string
+		build func(d *Dialect) (string, []interface{}, error)
+		mysql string
+		pg    string
+		args  []interface{}
+	}{
+		{"select everything", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(user, &Request{})
+		}, "select * from `user`", `select * from "user"`, []interface{}{}},
+		{"select", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(user, &Request{
+				Fields: []string{"id", "name"},
+				Where: []Cond{
+					{Col: "name", Op: "like", Values: []interface{}{"j%"}},
+					{Group: "or", Col: "id", Op: "in", Values: []interface{}{1, 2}},
+					{Group: "or", Col: "email", Op: "is null"},
+					{Col: "id", Op: "between", Values: []interface{}{1, 9}},
+				},
+				Order:  []Order{{Col: "name", Desc: true}, {Col: "id"}},
+				Limit:  10,
+				Offset: 20,
+			})
+		},
+			"select `id`, `name` from `user` where `name` like ? and `id` between ? and ? and (`id` in (?,?) or `email` is null) order by `name` desc, `id` limit ? offset ?",
+			`select "id", "name" from "user" where "name" like $1 and "id" between $2 and $3 and ("id" in ($4,$5) or "email" is null) order by "name" desc, "id" limit $6 offset $7`,
+			[]interface{}{"j%", 1, 9, 1, 2, 10, 20}},
+		{"offset without a limit", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(user, &Request{Offset: 20})
+		}, "select * from `user`", `select * from "user"`, []interface{}{}},
+		{"keyset", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(user, &Request{Order: []Order{{Col: "name", Desc: true}, {Col: "id"}}, After: []interface{}{"amy", 3}, Limit: 2})
+		},
+			"select * from `user` where ((`name` < ?) or (`name` = ? and `id` > ?)) order by `name` desc, `id` limit ?",
+			`select * from "user" where (("name" < $1) or ("name" = $2 and "id" > $3)) order by "name" desc, "id" limit $4`,
+			[]interface{}{"amy", "amy", 3, 2}},
+		{"keyset past nulls", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(user, &Request{Order: []Order{{Col: "email", Nullable: true}, {Col: "id"}}, After: []interface{}{"a@b.c", 3}, Limit: 2})
+		},
+			"select * from `user` where ((`email` > ?) or (`email` = ? and `id` > ?)) order by `email`, `id` limit ?",
+			`select * from "user" where (("email" > $1 or "email" is null) or ("email" = $2 and "id" > $3)) order by "email", "id" limit $4`,
+			[]interface{}{"a@b.c", "a@b.c", 3, 2}},
+		{"keyset past nulls later in the order", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(user, &Request{Order: []Order{{Col: "id"}, {Col: "email", Desc: true, Nullable: true}}, After: []interface{}{3, "a@b.c"}, Limit: 2})
+		},
+			"select * from `user` where ((`id` > ?) or (`id` = ? and (`email` < ? or `email` is null))) order by `id`, `email` desc limit ?",
+			`select * from "user" where (("id" > $1) or ("id" = $2 and "email" < $3)) order by "id", "email" desc limit $4`,
+			[]interface{}{3, 3, "a@b.c", 2}},
+		{"keyset after a null", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(user, &Request{Order: []Order{{Col: "email", Nullable: true}, {Col: "id"}}, After: []interface{}{nil, 3}, Limit: 2})
+		},
+			"select * from `user` where ((`email` is not null) or (`email` is null and `id` > ?)) order by `email`, `id` limit ?",
+			`select * from "user" where (("email" is null and "id" > $1)) order by "email", "id" limit $2`,
+			[]interface{}{3, 2}},
+		{"one key", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(shop, &Request{KeyCols: []string{"group_id", "id"}, Keys: [][]interface{}{{1, 26}}})
+		},
+			"select * from `shop`.`user` where `group_id` = ? and `id` = ?",
+			`select * from "shop"."user" where "group_id" = $1 and "id" = $2`,
+			[]interface{}{1, 26}},
+		{"keys on a column", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(shop, &Request{KeyCols: []string{"id"}, Keys: [][]interface{}{{1}, {2}}})
+		},
+			"select * from `shop`.`user` where `id` in (?,?)",
+			`select * from "shop"."user" where "id" in ($1,$2)`,
+			[]interface{}{1, 2}},
+		{"keys on columns", func(d *Dialect) (string, []interface{}, error) {
+			return d.Select(shop, &Request{KeyCols: []string{"group_id", "id"}, Keys: [][]interface{}{{1, 26}, {2, 27}}})
+		},
+			"select * from `shop`.`user` where (`group_id`, `id`) in ((?,?),(?,?))",
+			`select * from "shop"."user" where ("group_id", "id") in (($1,$2),($3,$4))`,
+			[]interface{}{1, 26, 2, 27}},
+		{"count", func(d *Dialect) (string, []interface{}, error) {
+			return d.Count(user, &Request{Where: []Cond{{Col: "name", Op: "=", Values: []interface{}{"jack"}}}, Limit: 1})
+		}, "select count(*) from `user` where `name` = ?", `select count(*) from "user" where "name" = $1`, []interface{}{"jack"}},
+		{"insert", func(d *Dialect) (string, []interface{}, error) {
+			return d.Insert(user, &Request{Set: map[string]interface{}{"name": "jack", "password": "x", "email": Default}})
+		},
+			"insert into `user` (`email`, `name`, `password`) values (DEFAULT, ?, ?)",
+			`insert into "user" ("email", "name", "password") values (DEFAULT, $1, $2)`,
+			[]interface{}{"jack", "x"}},
+		{"update", func(d *Dialect) (string, []interface{}, error) {
+			return d.Update(user, &Request{Set: map[string]interface{}{"name": "jack", "email": Default}, KeyCols: []string{"id"}, Keys: [][]interface{}{{26}}})
+		},
+			"update `user` set `email` = DEFAULT, `name` = ? where `id` = ?",
+			`update "user" set "email" = DEFAULT, "name" = $1 where "id" = $2`,
+			[]interface{}{"jack", 26}},
+		{"delete", func(d *Dialect) (string, []interface{}, error) {
+			return d.Delete(user, &Request{Where: []Cond{{Col: "email", Op: "not like", Values: []interface{}{"%.org"}}}})
+		}, "delete from `user` where `email` not like ?", `delete from "user" where "email" not like $1`, []interface{}{"%.org"}},
+		{"function", func(d *Dialect) (string, []interface{}, error) {
+			return d.CallFunction("", "add_one", []Arg{{Value: 41}}, "result")
+		}, "select `add_one`(?) as `result`", `select "add_one"($1) as "result"`, []interface{}{41}},
+		{"function in a schema", func(d *Dialect) (string, []interface{}, error) {
+			return d.CallFunction("shop", "add_one", []Arg{{Value: 41}}, "result")
+		}, "select `shop`.`add_one`(?) as `result`", `select "shop"."add_one"($1) as "result"`, []interface{}{41}},
+	}
+	for _, test := range tests {
+		for d, want := range map[*Dialect]string{MySQL: test.mysql, Postgres: test.pg} {
+			q, args, err := test.build(d)
+			if err != nil {
+				t.Errorf("%s %s - unexpected error %s", d.Name, test.name, err)
+				continue
+			}
+			if q != want {
+				t.Errorf("%s %s - got (%s), want (%s)", d.Name, test.name, q, want)
+			}
+			if !reflect.DeepEqual(args, test.args) {
+				t.Errorf("%s %s - got args %v, want %v", d.Name, test.name, args, test.args)
+			}
+		}
+	}
+}
+
+func TestWriteLimits(t *testing.T) {
+	user := testTable()
+	r := &Request{Set: map[string]interface{}{"name": "jack"}, KeyCols: []string{"id"}, Keys: [][]interface{}{{26}}, Limit: 1}
+
+	q, args, err := MySQL.Update(user, r)
+	if w := "update `user` set `name` = ? where `id` = ? limit ?"; err != nil || q != w {
+		t.Errorf("got (%s) %v, want (%s)", q, err, w)
+	}
+	if w := []interface{}{"jack", 26, 1}; !reflect.DeepEqual(args, w) {
+		t.Errorf("got args %v, want %v", args, w)
+	}
+	if q, _, err := Postgres.Delete(user, r); err == nil {
+		t.Errorf("postgres can't limit a delete, got (%s)", q)
+	}
+}
+
+// nothing outside the model gets into a statement
+func TestBuildErrors(t *testing.T) {
+	user := testTable()
+	name := []interface{}{"jack"}
+
+	for _, test := range []struct {
+		name   string
+		build  func() (string, []interface{}, error)
+		column string
+	}{
+		{"unknown field", func() (string, []interface{}, error) {
+			return MySQL.Select(user, &Request{Fields: []string{"id; drop table user"}})
+		}, "id; drop table user"},
+		{"write only field", func() (string, []interface{}, error) {
+			return MySQL.Select(user, &Request{Fields: []string{"password"}})
+		}, "password"},
+		{"write only filter", func() (string, []interface{}, error) {
+			return MySQL.Count(user, &Request{Where: []Cond{{Col: "password", Op: "=", Values: name}}})
+		}, "password"},
+		{"write only order", func() (string, []interface{}, error) {
+			return MySQL.Select(user, &Request{Order: []Order{{Col: "password"}}})
+		}, "password"},
+		{"unknown key", func() (string, []interface{}, error) {
+			return MySQL.Delete(user, &Request{KeyCols: []string{"nope"}, Keys: [][]interface{}{{1}}})
+		}, "nope"},
+		{"unknown set", func() (string, []interface{}, error) {
+			return MySQL.Insert(user, &Request{Set: map[string]interface{}{"name`) values (1); --": 1}})
+		}, "name`) values (1); --"},
+		{"read only set", func() (string, []interface{}, error) {
+			return MySQL.Update(user, &Request{Set: map[string]interface{}{"created_at": 1}, Where: []Cond{{Col: "name", Op: "=", Values: name}}})
+		}, "created_at"},
+		{"bad operator", func() (string, []interface{}, error) {
+			return MySQL.Select(user, &Request{Where: []Cond{{Col: "name", Op: "= 1 or 1 =", Values: name}}})
+		}, ""},
+		{"missing values", func() (string, []interface{}, error) {
+			return MySQL.Select(user, &Request{Where: []Cond{{Col: "id", Op: "between", Values: name}}})
+		}, ""},
+		{"short key", func() (string, []interface{}, error) {
+			return MySQL.Select(user, &Request{KeyCols: []string{"id", "name"}, Keys: [][]interface{}{{1}}})
+		}, ""},
+		{"short after", func() (string, []interface{}, error) {
+			return MySQL.Select(user, &Request{Order: []Order{{Col: "name"}, {Col: "id"}}, After: name})
+		}, ""},
+		{"nothing to insert", func() (string, []interface{}, error) {
+			return MySQL.Insert(user, &Request{})
+		}, ""},
+		{"update everything", func() (string, []interface{}, error) {
+			return MySQL.Update(user, &Request{Set: map[string]interface{}{"name": "jack"}})
+		}, ""},
+		{"delete everything", func() (string, []interface{}, error) {
+			return MySQL.Delete(user, &Request{Limit: 10})
+		}, ""},
+		{"postgres variables", func() (string, []interface{}, error) {
+			return Postgres.Call("", "rename_user", []Arg{{Var: "dapi_name"}})
+		}, ""},
+	} {
+		q, _, err := test.build()
+		if err == nil {
+			t.Errorf("%s - expected error, got (%s)", test.name, q)
+			continue
+		}
+		ce, ok := err.(*ColumnError)
+		if len(test.column) > 0 && (!ok || ce.Column != test.column) {
+			t.Errorf("%s - got %v, want a column error for (%s)", test.name, err, test.column)
+		}
+	}
+}
+
+func TestRoutines(t *testing.T) {
+	q, args, err := MySQL.SetVars([]Arg{{Var: "dapi_name", Value: "jack"}, {Var: "dapi_changed"}})
+	if w := "set @`dapi_name` = ?, @`dapi_changed` = ?"; err != nil || q != w {
+		t.Errorf("got (%s) %v, want (%s)", q, err, w)
+	}
+	if w := []interface{}{"jack", nil}; !reflect.DeepEqual(args, w) {
+		t.Errorf("got args %v, want %v", args, w)
+	}
+
+	q, args, err = MySQL.Call("", "rename_user", []Arg{{Value: 26}, {Var: "dapi_name"}})
+	if w := "call `rename_user`(?, @`dapi_name`)"; err != nil || q != w {
+		t.Errorf("got (%s) %v, want (%s)", q, err, w)
+	}
+	if w := []interface{}{26}; !reflect.DeepEqual(args, w) {
+		t.Errorf("got args %v, want %v", args, w)
+	}
+
+	q, _, err = MySQL.SelectVars([]string{"dapi_name"}, []string{"name"})
+	if w := "select @`dapi_name` as `name`"; err != nil || q != w {
+		t.Errorf("got (%s) %v, want (%s)", q, err, w)
+	}
+
+	if g, w := MySQL.Quote("we`ird"), "`we``ird`"; g != w {
+		t.Errorf("got (%s), want (%s)", g, w)
+	}
+	if g, w := Postgres.Quote(`we"ird`), `"we""ird"`; g != w {
+		t.Errorf("got (%s), want (%s)", g, w)
+	}
+}
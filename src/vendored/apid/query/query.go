@@ -0,0 +1,202 @@
+/*
+Package query builds parameterized sql from a table model and a parsed
+request. It knows nothing of http or database connections, so every
+statement can be checked without a database.
+
+identifiers only ever come from the table model and are always quoted.
+values are always placeholder arguments. a request naming a column the
+table doesn't have, or using one in a way the model doesn't allow, is a
+*ColumnError.
+*/
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/****************
+ *   Dialects   *
+ ****************/
+
+// Dialect is how a database writes identifiers and placeholders, and what
+// it can do
+type Dialect struct {
+	Name string
+
+	quote      string // the identifier quote
+	numbered   bool   // placeholders are $1, $2, ... rather than ?
+	writeLimit bool   // update and delete can take a limit
+	variables  bool   // session variables, written @name
+	nullsLast  bool   // nulls sort after values in ascending order
+}
+
+// MySQL is the dialect apid serves
+var MySQL = &Dialect{Name: "mysql", quote: "`", writeLimit: true, variables: true}
+
+// Postgres quotes with double quotes and numbers its placeholders
+var Postgres = &Dialect{Name: "postgres", quote: `"`, numbered: true, nullsLast: true}
+
+// Quote quotes a table or column name
+func (d *Dialect) Quote(name string) string {
+	return d.quote + strings.Replace(name, d.quote, d.quote+d.quote, -1) + d.quote
+}
+
+// placeholder is the placeholder for the nth argument, counting from 1
+func (d *Dialect) placeholder(n int) string {
+	if d.numbered {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+/*******************
+ *   Table Model   *
+ *******************/
+
+// Table is what the builder knows of a table
+type Table struct {
+	// Name is the table without its schema, and Schema is empty for the
+	// connection's default schema
+	Name   string
+	Schema string
+
+	// Columns are every column of the table, in table order
+	Columns []string
+
+	// ReadOnly columns are never written. WriteOnly columns are never
+	// selected, filtered on, or ordered by.
+	ReadOnly  map[string]bool
+	WriteOnly map[string]bool
+}
+
+// String is the table as errors name it
+func (t *Table) String() string {
+	if len(t.Schema) > 0 {
+		return t.Schema + "." + t.Name
+	}
+	return t.Name
+}
+
+// has is true when col is one of the table's columns
+func (t *Table) has(col string) bool {
+	for _, c := range t.Columns {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+// readable checks that col can be selected, filtered on, or ordered by
+func (t *Table) readable(col string) error {
+	if !t.has(col) || t.WriteOnly[col] {
+		return &ColumnError{Table: t.String(), Column: col}
+	}
+	return nil
+}
+
+// writable checks that col can be written
+func (t *Table) writable(col string) error {
+	if !t.has(col) {
+		return &ColumnError{Table: t.String(), Column: col}
+	}
+	if t.ReadOnly[col] {
+		return &ColumnError{Table: t.String(), Column: col, ReadOnly: true}
+	}
+	return nil
+}
+
+// ColumnError is a column the table doesn't have, or a read only column
+// being written
+type ColumnError struct {
+	Table    string
+	Column   string
+	ReadOnly bool
+}
+
+func (e *ColumnError) Error() string {
+	if e.ReadOnly {
+		return fmt.Sprintf("column (%s) is read only on %s", e.Column, e.Table)
+	}
+	return fmt.Sprintf("unknown column (%s) on %s", e.Column, e.Table)
+}
+
+/***************
+ *   Request   *
+ ***************/
+
+// Request is what a request asks of a table. Fields, Order, After, and
+// Offset only apply to selects.
+type Request struct {
+	// Fields are the columns to select, all of them when empty
+	Fields []string
+
+	// Where filters the rows
+	Where []Cond
+
+	// KeyCols and Keys match the rows whose KeyCols equal any one of Keys
+	KeyCols []string
+	Keys    [][]interface{}
+
+	// Set are the column values to write, Default for a column's default
+	Set map[string]interface{}
+
+	// Order sorts the rows, and After picks up after the row with these
+	// values of the Order columns
+	Order []Order
+	After []interface{}
+
+	// Limit and Offset page the rows. Zero is no limit.
+	Limit  int
+	Offset int
+}
+
+// Cond is a condition on a column. Conds in the same Group are OR'd
+// together, everything else is AND'd.
+type Cond struct {
+	Group  string
+	Col    string
+	Op     string
+	Values []interface{}
+}
+
+// Ops are the operators a Cond can use and how many values each takes,
+// -1 for one or more
+var Ops = map[string]int{
+	"=":           1,
+	"<>":          1,
+	">":           1,
+	">=":          1,
+	"<":           1,
+	"<=":          1,
+	"like":        1,
+	"not like":    1,
+	"in":          -1,
+	"between":     2,
+	"is null":     0,
+	"is not null": 0,
+}
+
+// Order is a column to sort by and its direction
+type Order struct {
+	Col  string
+	Desc bool
+
+	// Nullable columns page past their nulls too
+	Nullable bool
+}
+
+// Default as a Set value puts a column back to its default
+var Default = defaultValue{}
+
+type defaultValue struct{}
+
+var (
+	// ErrNothingToSet is an insert or update without values
+	ErrNothingToSet = errors.New("nothing to set")
+
+	// ErrUnfiltered is an update or delete that would touch every row
+	ErrUnfiltered = errors.New("update or delete without a condition")
+)
@@ -0,0 +1,209 @@
+package apid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/***************************
+ *   Single Record Routes  *
+ ***************************/
+
+// recordTable checks the table exists, can be written to if this is a
+// write, and has a primary key to find records by
+func (a *Apid) recordTable(w http.ResponseWriter, r *http.Request, t httprouter.Params) (*Table, []string, bool) {
+	tableName := a.tableKey(t)
+	table, ok := a.Tables[tableName]
+	if !ok {
+		NotFoundWithParams(w, r, fmt.Sprintf("table (%s) not found", tableName))
+		return nil, nil, false
+	}
+	if r.Method != "GET" && a.refuseWrite(w, r, table) {
+		return nil, nil, false
+	}
+
+	pKeys := table.PrimaryKeys()
+	if len(pKeys) == 0 {
+		sendError(w, r, noPrimaryKey(tableName))
+		return nil, nil, false
+	}
+	return table, pKeys, true
+}
+
+// noPrimaryKey refuses a request for records of a table without a primary
+// key. The table is there, there's just no way to name a record of it.
+func noPrimaryKey(table string) *Error {
+	e := errorf(http.StatusBadRequest, "table (%s) has no primary key", table)
+	e.Table = table
+	return e
+}
+
+// GetRecord returns the record with the primary key in the url. _meta
+// requests are forwarded to the TableMetaHandler since httprouter won't
+// let it share the route.
+func (a *Apid) GetRecord(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	if t.ByName("id") == "_meta" {
+		a.TableMetaHandler(w, r, t)
+		return
+	}
+
+	table, pKeys, ok := a.recordTable(w, r, t)
+	if !ok {
+		return
+	}
+	id := t.ByName("id")
+
+	q, args, err := a.recordSelectQuery(table.Name, pKeys, id, r.URL.Query())
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	db, release, err := a.conn(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	defer release()
+
+	rows, err := db.QueryContext(r.Context(), q, args...)
+	if err != nil {
+		sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+		return
+	}
+	defer rows.Close()
+
+	found, err := a.scanRows(rows, table)
+	if err != nil {
+		sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+		return
+	}
+	if len(found) == 0 {
+		NotFoundWithParams(w, r, fmt.Sprintf("record (%s) not found in %s", id, table.Name))
+		return
+	}
+	if err := a.expand(r.Context(), db, table.Name, r.URL.Query(), found[:1]); err != nil {
+		sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+		return
+	}
+
+	j, err := json.Marshal(found[0])
+	if err != nil {
+		a.log().Print("error making json record ", err)
+	}
+
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// PutRecord replaces the record with the primary key in the url. Columns
+// left out of the body go back to their defaults.
+func (a *Apid) PutRecord(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	a.updateRecord(w, r, t, true)
+}
+
+// PatchRecord updates only the columns given in the body
+func (a *Apid) PatchRecord(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	a.updateRecord(w, r, t, false)
+}
+
+// common functionality for PUT and PATCH
+func (a *Apid) updateRecord(w http.ResponseWriter, r *http.Request, t httprouter.Params, replace bool) {
+	table, pKeys, ok := a.recordTable(w, r, t)
+	if !ok {
+		return
+	}
+	id := t.ByName("id")
+
+	v, err := a.readJSONBody(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	q, args, err := a.recordUpdateQuery(table.Name, pKeys, id, v, replace)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	db, release, err := a.conn(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	defer release()
+
+	res, err := db.Exec(q, args...)
+	if err != nil {
+		sendError(w, r, withQuery(err, q))
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		a.log().Print("error ", err)
+	}
+
+	// mysql doesn't count rows that were already up to date, so make sure
+	// the record is really missing before saying so
+	if rowsAffected == 0 {
+		q, args, _ := a.recordSelectQuery(table.Name, pKeys, id, nil)
+		rows, err := db.Query(q, args...)
+		if err != nil {
+			sendError(w, r, wrapf(err, "%s request failed on %s", r.Method, table.Name))
+			return
+		}
+		exists := rows.Next()
+		rows.Close()
+		if !exists {
+			NotFoundWithParams(w, r, fmt.Sprintf("record (%s) not found in %s", id, table.Name))
+			return
+		}
+	}
+
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"message\":\"success\", \"rows_affected\":%d}", rowsAffected)))
+}
+
+// DeleteRecord deletes the record with the primary key in the url
+func (a *Apid) DeleteRecord(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	table, pKeys, ok := a.recordTable(w, r, t)
+	if !ok {
+		return
+	}
+	id := t.ByName("id")
+
+	db, release, err := a.conn(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	defer release()
+
+	q, args, err := a.recordDeleteQuery(table.Name, pKeys, id)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	res, err := db.Exec(q, args...)
+	if err != nil {
+		sendError(w, r, withQuery(err, q))
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		a.log().Print("error ", err)
+	}
+	if rowsAffected == 0 {
+		NotFoundWithParams(w, r, fmt.Sprintf("record (%s) not found in %s", id, table.Name))
+		return
+	}
+
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"message\":\"success\", \"rows_affected\":%d}", rowsAffected)))
+}
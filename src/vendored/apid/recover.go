@@ -0,0 +1,89 @@
+package apid
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+/****************
+ *   Recovery   *
+ ****************/
+
+/*
+a panic in a handler is a bug, but it's one request's bug. recoverPanics
+catches it, logs the stack, and sends a 500 so the server keeps serving.
+
+every request gets an id, the X-Request-Id it came with or a new one, sent
+back in the X-Request-Id header. a panic's log line and its problem carry
+the id, so a client's report can be matched to the stack.
+
+once part of the response has been written there's no sending a 500, so
+the connection is dropped instead and the client sees a cut off response
+rather than a short one that looks whole.
+*/
+
+// RequestIDHeader carries the request id, both ways
+const RequestIDHeader = "X-Request-Id"
+
+// longest request id taken from a client
+const maxRequestID = 64
+
+// recoverPanics turns a panic in next into a 500. Nested, only the
+// outermost does anything.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(*recoveryWriter); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := r.Header.Get(RequestIDHeader)
+		if len(id) == 0 || len(id) > maxRequestID {
+			id, _ = newUUID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		rw := &recoveryWriter{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// the reverse proxy aborts this way, and it isn't a bug
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			requestLogger(r).Printf("500 - %s %s (request %q): panic: %v\n%s", r.Method, r.RequestURI, id, rec, debug.Stack())
+			if rw.wrote {
+				panic(http.ErrAbortHandler)
+			}
+			status := http.StatusInternalServerError
+			WriteProblem(w, r, &Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: "internal error", RequestID: id})
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// recoveryWriter notes whether the response has been started
+type recoveryWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *recoveryWriter) WriteHeader(status int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoveryWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed rows flowing through the wrapper
+func (w *recoveryWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wrote = true
+		f.Flush()
+	}
+}
@@ -0,0 +1,52 @@
+package apid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	boom := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var table *Table
+		w.Write([]byte(table.Name))
+	})
+
+	for _, id := range []string{"", "abc-123"} {
+		req, _ := http.NewRequest("GET", "/api/v1/crud/user", nil)
+		if len(id) > 0 {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		rw := httptest.NewRecorder()
+		recoverPanics(recoverPanics(boom)).ServeHTTP(rw, req)
+
+		if g, w := rw.Code, http.StatusInternalServerError; g != w {
+			t.Errorf("(%s) got status %d, want %d", id, g, w)
+		}
+		got := rw.Header().Get(RequestIDHeader)
+		if len(got) == 0 || (len(id) > 0 && got != id) {
+			t.Errorf("(%s) got request id (%s)", id, got)
+		}
+		var p Problem
+		if err := json.Unmarshal(rw.Body.Bytes(), &p); err != nil || p.RequestID != got || p.Detail != "internal error" {
+			t.Errorf("(%s) got body %s, want a problem with the request id (%s)", id, rw.Body.String(), got)
+		}
+	}
+}
+
+// once the response has started, all that's left is dropping the connection
+func TestRecoverAfterWriting(t *testing.T) {
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":1},`))
+		panic("lost the rows")
+	}))
+
+	req, _ := http.NewRequest("GET", "/api/v1/crud/user", nil)
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("got panic %v, want http.ErrAbortHandler", rec)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
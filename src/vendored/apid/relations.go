@@ -0,0 +1,232 @@
+package apid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"vendored/apid/query"
+)
+
+/*********************
+ *   Relationships   *
+ *********************/
+
+/*
+foreign keys are read from information_schema when the tables are loaded.
+each one relates two tables both ways: a settings row belongs to one user
+(many-to-one) and a user has many settings (one-to-many). `?expand=` takes a
+comma separated list of relationship names and nests the related rows under
+each name, an object (or null) for many-to-one and an array for one-to-many.
+the related rows for all of the returned rows are loaded with one batched
+`in` query per relationship rather than a query per row.
+
+a relationship is named after the related table. when a table has more than
+one relationship to the same table, many-to-one relationships are named
+after the foreign key column without its _id suffix, and one-to-many
+relationships after the related table and that column (employee_manager).
+a name that's taken by a column of the table or by a relationship named
+before it gets _rel on the end (manager_rel), as many times as it takes to
+be unique, since the expanded rows are nested in place of the column.
+*/
+
+// relationship kinds
+const (
+	ManyToOne = "many-to-one"
+	OneToMany = "one-to-many"
+)
+
+// the most keys sent in a single expand query
+const expandBatch = 500
+
+// ForeignKey is a foreign key constraint from Cols to RefCols on RefTable
+type ForeignKey struct {
+	Name     string
+	Cols     []string
+	RefTable string
+	RefCols  []string
+}
+
+// Relation is a relationship from a table to the rows of Table, joining
+// Cols on this table to RefCols on the related one
+type Relation struct {
+	Name       string   `json:"name"`
+	Kind       string   `json:"kind"`
+	Table      string   `json:"table"`
+	Cols       []string `json:"columns"`
+	RefCols    []string `json:"related_columns"`
+	ForeignKey string   `json:"foreign_key"`
+}
+
+// relate fills in the Relations of every table from the foreign keys
+func relate(tables map[string]*Table) {
+	names := make([]string, 0, len(tables))
+	for name, t := range tables {
+		t.Relations = make([]*Relation, 0)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := tables[name]
+		for _, fk := range t.ForeignKeys {
+			parent, ok := tables[fk.RefTable]
+			if !ok {
+				continue
+			}
+			t.Relations = append(t.Relations, &Relation{Kind: ManyToOne, Table: parent.Name, Cols: fk.Cols, RefCols: fk.RefCols, ForeignKey: fk.Name})
+			parent.Relations = append(parent.Relations, &Relation{Kind: OneToMany, Table: t.Name, Cols: fk.RefCols, RefCols: fk.Cols, ForeignKey: fk.Name})
+		}
+	}
+
+	// names leave out the schema, so expand=settings works in any mode
+	for _, t := range tables {
+		related := make(map[string]int)
+		for _, rel := range t.Relations {
+			related[tables[rel.Table].baseName()]++
+		}
+		taken := make(map[string]bool, len(t.Relations))
+		for _, rel := range t.Relations {
+			rel.Name = tables[rel.Table].baseName()
+			if related[rel.Name] > 1 {
+				if rel.Kind == ManyToOne {
+					rel.Name = strings.TrimSuffix(rel.Cols[0], "_id")
+				} else {
+					rel.Name += "_" + strings.TrimSuffix(rel.RefCols[0], "_id")
+				}
+			}
+			// expanded rows would overwrite a column or another
+			// relationship of the same name
+			for t.Col(rel.Name) != nil || taken[rel.Name] {
+				rel.Name += "_rel"
+			}
+			taken[rel.Name] = true
+		}
+	}
+}
+
+// Relation finds a relationship by name, nil if there is none
+func (t *Table) Relation(name string) *Relation {
+	for _, rel := range t.Relations {
+		if rel.Name == name {
+			return rel
+		}
+	}
+	return nil
+}
+
+// expansions are the relationships named by `?expand=`
+func (a *Apid) expansions(table string, params url.Values) ([]*Relation, error) {
+	rels := make([]*Relation, 0)
+	for _, name := range splitValues(params["expand"]) {
+		rel := a.Tables[table].Relation(name)
+		if rel == nil {
+			return nil, errorf(http.StatusBadRequest, "unknown relationship (%s) on %s", name, table)
+		}
+		rels = append(rels, rel)
+	}
+	return rels, nil
+}
+
+// expand loads the related rows for each of rels and nests them in rows
+func (a *Apid) expand(ctx context.Context, db queryer, table string, params url.Values, rows []map[string]interface{}) error {
+	rels, err := a.expansions(table, params)
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range rels {
+		related := a.Tables[rel.Table]
+		fields, exclude := projection(params, rel.Name)
+		cols, err := a.selectColumns(rel.Table, fields, exclude, rel.RefCols)
+		if err != nil {
+			return err
+		}
+		order, err := a.parseOrderBy(rel.Table, "")
+		if err != nil {
+			return err
+		}
+
+		// the distinct keys, skipping rows that don't point anywhere
+		keys := make([][]interface{}, 0)
+		seen := make(map[string]bool)
+		for _, row := range rows {
+			key, ok := rowKey(row, rel.Cols)
+			if ok && !seen[keyString(key)] {
+				seen[keyString(key)] = true
+				keys = append(keys, key)
+			}
+		}
+
+		found := make(map[string][]map[string]interface{})
+		for start := 0; start < len(keys); start += expandBatch {
+			end := start + expandBatch
+			if end > len(keys) {
+				end = len(keys)
+			}
+			q, args, err := built(dialect.Select(a.queryTable(rel.Table), &query.Request{Fields: cols, KeyCols: rel.RefCols, Keys: keys[start:end], Order: order}))
+			if err != nil {
+				return err
+			}
+
+			res, err := db.QueryContext(ctx, q, args...)
+			if err != nil {
+				return err
+			}
+			err = a.eachRow(res, related, func(r map[string]interface{}) error {
+				if key, ok := rowKey(r, rel.RefCols); ok {
+					found[keyString(key)] = append(found[keyString(key)], r)
+				}
+				return nil
+			})
+			res.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, row := range rows {
+			var matches []map[string]interface{}
+			if key, ok := rowKey(row, rel.Cols); ok {
+				matches = found[keyString(key)]
+			}
+			if rel.Kind == ManyToOne {
+				row[rel.Name] = nil
+				if len(matches) > 0 {
+					row[rel.Name] = matches[0]
+				}
+				continue
+			}
+			if matches == nil {
+				matches = make([]map[string]interface{}, 0)
+			}
+			row[rel.Name] = matches
+		}
+	}
+	return nil
+}
+
+// rowKey is the values of cols in row. It is false if any are null.
+func rowKey(row map[string]interface{}, cols []string) ([]interface{}, bool) {
+	key := make([]interface{}, 0, len(cols))
+	for _, c := range cols {
+		v := row[c]
+		if v == nil {
+			return nil, false
+		}
+		key = append(key, v)
+	}
+	return key, true
+}
+
+// keyString makes a key comparable, whatever the integer types on each side
+func keyString(key []interface{}) string {
+	parts := make([]string, 0, len(key))
+	for _, v := range key {
+		parts = append(parts, fmt.Sprint(v))
+	}
+	return strings.Join(parts, "\x00")
+}
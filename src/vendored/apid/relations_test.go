@@ -0,0 +1,132 @@
+package apid
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// user has settings, and employees have managers who are employees
+func testRelated() *Apid {
+	a := testApid("user", "id", "name", "email")
+	a.Tables["settings"] = testApid("settings", "id", "user_id", "setting").Tables["settings"]
+	a.Tables["employee"] = testApid("employee", "id", "manager_id", "mentor_id", "mentor").Tables["employee"]
+
+	a.Tables["settings"].ForeignKeys = []*ForeignKey{{Name: "settings_user", Cols: []string{"user_id"}, RefTable: "user", RefCols: []string{"id"}}}
+	a.Tables["employee"].ForeignKeys = []*ForeignKey{
+		{Name: "employee_manager", Cols: []string{"manager_id"}, RefTable: "employee", RefCols: []string{"id"}},
+		{Name: "employee_mentor", Cols: []string{"mentor_id"}, RefTable: "employee", RefCols: []string{"id"}},
+		{Name: "employee_elsewhere", Cols: []string{"id"}, RefTable: "not_loaded", RefCols: []string{"id"}},
+	}
+	relate(a.Tables)
+	return a
+}
+
+func TestRelate(t *testing.T) {
+	a := testRelated()
+
+	var tests = []struct {
+		table, name string
+		want        Relation
+	}{
+		{"settings", "user", Relation{"user", ManyToOne, "user", []string{"user_id"}, []string{"id"}, "settings_user"}},
+		{"user", "settings", Relation{"settings", OneToMany, "settings", []string{"id"}, []string{"user_id"}, "settings_user"}},
+		// several relationships to the same table are named by column
+		{"employee", "manager", Relation{"manager", ManyToOne, "employee", []string{"manager_id"}, []string{"id"}, "employee_manager"}},
+		{"employee", "employee_mentor", Relation{"employee_mentor", OneToMany, "employee", []string{"id"}, []string{"mentor_id"}, "employee_mentor"}},
+		// and never by the name of a column, which expanding would overwrite
+		{"employee", "mentor_rel", Relation{"mentor_rel", ManyToOne, "employee", []string{"mentor_id"}, []string{"id"}, "employee_mentor"}},
+	}
+	for _, test := range tests {
+		rel := a.Tables[test.table].Relation(test.name)
+		if rel == nil {
+			t.Errorf("%s.%s - relationship not found", test.table, test.name)
+			continue
+		}
+		if !reflect.DeepEqual(*rel, test.want) {
+			t.Errorf("%s.%s - got %+v, want %+v", test.table, test.name, *rel, test.want)
+		}
+	}
+
+	// keys to tables that weren't loaded are left out
+	if n := len(a.Tables["employee"].Relations); n != 4 {
+		t.Errorf("got %d employee relationships, want 4", n)
+	}
+	if _, err := a.expansions("user", url.Values{"expand": {"settings,nope"}}); err == nil {
+		t.Errorf("expected error for an unknown relationship")
+	}
+}
+
+// names that clash with columns or each other keep getting _rel until
+// they're unique
+func TestRelateNameClashes(t *testing.T) {
+	a := testApid("user", "id")
+	a.Tables["person"] = testApid("person", "id").Tables["person"]
+	a.Tables["doc"] = testApid("doc", "id", "owner_id", "user_id", "reviewer_id", "reviewer", "reviewer_rel").Tables["doc"]
+	a.Tables["doc"].ForeignKeys = []*ForeignKey{
+		{Name: "doc_owner", Cols: []string{"owner_id"}, RefTable: "user", RefCols: []string{"id"}},
+		{Name: "doc_user", Cols: []string{"user_id"}, RefTable: "person", RefCols: []string{"id"}},
+		{Name: "doc_reviewer", Cols: []string{"reviewer_id"}, RefTable: "person", RefCols: []string{"id"}},
+	}
+	relate(a.Tables)
+
+	got := make(map[string]string)
+	for _, rel := range a.Tables["doc"].Relations {
+		if _, ok := got[rel.Name]; ok {
+			t.Errorf("two relationships are named %s", rel.Name)
+		}
+		got[rel.Name] = rel.ForeignKey
+	}
+	want := map[string]string{"user": "doc_owner", "user_rel": "doc_user", "reviewer_rel_rel": "doc_reviewer"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExpandSelectList(t *testing.T) {
+	a := testRelated()
+
+	var tests = []struct {
+		table, query string
+		want         string
+	}{
+		{"settings", "expand=user", ""},
+		{"settings", "expand=user&fields=setting,user.name", "user_id, setting"}, // the key comes back to join on
+		{"settings", "expand=user&exclude=user_id", "id, user_id, setting"},
+	}
+	for _, test := range tests {
+		params, _ := url.ParseQuery(test.query)
+		list, err := a.selectList(test.table, params)
+		if err != nil {
+			t.Errorf("%s - unexpected error %s", test.query, err)
+		}
+		if got := strings.Join(list, ", "); got != test.want {
+			t.Errorf("%s - got (%s), want (%s)", test.query, got, test.want)
+		}
+	}
+
+	// the related side keeps its join columns too
+	params, _ := url.ParseQuery("expand=user&fields=setting,user.name")
+	fields, exclude := projection(params, "user")
+	if got, err := a.selectColumns("user", fields, exclude, []string{"id"}); err != nil || strings.Join(got, ", ") != "id, name" {
+		t.Errorf("got %v %v, want (id, name)", got, err)
+	}
+
+	for _, query := range []string{"fields=user.name", "expand=nope"} {
+		params, _ := url.ParseQuery(query)
+		if got, err := a.selectList("settings", params); err == nil {
+			t.Errorf("%s - expected error, got %v", query, got)
+		}
+	}
+	if got, err := a.selectColumns("user", "password", "", []string{"id"}); err == nil {
+		t.Errorf("expected error for an unknown related field, got %v", got)
+	}
+}
+
+func TestKeyString(t *testing.T) {
+	// signed and unsigned keys still match
+	if keyString([]interface{}{int64(26)}) != keyString([]interface{}{uint64(26)}) {
+		t.Errorf("keys of different integer types should match")
+	}
+}
@@ -0,0 +1,396 @@
+package apid
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"vendored/apid/query"
+)
+
+/***********************
+ *   Stored Routines   *
+ ***********************/
+
+/*
+stored procedures and functions are served at POST /api/v1/rpc/:routine, or
+/api/v1/rpc/:schema/:routine in multi-schema mode, and are called by their
+schema qualified name. the json body holds the IN and INOUT parameters by name. a function's value
+comes back as result. a procedure's result sets come back as result_sets,
+and its OUT and INOUT parameters as out.
+
+OUT and INOUT parameters are passed as session variables (@`dapi_name`), so a
+call runs its statements on a single connection: the transaction's, when
+there is a token, or one held from the pool for the call.
+
+the driver (go-sql-driver/mysql 1.3 and up) asks for multiple results,
+without which mysql refuses to call a procedure that selects (error 1312),
+and each result set is read in turn with NextResultSet.
+*/
+
+// Routine is a stored procedure or function
+type Routine struct {
+	Name   string       `json:"name"`
+	Schema string       `json:"schema,omitempty"`
+	Type   string       `json:"type"`
+	Params []*Parameter `json:"parameters"`
+
+	// Returns is a function's return value, nil for procedures
+	Returns *Parameter `json:"returns,omitempty"`
+}
+
+// Parameter is a routine parameter. Mode is IN, OUT, or INOUT, and empty
+// for a function's return value.
+type Parameter struct {
+	Name       string `json:"name"`
+	Mode       string `json:"mode,omitempty"`
+	DataType   string `json:"type"`
+	ColumnType string `json:"column_type"`
+	Scale      string `json:"-"`
+}
+
+// schema describes the parameter like a column so its value gets the
+// right json type
+func (p *Parameter) schema() *TableSchema {
+	return &TableSchema{
+		COLUMN_NAME:   sql.NullString{String: p.Name, Valid: true},
+		DATA_TYPE:     sql.NullString{String: p.DataType, Valid: true},
+		COLUMN_TYPE:   sql.NullString{String: p.ColumnType, Valid: true},
+		NUMERIC_SCALE: sql.NullString{String: p.Scale, Valid: len(p.Scale) > 0},
+	}
+}
+
+// session is a single connection, so session variables carry between statements
+type session interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// rpcCall is the statements for a call: setting the OUT and INOUT
+// variables, the call itself, and selecting the variables back
+type rpcCall struct {
+	set     string
+	setArgs []interface{}
+	call    string
+	args    []interface{}
+	out     string
+	outCols []*TableSchema
+}
+
+// callQuery builds the statements to call a routine with the body values
+func callQuery(rt *Routine, v map[string]interface{}) (*rpcCall, error) {
+	known := make(map[string]bool)
+	for _, p := range rt.Params {
+		if p.Mode != "OUT" {
+			known[p.Name] = true
+		}
+	}
+	for k := range v {
+		if !known[k] {
+			return nil, errorf(http.StatusBadRequest, "unknown parameter (%s) for %s", k, rt.Name)
+		}
+	}
+
+	c := &rpcCall{}
+	sets := make([]query.Arg, 0)
+	args := make([]query.Arg, 0, len(rt.Params))
+	outs, names := make([]string, 0), make([]string, 0)
+	for _, p := range rt.Params {
+		value, ok := v[p.Name]
+		if !ok && p.Mode != "OUT" {
+			return nil, errorf(http.StatusBadRequest, "missing parameter (%s) for %s", p.Name, rt.Name)
+		}
+		value = jsonArg(value)
+
+		variable := "dapi_" + p.Name
+		switch p.Mode {
+		case "OUT":
+			// cleared so a value from an earlier call on the connection can't leak
+			sets = append(sets, query.Arg{Var: variable})
+		case "INOUT":
+			sets = append(sets, query.Arg{Var: variable, Value: value})
+		default:
+			args = append(args, query.Arg{Value: value})
+			continue
+		}
+		args = append(args, query.Arg{Var: variable})
+		outs, names = append(outs, variable), append(names, p.Name)
+		c.outCols = append(c.outCols, p.schema())
+	}
+
+	var err error
+	if rt.Returns != nil {
+		c.call, c.args, err = dialect.CallFunction(rt.Schema, rt.Name, args, "result")
+		return c, err
+	}
+
+	if c.call, c.args, err = dialect.Call(rt.Schema, rt.Name, args); err != nil {
+		return nil, err
+	}
+	if len(sets) > 0 {
+		if c.set, c.setArgs, err = dialect.SetVars(sets); err != nil {
+			return nil, err
+		}
+	}
+	if len(outs) > 0 {
+		if c.out, _, err = dialect.SelectVars(outs, names); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// jsonArg passes objects and arrays to json parameters and columns as text
+func jsonArg(v interface{}) interface{} {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		j, _ := json.Marshal(v)
+		return string(j)
+	}
+	return v
+}
+
+// session holds a single connection for the request, the transaction's if
+// there is a token
+func (a *Apid) session(r *http.Request) (session, func(), error) {
+	if len(transactionToken(r)) > 0 {
+		db, release, err := a.conn(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db.(session), release, nil
+	}
+
+	c, err := a.DB.Conn(r.Context())
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, func() { c.Close() }, nil
+}
+
+// callRoutine runs the call and builds the response
+func (a *Apid) callRoutine(ctx context.Context, db session, rt *Routine, c *rpcCall) (map[string]interface{}, error) {
+	res := map[string]interface{}{"message": "success"}
+
+	if len(c.set) > 0 {
+		a.log().Print(c.set, " ", c.setArgs)
+		if _, err := db.ExecContext(ctx, c.set, c.setArgs...); err != nil {
+			return nil, err
+		}
+	}
+
+	a.log().Print(c.call, " ", c.args)
+	rows, err := db.QueryContext(ctx, c.call, c.args...)
+	if err != nil {
+		return nil, err
+	}
+	// closed as soon as it's read too, to free the session for the out query
+	defer rows.Close()
+
+	if rt.Returns != nil {
+		found, err := a.scanRows(rows, &Table{Name: rt.Name, Cols: []*TableSchema{rt.Returns.schema()}})
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		res["result"] = nil
+		if len(found) > 0 {
+			res["result"] = found[0]["result"]
+		}
+		return res, nil
+	}
+
+	// result sets have no table to take their types from
+	sets := make([][]map[string]interface{}, 0)
+	for {
+		if cols, _ := rows.Columns(); len(cols) > 0 {
+			found, err := a.scanRows(rows, &Table{Name: rt.Name})
+			if err != nil {
+				return nil, err
+			}
+			sets = append(sets, found)
+		}
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	rows.Close()
+	res["result_sets"] = sets
+
+	out := make(map[string]interface{})
+	if len(c.out) > 0 {
+		rows, err := db.QueryContext(ctx, c.out)
+		if err != nil {
+			return nil, err
+		}
+		found, err := a.scanRows(rows, &Table{Name: rt.Name, Cols: c.outCols})
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(found) > 0 {
+			out = found[0]
+		}
+	}
+	res["out"] = out
+	return res, nil
+}
+
+// routineKey is the Routines key the url params name
+func (a *Apid) routineKey(t httprouter.Params) string {
+	return tableKey(t.ByName("schema"), t.ByName("routine"), a.MultiSchema)
+}
+
+// routinePath is where the routine under key is served, below /api/v1/rpc/
+func (a *Apid) routinePath(key string) string {
+	if rt := a.Routines[key]; a.MultiSchema {
+		return rt.Schema + "/" + rt.Name
+	}
+	return key
+}
+
+// PostRoutine calls a stored procedure or function with the body as its parameters
+func (a *Apid) PostRoutine(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	rt, ok := a.Routines[a.routineKey(t)]
+	if !ok {
+		NotFoundWithParams(w, r, fmt.Sprintf("routine (%s) not found", a.routineKey(t)))
+		return
+	}
+
+	// numbers are passed on exactly as they were sent
+	v := make(map[string]interface{})
+	body, err := a.readBody(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			sendError(w, r, errorf(http.StatusBadRequest, "error decoding json body: %s", err))
+			return
+		}
+	}
+
+	c, err := callQuery(rt, v)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	db, release, err := a.session(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	defer release()
+
+	res, err := a.callRoutine(r.Context(), db, rt, c)
+	if err != nil {
+		sendError(w, r, wrapf(err, "call to %s failed", rt.Name))
+		return
+	}
+
+	j, err := json.Marshal(res)
+	if err != nil {
+		a.log().Print("error making json result ", err)
+	}
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// GetRoutine serves /api/v1/rpc/_meta, and /api/v1/rpc/:schema/_meta for
+// one schema. Routines themselves are only called with POST.
+func (a *Apid) GetRoutine(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	if t.ByName("routine") != "_meta" {
+		if _, ok := a.Routines[a.routineKey(t)]; !ok {
+			NotFoundWithParams(w, r, fmt.Sprintf("routine (%s) not found", a.routineKey(t)))
+			return
+		}
+		MethodNotAllowed(w, r, []string{"POST"})
+		return
+	}
+
+	names := make([]string, 0, len(a.Routines))
+	for name, rt := range a.Routines {
+		if schema := t.ByName("schema"); len(schema) > 0 && rt.Schema != schema {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	base := a.prefix() + "/rpc/"
+	schema := make([]Meta, 0, len(names))
+	for _, name := range names {
+		schema = append(schema, GenRoutineMeta(a.Routines[name], base+a.routinePath(name)))
+	}
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	j, err := json.Marshal(schema)
+	if err != nil {
+		a.log().Print("error making json routine schema ", err)
+	}
+	w.Write(j)
+}
+
+// RoutineMetaHandler displays the meta data for a single routine
+func (a *Apid) RoutineMetaHandler(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	rt, ok := a.Routines[a.routineKey(t)]
+	if !ok {
+		NotFoundWithParams(w, r, fmt.Sprintf("No routine (%s) found for _meta", a.routineKey(t)))
+		return
+	}
+
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	j, err := json.Marshal([]Meta{GenRoutineMeta(rt, r.RequestURI[:len(r.RequestURI)-len("/_meta")])})
+	if err != nil {
+		a.log().Print("error making json routine schema ", err)
+	}
+	w.Write(j)
+}
+
+// GenRoutineMeta describes calling a routine. Properties are the IN and
+// INOUT parameters, and Parameters lists them all.
+func GenRoutineMeta(rt *Routine, location string) Meta {
+	properties := make(map[string]Property)
+	required := make([]string, 0)
+	for _, p := range rt.Params {
+		if p.Mode == "OUT" {
+			continue
+		}
+		properties[p.Name] = Property{DataType: p.DataType, Description: p.Mode + " " + p.ColumnType}
+		required = append(required, p.Name)
+	}
+
+	notes := "Returns result_sets, and out with the OUT and INOUT parameters."
+	if rt.Returns != nil {
+		notes = "Returns result, a " + rt.Returns.ColumnType + "."
+	}
+
+	schema := Meta{}
+	schema.Title = rt.Name
+	schema.Properties = properties
+	schema.Description = "MySQL " + rt.Type[:1] + strings.ToLower(rt.Type[1:]) + " " + rt.Name
+	schema.Location = location
+	schema.Primary = make([]string, 0)
+	schema.Relations = make([]*Relation, 0)
+	schema.Routes = make([]string, 0)
+	schema.Parameters = rt.Params
+	schema.Required = required
+	schema.SchemaType = "object"
+	schema.Method = "POST"
+	schema.Notes = notes
+
+	return schema
+}
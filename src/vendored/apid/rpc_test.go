@@ -0,0 +1,138 @@
+package apid
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// a procedure with every parameter mode, and a function
+func testRoutines() map[string]*Routine {
+	return map[string]*Routine{
+		"rename_user": {Name: "rename_user", Type: "PROCEDURE", Params: []*Parameter{
+			{Name: "id", Mode: "IN", DataType: "int", ColumnType: "int(11)"},
+			{Name: "name", Mode: "INOUT", DataType: "varchar", ColumnType: "varchar(20)"},
+			{Name: "changed", Mode: "OUT", DataType: "tinyint", ColumnType: "tinyint(1)"},
+		}},
+		"add_one": {Name: "add_one", Type: "FUNCTION",
+			Params:  []*Parameter{{Name: "n", Mode: "IN", DataType: "int", ColumnType: "int(11)"}},
+			Returns: &Parameter{Name: "result", DataType: "int", ColumnType: "int(11)"},
+		},
+	}
+}
+
+func TestCallQuery(t *testing.T) {
+	routines := testRoutines()
+
+	c, err := callQuery(routines["rename_user"], map[string]interface{}{"id": 26, "name": "jack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := "set @`dapi_name` = ?, @`dapi_changed` = ?"; c.set != w {
+		t.Errorf("got (%s), want (%s)", c.set, w)
+	}
+	if w := "call `rename_user`(?, @`dapi_name`, @`dapi_changed`)"; c.call != w {
+		t.Errorf("got (%s), want (%s)", c.call, w)
+	}
+	if w := "select @`dapi_name` as `name`, @`dapi_changed` as `changed`"; c.out != w {
+		t.Errorf("got (%s), want (%s)", c.out, w)
+	}
+	if !reflect.DeepEqual(c.setArgs, []interface{}{"jack", nil}) || !reflect.DeepEqual(c.args, []interface{}{26}) {
+		t.Errorf("got args %v and %v", c.setArgs, c.args)
+	}
+
+	c, err = callQuery(routines["add_one"], map[string]interface{}{"n": 41})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := "select `add_one`(?) as `result`"; c.call != w || len(c.set) > 0 || len(c.out) > 0 {
+		t.Errorf("got (%s) (%s) (%s), want (%s)", c.set, c.call, c.out, w)
+	}
+
+	// json parameters take objects as text
+	c, _ = callQuery(routines["add_one"], map[string]interface{}{"n": map[string]interface{}{"a": 1}})
+	if !reflect.DeepEqual(c.args, []interface{}{`{"a":1}`}) {
+		t.Errorf("got args %v", c.args)
+	}
+
+	for _, v := range []map[string]interface{}{
+		{"id": 26},                               // missing
+		{"id": 26, "name": "jack", "nope": 1},    // unknown
+		{"id": 26, "name": "jack", "changed": 1}, // OUT only
+	} {
+		if _, err := callQuery(routines["rename_user"], v); err == nil {
+			t.Errorf("%v - expected error", v)
+		}
+	}
+}
+
+// every result set a procedure selects is read, then its out parameters
+func TestCallRoutineResultSets(t *testing.T) {
+	a := &Apid{}
+	db := stubSetsDB(func(q string, args []driver.Value) []stubResult {
+		if strings.HasPrefix(q, "call ") {
+			return []stubResult{
+				{[]string{"id", "name"}, [][]driver.Value{{int64(26), []byte("jack")}, {int64(27), []byte("jill")}}, nil},
+				{[]string{"total"}, [][]driver.Value{{int64(2)}}, nil},
+				{}, // the call's status
+			}
+		}
+		return []stubResult{{[]string{"name", "changed"}, [][]driver.Value{{[]byte("jill"), int64(1)}}, nil}}
+	})
+
+	rt := testRoutines()["rename_user"]
+	c, err := callQuery(rt, map[string]interface{}{"id": 26, "name": "jack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := a.callRoutine(context.Background(), db, rt, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][]map[string]interface{}{
+		{{"id": int64(26), "name": "jack"}, {"id": int64(27), "name": "jill"}},
+		{{"total": int64(2)}},
+	}
+	if g := res["result_sets"]; !reflect.DeepEqual(g, sets) {
+		t.Errorf("got result sets %v, want %v", g, sets)
+	}
+	if g, w := res["out"], map[string]interface{}{"name": "jill", "changed": true}; !reflect.DeepEqual(g, w) {
+		t.Errorf("got out %v, want %v", g, w)
+	}
+}
+
+func TestRoutineMeta(t *testing.T) {
+	a := &Apid{Tables: map[string]*Table{}, Routines: testRoutines()}
+	router := a.NewRouter()
+
+	var tests = []struct {
+		method, url string
+		code        int
+		contains    string
+	}{
+		{"GET", "/api/v1/rpc/_meta", 200, `"description":"MySQL Function add_one"`},
+		{"GET", "/api/v1/rpc/_meta", 200, `"required":["id","name"]`},
+		{"GET", "/api/v1/rpc/rename_user/_meta", 200, `{"name":"changed","mode":"OUT","type":"tinyint","column_type":"tinyint(1)"}`},
+		{"GET", "/api/v1/rpc/rename_user", 405, "GET not allowed, use POST"},
+		{"GET", "/api/v1/rpc/nope/_meta", 404, "No routine (nope)"},
+		{"POST", "/api/v1/rpc/nope", 404, "routine (nope) not found"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.url, strings.NewReader(`{}`))
+		req.RequestURI = test.url
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+
+		if rw.Code != test.code {
+			t.Errorf("%s %s - got status %d, want %d", test.method, test.url, rw.Code, test.code)
+		}
+		if !strings.Contains(rw.Body.String(), test.contains) {
+			t.Errorf("%s %s - body does not contain (%s)\n\n%s", test.method, test.url, test.contains, rw.Body.String())
+		}
+	}
+}
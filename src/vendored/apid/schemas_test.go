@@ -0,0 +1,135 @@
+package apid
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// a user table in two schemas, one with settings, and a routine in each
+func testSchemas() *Apid {
+	a := &Apid{Tables: map[string]*Table{}, Routines: map[string]*Routine{}, MultiSchema: true}
+	for key, rt := range testRoutines() {
+		rt.Schema = map[string]string{"rename_user": "crm", "add_one": "shop"}[key]
+		a.Routines[rt.Schema+"."+key] = rt
+	}
+	for _, key := range []string{"shop.user", "shop.settings", "crm.user"} {
+		parts := strings.SplitN(key, ".", 2)
+		t := testApid(key, "id", "user_id", "name").Tables[key]
+		t.Schema = parts[0]
+		a.Tables[key] = t
+	}
+	a.Tables["shop.settings"].ForeignKeys = []*ForeignKey{{Name: "settings_user", Cols: []string{"user_id"}, RefTable: "shop.user", RefCols: []string{"id"}}}
+	relate(a.Tables)
+	return a
+}
+
+func TestMultiSchema(t *testing.T) {
+	a := testSchemas()
+
+	// relationships are named without the schema
+	if rel := a.Tables["shop.user"].Relation("settings"); rel == nil || rel.Table != "shop.settings" {
+		t.Errorf("got %+v, want settings on shop.settings", rel)
+	}
+	if got := a.routePaths("shop.user"); len(got) != 1 || got[0] != "/api/v1/crud/shop/user/:id/settings" {
+		t.Errorf("got routes %v", got)
+	}
+
+	router := a.NewRouter()
+	var tests = []struct {
+		method, url string
+		code        int
+		contains    string
+		missing     string
+	}{
+		{"GET", "/api/v1/crud/crm/user/_meta", 200, `"location":"/api/v1/crud/crm/user/"`, "shop"},
+		{"GET", "/api/v1/crud/_meta", 200, `"location":"/api/v1/crud/crm/user"`, ""},
+		{"GET", "/api/v1/crud/_meta", 200, `"location":"/api/v1/crud/shop/settings"`, ""},
+		{"GET", "/api/v1/crud/crm/_meta", 200, "MySQL Table crm.user", "shop"},
+		{"GET", "/api/v1/crud/nope", 404, "resource does not exist", ""},
+		{"GET", "/api/v1/crud/crm/settings/_meta", 404, "No table (crm.settings)", ""},
+		{"POST", "/api/v1/crud/crm/settings", 404, "table (crm.settings) not found", ""},
+		{"GET", "/", 200, "/api/v1/crud/:schema/:table/:id, /api/v1/crud/shop/user/:id/settings", ""},
+		{"GET", "/", 200, "/api/v1/rpc/_meta, /api/v1/rpc/:schema/:routine, /api/v1/rpc/:schema/:routine/_meta", ""},
+		{"GET", "/api/v1/rpc/_meta", 200, `"location":"/api/v1/rpc/crm/rename_user"`, ""},
+		{"GET", "/api/v1/rpc/_meta", 200, `"location":"/api/v1/rpc/shop/add_one"`, ""},
+		{"GET", "/api/v1/rpc/shop/_meta", 200, `"location":"/api/v1/rpc/shop/add_one"`, "crm"},
+		{"GET", "/api/v1/rpc/shop/add_one/_meta", 200, `"location":"/api/v1/rpc/shop/add_one"`, ""},
+		{"GET", "/api/v1/rpc/shop/add_one", 405, "", ""},
+		{"GET", "/api/v1/rpc/nope", 404, "resource does not exist", ""},
+		{"POST", "/api/v1/rpc/shop/rename_user", 404, "routine (shop.rename_user) not found", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.url, strings.NewReader(`{}`))
+		req.RequestURI = test.url
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+
+		if rw.Code != test.code {
+			t.Errorf("%s %s - got status %d, want %d", test.method, test.url, rw.Code, test.code)
+		}
+		body := rw.Body.String()
+		if !strings.Contains(body, test.contains) || (len(test.missing) > 0 && strings.Contains(body, test.missing)) {
+			t.Errorf("%s %s - body should contain (%s) and not (%s)\n\n%s", test.method, test.url, test.contains, test.missing, body)
+		}
+	}
+}
+
+// routines are loaded from every schema, which are called by schema
+func TestSchemaRoutines(t *testing.T) {
+	var gotArgs []driver.Value
+	db := stubDB(func(q string, args []driver.Value) ([]string, [][]driver.Value) {
+		if q == "select database()" {
+			return []string{"database()"}, [][]driver.Value{{"shop"}}
+		}
+		gotArgs = args
+		cols := []string{"ROUTINE_SCHEMA", "ROUTINE_NAME", "ROUTINE_TYPE", "ORDINAL_POSITION", "PARAMETER_MODE", "PARAMETER_NAME", "DATA_TYPE", "DTD_IDENTIFIER", "NUMERIC_SCALE"}
+		return cols, [][]driver.Value{
+			{"crm", "touch", "PROCEDURE", nil, nil, nil, nil, nil, nil},
+			{"shop", "touch", "PROCEDURE", nil, nil, nil, nil, nil, nil},
+		}
+	})
+
+	schemas := []string{"", "crm"}
+	routines, err := getRoutines(db, schemas, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := []string{"", "crm"}; !reflect.DeepEqual(schemas, w) {
+		t.Errorf("schemas changed to %v, want %v", schemas, w)
+	}
+	if w := []driver.Value{"shop", "crm"}; !reflect.DeepEqual(gotArgs, w) {
+		t.Errorf("got schemas %v, want %v", gotArgs, w)
+	}
+	for _, key := range []string{"crm.touch", "shop.touch"} {
+		if rt := routines[key]; rt == nil || rt.Schema+"."+rt.Name != key {
+			t.Errorf("%s - got %+v", key, rt)
+		}
+	}
+
+	c, err := callQuery(testSchemas().Routines["crm.rename_user"], map[string]interface{}{"id": 26, "name": "jack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := "call `crm`.`rename_user`(?, @`dapi_name`, @`dapi_changed`)"; c.call != w {
+		t.Errorf("got (%s), want (%s)", c.call, w)
+	}
+}
+
+func TestDataSourceName(t *testing.T) {
+	d := &DataSourceName{Raw: "root:pw@tcp(localhost:3306)/shop?parseTime=true"}
+	if g, w := d.String(), d.Raw; g != w {
+		t.Errorf("got (%s), want (%s)", g, w)
+	}
+	if g, w := d.DBName, "shop"; g != w {
+		t.Errorf("got db name (%s), want (%s)", g, w)
+	}
+
+	d = &DataSourceName{User: "root", Password: "pw", Host: "localhost", Port: "3306", DBName: "shop"}
+	if g, w := d.String(), "root:pw@tcp(localhost:3306)/shop"; g != w {
+		t.Errorf("got (%s), want (%s)", g, w)
+	}
+}
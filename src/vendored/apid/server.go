@@ -0,0 +1,332 @@
+package apid
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/*************************
+ *   Setup & Lifecycle   *
+ *************************/
+
+/*
+New builds an Apid from a database, loading the tables and routines unless
+they're given, and takes options for everything else. an Apid can still be
+built as a literal and served with NewRouter; New, Start, and Shutdown are
+for embedding it in a service.
+
+Shutdown drains rather than drops: it stops taking new transactions and
+requests that aren't part of an open transaction, waits for the open
+transactions to be committed or rolled back, then lets in-flight requests
+finish. anything still open when the context ends is rolled back. Run does
+all of this on SIGTERM or an interrupt.
+*/
+
+// DefaultPrefix is where the api is served
+const DefaultPrefix = "/api/v1"
+
+// how often Shutdown checks whether the open transactions have finished
+const drainPoll = 50 * time.Millisecond
+
+// logger is where the package logs when there's no Apid to ask, and where
+// an Apid logs without WithLogger
+var logger = log.Default()
+
+// loggerKey is the request context key for the serving Apid's logger
+type loggerKey struct{}
+
+// Option configures an Apid built with New
+type Option func(*Apid)
+
+// customRoute is a route added with WithRoute
+type customRoute struct {
+	method, path string
+	handle       httprouter.Handle
+}
+
+// WithTables serves the given tables rather than loading them
+func WithTables(tables map[string]*Table) Option {
+	return func(a *Apid) { a.Tables = tables }
+}
+
+// WithRoutines serves the given routines rather than loading them
+func WithRoutines(routines map[string]*Routine) Option {
+	return func(a *Apid) { a.Routines = routines }
+}
+
+// WithSchemas loads the tables of several schemas and serves them in
+// multi-schema mode
+func WithSchemas(schemas ...string) Option {
+	return func(a *Apid) {
+		a.schemas = schemas
+		a.MultiSchema = true
+	}
+}
+
+// WithPolicy applies an exposure policy to the tables
+func WithPolicy(p *Policy) Option {
+	return func(a *Apid) { a.policy = p }
+}
+
+// WithPrefix serves the api somewhere other than /api/v1
+func WithPrefix(prefix string) Option {
+	return func(a *Apid) { a.Prefix = prefix }
+}
+
+// WithLogger sends the Apid's logging to l
+func WithLogger(l *log.Logger) Option {
+	return func(a *Apid) { a.logger = l }
+}
+
+// WithMiddleware wraps the api's handler. The first middleware given is
+// the outermost.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) Option {
+	return func(a *Apid) { a.middleware = append(a.middleware, mw...) }
+}
+
+// WithRoute adds an endpoint of your own. It can't overlap the api's routes.
+func WithRoute(method, path string, handle httprouter.Handle) Option {
+	return func(a *Apid) { a.custom = append(a.custom, customRoute{method, path, handle}) }
+}
+
+// WithDecimalsAsNumbers writes decimal columns as json numbers
+func WithDecimalsAsNumbers() Option {
+	return func(a *Apid) { a.DecimalsAsNumbers = true }
+}
+
+// WithTransactions caps the open transactions and sets how long they can
+// sit idle. Zero keeps the default.
+func WithTransactions(max int, timeout time.Duration) Option {
+	return func(a *Apid) {
+		a.MaxTransactions = max
+		a.TransactionTimeout = timeout
+	}
+}
+
+// WithWritableViews lets updatable views take writes
+func WithWritableViews() Option {
+	return func(a *Apid) { a.WritableViews = true }
+}
+
+// WithMaxBodyBytes sets the largest request body taken
+func WithMaxBodyBytes(n int64) Option {
+	return func(a *Apid) { a.MaxBodyBytes = n }
+}
+
+// WithMaxNesting sets how deep nested routes go, negative for none
+func WithMaxNesting(n int) Option {
+	return func(a *Apid) { a.MaxNesting = n }
+}
+
+// WithPeers names this instance and the others that transaction requests
+// can be forwarded to
+func WithPeers(node string, peers map[string]string) Option {
+	return func(a *Apid) {
+		a.NodeName = node
+		a.Peers = peers
+	}
+}
+
+// New builds an Apid for db, loading its tables and routines
+func New(db *sql.DB, opts ...Option) (*Apid, error) {
+	a := &Apid{DB: db}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	schemas := a.schemas
+	if len(schemas) == 0 {
+		schemas = []string{""}
+	}
+	if a.Tables == nil {
+		tables, err := getTables(db, schemas, a.MultiSchema)
+		if err != nil {
+			return nil, err
+		}
+		a.Tables = tables
+	}
+	if a.Routines == nil {
+		routines, err := getRoutines(db, schemas, a.MultiSchema)
+		if err != nil {
+			return nil, err
+		}
+		a.Routines = routines
+	}
+	if a.policy != nil {
+		if err := a.policy.Apply(a.Tables); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// prefix is where the api is served
+func (a *Apid) prefix() string {
+	if len(a.Prefix) == 0 {
+		return DefaultPrefix
+	}
+	return a.Prefix
+}
+
+// Handler is the router wrapped in the middleware, refusing new work
+// while shutting down. Panics in the middleware are recovered too.
+func (a *Apid) Handler() http.Handler {
+	router := a.NewRouter()
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&a.draining) == 1 && !a.inOpenTransaction(r) {
+			w.Header().Set("Connection", "close")
+			sendError(w, r, errorf(http.StatusServiceUnavailable, "server is shutting down"))
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+	for i := len(a.middleware) - 1; i >= 0; i-- {
+		h = a.middleware[i](h)
+	}
+	return a.withLogger(recoverPanics(h))
+}
+
+// inOpenTransaction is true when r names a transaction open on this
+// instance. A made up token is no way past a drain.
+func (a *Apid) inOpenTransaction(r *http.Request) bool {
+	token := transactionToken(r)
+	if len(token) == 0 {
+		return false
+	}
+	_, ok := a.transactions().get(token)
+	return ok
+}
+
+// log is the Apid's logger
+func (a *Apid) log() *log.Logger {
+	if a.logger != nil {
+		return a.logger
+	}
+	return logger
+}
+
+// withLogger puts the Apid's logger on the request for the helpers that
+// only see the request, like sendError
+func (a *Apid) withLogger(next http.Handler) http.Handler {
+	l := a.log()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+	})
+}
+
+// requestLogger is the logger of the Apid serving r
+func requestLogger(r *http.Request) *log.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*log.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// Start listens on addr and serves in the background
+func (a *Apid) Start(addr string) error {
+	a.serverMu.Lock()
+	defer a.serverMu.Unlock()
+	if a.server != nil {
+		return errors.New("already started")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	a.listener = l
+	a.server = &http.Server{Handler: a.Handler()}
+	a.served = make(chan error, 1)
+
+	a.log().Printf("serving on %s", l.Addr())
+	go func(srv *http.Server, served chan error) {
+		err := srv.Serve(l)
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		served <- err
+	}(a.server, a.served)
+	return nil
+}
+
+// Addr is the address Start is listening on, empty before Start
+func (a *Apid) Addr() string {
+	a.serverMu.Lock()
+	defer a.serverMu.Unlock()
+	if a.listener == nil {
+		return ""
+	}
+	return a.listener.Addr().String()
+}
+
+// Shutdown drains the open transactions and in-flight requests, then
+// stops the server. Transactions still open when ctx ends are rolled back.
+func (a *Apid) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&a.draining, 1)
+	reg := a.transactions()
+	reg.close()
+
+	var err error
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+wait:
+	for reg.count() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	a.serverMu.Lock()
+	srv := a.server
+	a.serverMu.Unlock()
+	if srv != nil {
+		if serr := srv.Shutdown(ctx); serr != nil {
+			srv.Close()
+			if err == nil {
+				err = serr
+			}
+		}
+	}
+
+	for _, token := range reg.rollbackAll() {
+		a.log().Printf("rolled back transaction %s at shutdown", token)
+	}
+	return err
+}
+
+// Run serves on addr until SIGTERM or an interrupt, then shuts down,
+// giving open transactions and requests up to grace to finish
+func (a *Apid) Run(addr string, grace time.Duration) error {
+	if err := a.Start(addr); err != nil {
+		return err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	select {
+	case err := <-a.served:
+		return err
+	case sig := <-sigs:
+		a.log().Printf("%s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return a.Shutdown(ctx)
+}
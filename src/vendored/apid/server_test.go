@@ -0,0 +1,218 @@
+package apid
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestNewOptions(t *testing.T) {
+	tables := testApid("user", "id", "name", "password_hash").Tables
+	a, err := New(nil,
+		WithTables(tables),
+		WithRoutines(map[string]*Routine{}),
+		WithPrefix("/v2"),
+		WithPolicy(&Policy{Hidden: []string{"user.password_hash"}}),
+		WithMaxNesting(-1),
+		WithRoute("GET", "/healthz", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			w.Write([]byte("ok"))
+		}),
+		WithMiddleware(
+			func(h http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Add("X-Order", "outer")
+					h.ServeHTTP(w, r)
+				})
+			},
+			func(h http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Add("X-Order", "inner")
+					h.ServeHTTP(w, r)
+				})
+			},
+		),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if a.Tables["user"].Col("password_hash") != nil {
+		t.Errorf("the policy should be applied")
+	}
+
+	h := a.Handler()
+	for _, test := range []struct {
+		url      string
+		code     int
+		contains string
+	}{
+		{"/healthz", http.StatusOK, "ok"},
+		{"/v2/crud/user/_meta", http.StatusOK, `"location":"/v2/crud/user/"`},
+		{"/api/v1/crud/user/_meta", http.StatusNotFound, ""},
+		{"/", http.StatusOK, "/v2/crud/:table"},
+	} {
+		req, _ := http.NewRequest("GET", test.url, nil)
+		req.RequestURI = test.url
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != test.code {
+			t.Errorf("%s - got status %d, want %d", test.url, rw.Code, test.code)
+		}
+		if !strings.Contains(rw.Body.String(), test.contains) {
+			t.Errorf("%s - got body %s, want it to contain %s", test.url, rw.Body.String(), test.contains)
+		}
+		if g, w := strings.Join(rw.Header()["X-Order"], ","), "outer,inner"; g != w {
+			t.Errorf("%s - got middleware order (%s), want (%s)", test.url, g, w)
+		}
+	}
+
+	// a policy that can't be applied fails the build
+	if _, err := New(nil, WithTables(testApid("user", "id").Tables), WithRoutines(map[string]*Routine{}), WithPolicy(&Policy{Hidden: []string{"user.id"}})); err == nil {
+		t.Errorf("expected an error from the policy")
+	}
+}
+
+// each Apid logs to its own logger, error pages included
+func TestWithLogger(t *testing.T) {
+	var logs [2]bytes.Buffer
+	var handlers [2]http.Handler
+	for i := range handlers {
+		a, err := New(nil, WithTables(testApid("user", "id").Tables), WithRoutines(map[string]*Routine{}), WithLogger(log.New(&logs[i], "", 0)))
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		handlers[i] = a.Handler()
+	}
+
+	for i, url := range []string{"/api/v1/crud/user/_meta", "/api/v1/crud/nope/_meta"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.RequestURI = url
+		handlers[i].ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for i, want := range []string{"200 - GET /api/v1/crud/user/_meta", "404 - GET /api/v1/crud/nope/_meta"} {
+		if !strings.Contains(logs[i].String(), want) {
+			t.Errorf("logger %d got (%s), want it to contain (%s)", i, logs[i].String(), want)
+		}
+		if other := logs[1-i].String(); strings.Contains(other, want) {
+			t.Errorf("logger %d got the other Apid's line (%s)", 1-i, want)
+		}
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	started, finish := make(chan bool), make(chan bool)
+	a, err := New(nil,
+		WithTables(testApid("user", "id").Tables),
+		WithRoutines(map[string]*Routine{}),
+		WithRoute("GET", "/slow", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			close(started)
+			<-finish
+			w.Write([]byte("done"))
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	a.DB = stubDB(nil)
+	token, err := a.transactions().open(a.DB, a.nodeName())
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := a.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := a.Start("127.0.0.1:0"); err == nil {
+		t.Errorf("starting twice should be an error")
+	}
+
+	// a request in flight when Shutdown is called gets to finish
+	body := make(chan string)
+	go func() {
+		res, err := http.Get("http://" + a.Addr() + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		body <- string(b)
+	}()
+	<-started
+
+	stopped := make(chan error)
+	go func() { stopped <- a.Shutdown(context.Background()) }()
+
+	// new work is refused while draining
+	time.Sleep(2 * drainPoll)
+	rw := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/api/v1/crud/user", nil))
+	if g, w := rw.Code, http.StatusServiceUnavailable; g != w {
+		t.Errorf("got status %d while draining, want %d", g, w)
+	}
+	if _, err := a.transactions().open(nil, "node"); err == nil {
+		t.Errorf("no transactions should be opened while draining")
+	}
+
+	// only a transaction that's open gets past, and its end lets Shutdown go on
+	for _, test := range []struct {
+		token string
+		code  int
+	}{
+		{a.nodeName() + "::made-up", http.StatusServiceUnavailable},
+		{token, http.StatusOK},
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("DELETE", "/api/v1/transaction", nil)
+		req.Header.Set(TransactionHeader, test.token)
+		a.Handler().ServeHTTP(rw, req)
+		if rw.Code != test.code {
+			t.Errorf("%s - got status %d while draining, want %d", test.token, rw.Code, test.code)
+		}
+	}
+	select {
+	case <-stopped:
+		t.Fatalf("Shutdown returned before the request finished")
+	default:
+	}
+
+	close(finish)
+	if g := <-body; g != "done" {
+		t.Errorf("got body (%s), want the request to finish", g)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started, finish := make(chan bool), make(chan bool)
+	defer close(finish)
+	a, _ := New(nil,
+		WithTables(testApid("user", "id").Tables),
+		WithRoutines(map[string]*Routine{}),
+		WithRoute("GET", "/stuck", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			close(started)
+			<-finish
+		}),
+	)
+	if err := a.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	go http.Get("http://" + a.Addr() + "/stuck")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*drainPoll)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want the deadline to be exceeded", err)
+	}
+}
@@ -0,0 +1,234 @@
+package apid
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*****************
+ *   Streaming   *
+ *****************/
+
+/*
+unpaged GETs (no limit, cursor, or envelope) can return whole tables, so the
+rows are encoded and flushed as they are scanned rather than collected and
+marshalled at the end. Clients that send `Accept: application/x-ndjson`
+get one json object per line instead of an array, paged or not.
+
+cancelling a query only makes the driver drop its connection, and mysql
+carries on running it, so a stream runs on a connection of its own and mysql
+is asked to KILL QUERY it when the client goes away.
+
+once a row is out the status has been sent. an error after that, which
+rows.Err reports once the rows stop, ends ndjson with an {"error": problem}
+line, and drops the connection for a json array so the client can't take
+the cut off array for a whole one.
+*/
+
+// NDJSONType is the content type for newline delimited json
+const NDJSONType = "application/x-ndjson"
+
+// rows are flushed to the client every flushEvery rows
+const flushEvery = 100
+
+// how long to wait on a connection to kill a query from
+const killTimeout = 5 * time.Second
+
+// wantsNDJSON is true if the client accepts newline delimited json
+func wantsNDJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), NDJSONType)
+}
+
+// isPaged is true when the response is bounded or needs every row before
+// it can be written. Expanded rows are loaded in batches, so they are read
+// in full too.
+func isPaged(params url.Values) bool {
+	if _, ok := params["limit"]; ok {
+		return true
+	}
+	if len(params.Get("expand")) > 0 {
+		return true
+	}
+	envelope, _ := strconv.ParseBool(params.Get("envelope"))
+	return envelope || isCursorPaging(params)
+}
+
+// rowWriter writes rows as a json array or as ndjson, flushing as it goes
+type rowWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	ndjson  bool
+	n       int
+}
+
+// newRowWriter sets the content type. Nothing is written until the first row.
+func newRowWriter(w http.ResponseWriter, ndjson bool) *rowWriter {
+	rw := &rowWriter{w: w, ndjson: ndjson}
+	rw.flusher, _ = w.(http.Flusher)
+	if ndjson {
+		w.Header().Set("Content-Type", NDJSONType)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	return rw
+}
+
+// write encodes a single row
+func (rw *rowWriter) write(row map[string]interface{}) error {
+	j, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	var sep string
+	switch {
+	case rw.ndjson:
+		j = append(j, '\n')
+	case rw.n == 0:
+		sep = "["
+	default:
+		sep = ","
+	}
+	if _, err := rw.w.Write([]byte(sep)); err != nil {
+		return err
+	}
+	if _, err := rw.w.Write(j); err != nil {
+		return err
+	}
+
+	rw.n++
+	if rw.n%flushEvery == 0 && rw.flusher != nil {
+		rw.flusher.Flush()
+	}
+	return nil
+}
+
+// fail ends a stream that has started with err
+func (rw *rowWriter) fail(err error) {
+	if !rw.ndjson {
+		panic(http.ErrAbortHandler)
+	}
+	p := problem(err)
+	p.RequestID = rw.w.Header().Get(RequestIDHeader)
+	j, _ := json.Marshal(map[string]*Problem{"error": p})
+	rw.w.Write(append(j, '\n'))
+	if rw.flusher != nil {
+		rw.flusher.Flush()
+	}
+}
+
+// end closes the array
+func (rw *rowWriter) end() {
+	if !rw.ndjson {
+		if rw.n == 0 {
+			rw.w.Write([]byte("["))
+		}
+		rw.w.Write([]byte("]"))
+	}
+	if rw.flusher != nil {
+		rw.flusher.Flush()
+	}
+}
+
+// streamTable runs the query and writes each row as soon as it is scanned
+func (a *Apid) streamTable(w http.ResponseWriter, r *http.Request, db queryer, table *Table, query string, args []interface{}) {
+	// counts have to go out in the headers, ahead of the rows
+	p, err := a.paginate(db, r, table.Name, nil)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	// the query is killed if the client goes away
+	s, stop, err := a.killOnCancel(r.Context(), db)
+	if err != nil {
+		sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+		return
+	}
+	defer stop()
+
+	rows, err := s.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+		return
+	}
+	defer rows.Close()
+
+	p.setHeaders(w)
+	rw := newRowWriter(w, wantsNDJSON(r))
+
+	err = a.eachRow(rows, table, rw.write)
+	if err != nil {
+		if rw.n == 0 {
+			sendError(w, r, wrapf(err, "GET request failed on %s", table.Name))
+			return
+		}
+		a.log().Printf("Error streaming GET on %s (request %q): %s", table.Name, w.Header().Get(RequestIDHeader), err)
+		rw.fail(wrapf(err, "GET request failed on %s after %d rows", table.Name, rw.n))
+		return
+	}
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	rw.end()
+}
+
+// killOnCancel holds a connection for a query, and kills whatever it's
+// running if ctx is done before stop is called. stop gives the connection
+// back. A transaction is already on a connection of its own.
+func (a *Apid) killOnCancel(ctx context.Context, db queryer) (session, func(), error) {
+	s, release := session(nil), func() {}
+	switch db := db.(type) {
+	case *sql.DB:
+		c, err := db.Conn(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		s, release = c, func() { c.Close() }
+	case session:
+		s = db
+	default:
+		return nil, nil, fmt.Errorf("can't hold a connection from %T", db)
+	}
+
+	var id int64
+	rows, err := s.QueryContext(ctx, "select connection_id()")
+	if err == nil {
+		if rows.Next() {
+			err = rows.Scan(&id)
+		} else if err = rows.Err(); err == nil {
+			err = fmt.Errorf("no connection id")
+		}
+		rows.Close()
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-done:
+		case <-ctx.Done():
+			// on another connection, this one is busy with the query. The
+			// pool may have none to spare, so it isn't waited on forever.
+			kill, cancel := context.WithTimeout(context.Background(), killTimeout)
+			defer cancel()
+			if _, err := a.DB.ExecContext(kill, fmt.Sprintf("kill query %d", id)); err != nil {
+				a.log().Printf("error killing query on connection %d: %s", id, err)
+			}
+		}
+	}()
+	return s, func() {
+		close(done)
+		<-stopped
+		release()
+	}, nil
+}
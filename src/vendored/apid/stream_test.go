@@ -0,0 +1,135 @@
+package apid
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRowWriter(t *testing.T) {
+	rows := []map[string]interface{}{{"id": 1}, {"id": 2, "name": nil}}
+
+	var tests = []struct {
+		ndjson      bool
+		rows        []map[string]interface{}
+		contentType string
+		want        string
+	}{
+		{false, rows, "application/json", `[{"id":1},{"id":2,"name":null}]`},
+		{false, nil, "application/json", `[]`},
+		{true, rows, NDJSONType, "{\"id\":1}\n{\"id\":2,\"name\":null}\n"},
+		{true, nil, NDJSONType, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		rw := newRowWriter(w, test.ndjson)
+		for _, row := range test.rows {
+			if err := rw.write(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rw.end()
+
+		if g, want := w.Header().Get("Content-Type"), test.contentType; g != want {
+			t.Errorf("ndjson %v - got content type (%s), want (%s)", test.ndjson, g, want)
+		}
+		if g, want := w.Body.String(), test.want; g != want {
+			t.Errorf("ndjson %v - got body (%s), want (%s)", test.ndjson, g, want)
+		}
+		if !w.Flushed {
+			t.Errorf("ndjson %v - expected rows to be flushed", test.ndjson)
+		}
+	}
+}
+
+// a stream that fails part way can't send an error status
+func TestRowWriterFail(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set(RequestIDHeader, "abc-123")
+	rw := newRowWriter(w, true)
+	rw.write(map[string]interface{}{"id": 1})
+	rw.fail(wrapf(errors.New("connection reset"), "GET request failed on user after 1 rows"))
+
+	want := "{\"id\":1}\n{\"error\":{\"type\":\"about:blank\",\"title\":\"Internal Server Error\",\"status\":500,\"detail\":\"GET request failed on user after 1 rows: internal error\",\"request_id\":\"abc-123\"}}\n"
+	if g := w.Body.String(); g != want {
+		t.Errorf("ndjson - got (%s), want (%s)", g, want)
+	}
+
+	// an array is cut off, and the connection dropped
+	rw = newRowWriter(httptest.NewRecorder(), false)
+	rw.write(map[string]interface{}{"id": 1})
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("json - got panic %v, want http.ErrAbortHandler", rec)
+		}
+	}()
+	rw.fail(errors.New("connection reset"))
+}
+
+// a query that fails after its first row ends the stream with an error
+func TestStreamFailsPartWay(t *testing.T) {
+	a := testApid("user", "id")
+	a.DB = stubSetsDB(func(q string, args []driver.Value) []stubResult {
+		if q == "select connection_id()" {
+			return []stubResult{{[]string{"connection_id()"}, [][]driver.Value{{int64(7)}}, nil}}
+		}
+		return []stubResult{{[]string{"id"}, [][]driver.Value{{int64(1)}}, errors.New("query interrupted")}}
+	})
+
+	req := httptest.NewRequest("GET", "/api/v1/crud/user", nil)
+	req.Header.Set("Accept", NDJSONType)
+	w := httptest.NewRecorder()
+	a.streamTable(w, req, a.DB, a.Tables["user"], "select * from `user`", nil)
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 || lines[0] != `{"id":"1"}` || !strings.HasPrefix(lines[1], `{"error":{`) {
+		t.Errorf("got (%s), want a row then an error line", w.Body.String())
+	}
+}
+
+func TestKillOnCancel(t *testing.T) {
+	killed := make(chan string, 2)
+	a := &Apid{}
+	a.DB = stubExecDB(func(q string, args []driver.Value) ([]string, [][]driver.Value) {
+		if q == "select connection_id()" {
+			return []string{"connection_id()"}, [][]driver.Value{{int64(7)}}
+		}
+		return nil, nil
+	}, func(q string) { killed <- q })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, stop, err := a.killOnCancel(ctx, a.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case q := <-killed:
+		if w := "kill query 7"; q != w {
+			t.Errorf("got (%s), want (%s)", q, w)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the query to be killed")
+	}
+	stop()
+
+	// a query that finished is left alone
+	ctx, cancel = context.WithCancel(context.Background())
+	_, stop, err = a.killOnCancel(ctx, a.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	cancel()
+	select {
+	case q := <-killed:
+		t.Errorf("got (%s) after stopping", q)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,120 @@
+package apid
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+)
+
+// stubDB is a database for tests. query answers every select with its
+// columns and rows, and nil answers with nothing. Everything else succeeds.
+func stubDB(query func(q string, args []driver.Value) ([]string, [][]driver.Value)) *sql.DB {
+	return sql.OpenDB(&stubConnector{query: query})
+}
+
+// stubExecDB is a stubDB that tells exec about every statement it runs
+func stubExecDB(query func(q string, args []driver.Value) ([]string, [][]driver.Value), exec func(q string)) *sql.DB {
+	return sql.OpenDB(&stubConnector{query: query, exec: exec})
+}
+
+// stubSetsDB is a stubDB whose queries answer with any number of result sets
+func stubSetsDB(sets func(q string, args []driver.Value) []stubResult) *sql.DB {
+	return sql.OpenDB(&stubConnector{sets: sets})
+}
+
+// stubResult is one result set. Without columns it's a statement's status.
+// err, if set, fails the rows after the last one, as a query killed part
+// way does.
+type stubResult struct {
+	cols []string
+	rows [][]driver.Value
+	err  error
+}
+
+type stubConnector struct {
+	query func(q string, args []driver.Value) ([]string, [][]driver.Value)
+	sets  func(q string, args []driver.Value) []stubResult
+	exec  func(q string)
+}
+
+func (c *stubConnector) Connect(context.Context) (driver.Conn, error) { return &stubConn{c}, nil }
+func (c *stubConnector) Driver() driver.Driver                        { return stubDriver{} }
+
+type stubDriver struct{}
+
+func (stubDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("open the stub with its connector")
+}
+
+type stubConn struct{ c *stubConnector }
+
+func (c *stubConn) Prepare(q string) (driver.Stmt, error) { return &stubStmt{c.c, q}, nil }
+func (c *stubConn) Close() error                          { return nil }
+func (c *stubConn) Begin() (driver.Tx, error)             { return stubTx{}, nil }
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubStmt struct {
+	c *stubConnector
+	q string
+}
+
+func (s *stubStmt) Close() error  { return nil }
+func (s *stubStmt) NumInput() int { return -1 }
+
+func (s *stubStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.c.exec != nil {
+		s.c.exec(s.q)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *stubStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := &stubRows{}
+	if s.c.query != nil {
+		rows.cols, rows.rows = s.c.query(s.q, args)
+	}
+	if s.c.sets != nil {
+		rows.more = s.c.sets(s.q, args)
+		rows.NextResultSet()
+	}
+	return rows, nil
+}
+
+type stubRows struct {
+	cols []string
+	rows [][]driver.Value
+	err  error
+	more []stubResult
+}
+
+func (r *stubRows) Columns() []string { return r.cols }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		if r.err != nil {
+			return r.err
+		}
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func (r *stubRows) HasNextResultSet() bool { return len(r.more) > 0 }
+
+func (r *stubRows) NextResultSet() error {
+	if len(r.more) == 0 {
+		return io.EOF
+	}
+	r.cols, r.rows, r.err = r.more[0].cols, r.more[0].rows, r.more[0].err
+	r.more = r.more[1:]
+	return nil
+}
@@ -1,7 +1,22 @@
 package apid
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -26,17 +41,606 @@ maybe we can do the same with a header?
 shane's suggestion: send a series of queries in a single request, each performed as
 a transaction. If the whole transaction is good, return success. The client could manage
 putting it all together. Simple.
+
+we ended up doing all three: POST a list of operations for shane's batch,
+or POST nothing to open a transaction whose token is node::uuid. A request
+carrying a token owned by another node is proxied to it if it is in Peers,
+otherwise we answer with the owning node in a header and cookie for the LB.
 */
 
-func GetTransaction(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
-	w.Write([]byte("unimplemented"))
+// Operation is a single step of a transaction. Method is one of insert,
+// update, delete, or select. Values are the same key value pairs the crud
+// endpoints take in their body (or query string, in the case of select).
+type Operation struct {
+	Method string                 `json:"method"`
+	Table  string                 `json:"table"`
+	Values map[string]interface{} `json:"values"`
 }
-func PostTransaction(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
-	w.Write([]byte("unimplemented"))
+
+// TransactionRequest is the body POSTed to /api/v1/transaction
+type TransactionRequest struct {
+	Operations []Operation `json:"operations"`
 }
-func PutTransaction(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
-	w.Write([]byte("unimplemented"))
+
+// GetTransaction lists the open transactions and how old they are
+func (a *Apid) GetTransaction(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	j, err := json.Marshal(a.transactions().list())
+	if err != nil {
+		a.log().Print("error making json transaction list ", err)
+	}
+
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// PostTransaction runs an ordered list of operations in a single sql.Tx.
+// Everything is committed only if every step succeeds, otherwise the whole
+// batch is rolled back and the failed step is reported. Without a body,
+// a transaction is opened and its token returned for use with the crud
+// endpoints. Neither runs inside a transaction a token already names.
+func (a *Apid) PostTransaction(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	if token := transactionToken(r); len(token) > 0 {
+		sendError(w, r, errorf(http.StatusConflict, "can't batch or open a transaction inside transaction (%s); send the operations to the crud endpoints with its token, or POST without it", token))
+		return
+	}
+
+	body, err := a.readBody(r)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		a.openTransaction(w, r)
+		return
+	}
+
+	// UseNumber keeps numbers as they were sent rather than as float64
+	var req TransactionRequest
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		sendError(w, r, errorf(http.StatusBadRequest, "error decoding transaction body: %s", err))
+		return
+	}
+	if len(req.Operations) == 0 {
+		sendError(w, r, errorf(http.StatusBadRequest, "transaction has no operations"))
+		return
+	}
+
+	tx, err := a.DB.Begin()
+	if err != nil {
+		sendError(w, r, wrapf(err, "unable to begin transaction"))
+		return
+	}
+
+	results := make([]map[string]interface{}, 0, len(req.Operations))
+	for i, op := range req.Operations {
+		res, err := a.runOperation(tx, op)
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				a.log().Print("error rolling back transaction ", rbErr)
+			}
+			sendError(w, r, wrapf(err, "transaction rolled back, step %d (%s on %s) failed", i, op.Method, op.Table))
+			return
+		}
+		res["step"] = i
+		results = append(results, res)
+	}
+
+	if err := tx.Commit(); err != nil {
+		sendError(w, r, wrapf(err, "transaction commit failed"))
+		return
+	}
+
+	j, err := json.Marshal(map[string]interface{}{"message": "success", "results": results})
+	if err != nil {
+		a.log().Print("error making json transaction results ", err)
+	}
+
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// openTransaction begins a transaction that lives across requests
+func (a *Apid) openTransaction(w http.ResponseWriter, r *http.Request) {
+	token, err := a.transactions().open(a.DB, a.nodeName())
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(TransactionHeader, token)
+	setAffinity(w, a.nodeName())
+	w.Write([]byte(fmt.Sprintf("{\"message\":\"success\", \"token\":%q}", token)))
+}
+
+// PutTransaction commits the transaction named in the request
+func (a *Apid) PutTransaction(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	a.finishTransaction(w, r, true)
+}
+
+// DeleteTransaction rolls back the transaction named in the request
+func (a *Apid) DeleteTransaction(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
+	a.finishTransaction(w, r, false)
+}
+
+// common functionality for commit and rollback
+func (a *Apid) finishTransaction(w http.ResponseWriter, r *http.Request, commit bool) {
+	token := transactionToken(r)
+	if len(token) == 0 {
+		sendError(w, r, errorf(http.StatusBadRequest, "missing transaction token"))
+		return
+	}
+
+	open, ok := a.transactions().remove(token)
+	if !ok {
+		NotFoundWithParams(w, r, fmt.Sprintf("transaction (%s) not found or expired", token))
+		return
+	}
+
+	// wait for any in flight request on the transaction
+	open.mu.Lock()
+	defer open.mu.Unlock()
+
+	message := "committed"
+	var err error
+	if commit {
+		err = open.tx.Commit()
+	} else {
+		message = "rolled back"
+		err = open.tx.Rollback()
+	}
+	if err != nil {
+		sendError(w, r, wrapf(err, "transaction (%s) failed to finish", token))
+		return
+	}
+
+	a.log().Printf("200 - %s %s", r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(fmt.Sprintf("{\"message\":%q, \"token\":%q}", message, token)))
+}
+
+// runOperation performs a single transaction step and returns its results
+func (a *Apid) runOperation(tx *sql.Tx, op Operation) (map[string]interface{}, error) {
+	table, ok := a.Tables[op.Table]
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "table (%s) not found", op.Table)
+	}
+	if op.Method != "select" && !a.writable(table) {
+		return nil, errorf(http.StatusMethodNotAllowed, "table (%s) is read only", op.Table)
+	}
+	if len(op.Values) == 0 && op.Method != "select" {
+		return nil, errorf(http.StatusBadRequest, "no values given")
+	}
+	res := map[string]interface{}{"method": op.Method, "table": op.Table}
+
+	var q string
+	var args []interface{}
+	var err error
+
+	switch op.Method {
+	case "select":
+		q, args, err = a.selectQuery(table.Name, bodyToParams(op.Values))
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := tx.Query(q, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		found, err := a.scanRows(rows, table)
+		if err != nil {
+			return nil, err
+		}
+		res["rows"] = found
+		return res, nil
+	case "insert":
+		q, args, err = a.insertQuery(table.Name, op.Values)
+	case "update":
+		pKeys := table.PrimaryKeys()
+		if len(pKeys) == 0 {
+			return nil, noPrimaryKey(table.Name)
+		}
+		q, args, err = a.updateQuery(table.Name, pKeys, op.Values, nil)
+	case "delete":
+		q, args, err = a.deleteQuery(table.Name, op.Values, nil)
+	default:
+		return nil, errorf(http.StatusBadRequest, "unknown method %s", op.Method)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	if op.Method == "insert" {
+		res["inserted_id"], err = result.LastInsertId()
+	} else {
+		res["rows_affected"], err = result.RowsAffected()
+	}
+	return res, err
+}
+
+/*************************
+ *   Open Transactions   *
+ *************************/
+
+const (
+	// TransactionHeader carries the token of an open transaction
+	TransactionHeader = "X-Transaction-Token"
+
+	// TransactionNodeHeader and TransactionNodeCookie name the node that
+	// owns a transaction so a load balancer can route on them
+	TransactionNodeHeader = "X-Transaction-Node"
+	TransactionNodeCookie = "dapi_transaction_node"
+
+	// ProxiedHeader is set on requests forwarded to a peer so they are
+	// never forwarded twice
+	ProxiedHeader = "X-Transaction-Proxied-By"
+
+	// tokens are node::uuid
+	tokenSeparator = "::"
+
+	DefaultMaxTransactions    = 100
+	DefaultTransactionTimeout = time.Minute
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// openTx is a transaction that lives across requests
+type openTx struct {
+	tx       *sql.Tx
+	created  time.Time
+	lastUsed time.Time
+	timer    *time.Timer
+
+	// only one request may use the transaction at a time
+	mu sync.Mutex
+}
+
+// TransactionInfo describes an open transaction for GET /api/v1/transaction.
+// The token is all it takes to use a transaction, so only a hash of it is
+// listed.
+type TransactionInfo struct {
+	ID          string  `json:"id"`
+	Node        string  `json:"node"`
+	Created     string  `json:"created"`
+	AgeSeconds  float64 `json:"age_seconds"`
+	IdleSeconds float64 `json:"idle_seconds"`
+}
+
+// txRegistry holds the open transactions keyed by token
+type txRegistry struct {
+	sync.Mutex
+	txs     map[string]*openTx
+	max     int
+	timeout time.Duration
+
+	// closed registries take no new transactions
+	closed bool
+
+	// logger is the Apid's
+	logger *log.Logger
+
+	// pending are slots held for transactions still beginning. Begin can
+	// wait on a free connection, so it runs without the lock, or nothing
+	// could commit or roll back to free one.
+	pending int
 }
-func DeleteTransaction(w http.ResponseWriter, r *http.Request, t httprouter.Params) {
-	w.Write([]byte("unimplemented"))
+
+// transactions lazily sets up the registry so Apid can be built as a literal
+func (a *Apid) transactions() *txRegistry {
+	a.txOnce.Do(func() {
+		a.txs = &txRegistry{
+			txs:     make(map[string]*openTx),
+			max:     a.MaxTransactions,
+			timeout: a.TransactionTimeout,
+			logger:  a.log(),
+		}
+		if a.txs.max <= 0 {
+			a.txs.max = DefaultMaxTransactions
+		}
+		if a.txs.timeout <= 0 {
+			a.txs.timeout = DefaultTransactionTimeout
+		}
+	})
+	return a.txs
+}
+
+// conn returns the transaction named in the request, or the DB if there
+// is none. release must be called when the caller is done with it.
+func (a *Apid) conn(r *http.Request) (queryer, func(), error) {
+	token := transactionToken(r)
+	if len(token) == 0 {
+		return a.DB, func() {}, nil
+	}
+
+	open, ok := a.transactions().get(token)
+	if !ok {
+		return nil, nil, errorf(http.StatusNotFound, "transaction (%s) not found or expired", token)
+	}
+	open.mu.Lock()
+
+	// the reaper may have beat us to the lock
+	if _, ok := a.transactions().get(token); !ok {
+		open.mu.Unlock()
+		return nil, nil, errorf(http.StatusNotFound, "transaction (%s) not found or expired", token)
+	}
+	return open.tx, func() {
+		a.transactions().touch(token)
+		open.mu.Unlock()
+	}, nil
+}
+
+// transactionToken pulls the token from the header. It's never taken from
+// the query string, where it would shadow a filter on a token column.
+func transactionToken(r *http.Request) string {
+	return r.Header.Get(TransactionHeader)
+}
+
+/*****************************
+ *   Cross Instance Routing   *
+ *****************************/
+
+// nodeName is the name this instance puts in its transaction tokens
+func (a *Apid) nodeName() string {
+	if len(a.NodeName) > 0 {
+		return a.NodeName
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		a.log().Print("error getting hostname ", err)
+		return "localhost"
+	}
+	return host
+}
+
+// tokenNode returns the node that owns a transaction token
+func tokenNode(token string) (string, error) {
+	i := strings.LastIndex(token, tokenSeparator)
+	if i <= 0 || i+len(tokenSeparator) == len(token) {
+		return "", errorf(http.StatusBadRequest, "malformed transaction token (%s), expected node%suuid", token, tokenSeparator)
+	}
+	return token[:i], nil
+}
+
+// setAffinity tells the client and load balancer which node owns a transaction
+func setAffinity(w http.ResponseWriter, node string) {
+	w.Header().Set(TransactionNodeHeader, node)
+	http.SetCookie(w, &http.Cookie{Name: TransactionNodeCookie, Value: node, Path: "/"})
+}
+
+// routeTransactions passes requests for our own transactions (or none at
+// all) to next. Requests for a transaction owned by a peer are proxied to
+// it, and anything else is told which node to go to.
+func (a *Apid) routeTransactions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := transactionToken(r)
+		if len(token) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		node, err := tokenNode(token)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+
+		self := a.nodeName()
+		if node == self {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// never bounce a request between peers
+		if by := r.Header.Get(ProxiedHeader); len(by) > 0 {
+			NotFoundWithParams(w, r, fmt.Sprintf("transaction (%s) forwarded by %s does not belong to %s", token, by, self))
+			return
+		}
+
+		peer, ok := a.Peers[node]
+		if !ok {
+			setAffinity(w, node)
+			NotFoundWithParams(w, r, fmt.Sprintf("transaction (%s) belongs to unknown node %s", token, node))
+			return
+		}
+		target, err := url.Parse(peer)
+		if err != nil {
+			sendError(w, r, &Error{Status: http.StatusServiceUnavailable, Detail: fmt.Sprintf("transaction (%s) belongs to unreachable node %s", token, node), Err: err})
+			return
+		}
+
+		a.log().Printf("proxy - %s %s to %s", r.Method, r.RequestURI, node)
+		r.Header.Set(ProxiedHeader, self)
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	})
+}
+
+// open begins a new transaction and registers it under a token owned by node
+func (reg *txRegistry) open(db *sql.DB, node string) (string, error) {
+	reg.Lock()
+	if reg.closed {
+		reg.Unlock()
+		return "", errorf(http.StatusServiceUnavailable, "shutting down, no new transactions")
+	}
+	if len(reg.txs)+reg.pending >= reg.max {
+		reg.Unlock()
+		return "", errorf(http.StatusServiceUnavailable, "too many open transactions (%d)", reg.max)
+	}
+	reg.pending++
+	reg.Unlock()
+
+	id, err := newUUID()
+	var tx *sql.Tx
+	if err == nil {
+		tx, err = db.Begin()
+	}
+
+	reg.Lock()
+	defer reg.Unlock()
+	reg.pending--
+	if err != nil {
+		return "", wrapf(err, "unable to begin transaction")
+	}
+	if reg.closed {
+		tx.Rollback()
+		return "", errorf(http.StatusServiceUnavailable, "shutting down, no new transactions")
+	}
+
+	token := node + tokenSeparator + id
+	now := time.Now()
+	open := &openTx{tx: tx, created: now, lastUsed: now}
+	open.timer = time.AfterFunc(reg.timeout, func() { reg.reap(token) })
+	reg.txs[token] = open
+
+	return token, nil
+}
+
+// get finds an open transaction
+func (reg *txRegistry) get(token string) (*openTx, bool) {
+	reg.Lock()
+	defer reg.Unlock()
+	open, ok := reg.txs[token]
+	return open, ok
+}
+
+// touch marks the transaction as used so it is not reaped while active
+func (reg *txRegistry) touch(token string) {
+	reg.Lock()
+	defer reg.Unlock()
+	if open, ok := reg.txs[token]; ok {
+		open.lastUsed = time.Now()
+	}
+}
+
+// remove unregisters the transaction. The caller must commit or roll it back.
+func (reg *txRegistry) remove(token string) (*openTx, bool) {
+	reg.Lock()
+	defer reg.Unlock()
+	open, ok := reg.txs[token]
+	if ok {
+		open.timer.Stop()
+		delete(reg.txs, token)
+	}
+	return open, ok
+}
+
+// reap rolls back the transaction if it has been idle for the timeout,
+// otherwise it checks back when it could next expire
+func (reg *txRegistry) reap(token string) {
+	reg.Lock()
+	open, ok := reg.txs[token]
+	if !ok {
+		reg.Unlock()
+		return
+	}
+	if idle := time.Since(open.lastUsed); idle < reg.timeout {
+		open.timer.Reset(reg.timeout - idle)
+		reg.Unlock()
+		return
+	}
+	delete(reg.txs, token)
+	reg.Unlock()
+
+	open.mu.Lock()
+	defer open.mu.Unlock()
+	reg.logger.Printf("rolling back idle transaction %s", token)
+	if err := open.tx.Rollback(); err != nil {
+		reg.logger.Print("error rolling back idle transaction ", err)
+	}
+}
+
+// close stops new transactions from being opened
+func (reg *txRegistry) close() {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.closed = true
+}
+
+// count is how many transactions are open
+func (reg *txRegistry) count() int {
+	reg.Lock()
+	defer reg.Unlock()
+	return len(reg.txs)
+}
+
+// rollbackAll rolls back every open transaction, waiting for any request
+// using one to finish, and returns their tokens
+func (reg *txRegistry) rollbackAll() []string {
+	reg.Lock()
+	txs := reg.txs
+	reg.txs = make(map[string]*openTx)
+	reg.Unlock()
+
+	tokens := make([]string, 0, len(txs))
+	for token, open := range txs {
+		open.timer.Stop()
+		open.mu.Lock()
+		if err := open.tx.Rollback(); err != nil {
+			reg.logger.Print("error rolling back transaction ", err)
+		}
+		open.mu.Unlock()
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// list describes the open transactions, oldest first
+func (reg *txRegistry) list() []TransactionInfo {
+	reg.Lock()
+	defer reg.Unlock()
+
+	now := time.Now()
+	infos := make([]TransactionInfo, 0, len(reg.txs))
+	for token, open := range reg.txs {
+		infos = append(infos, TransactionInfo{
+			ID:          tokenID(token),
+			Node:        strings.SplitN(token, tokenSeparator, 2)[0],
+			Created:     open.created.Format(time.RFC3339),
+			AgeSeconds:  now.Sub(open.created).Seconds(),
+			IdleSeconds: now.Sub(open.lastUsed).Seconds(),
+		})
+	}
+	sort.Sort(byAge(infos))
+	return infos
+}
+
+type byAge []TransactionInfo
+
+func (b byAge) Len() int           { return len(b) }
+func (b byAge) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byAge) Less(i, j int) bool { return b[i].AgeSeconds > b[j].AgeSeconds }
+
+// tokenID identifies a transaction without giving away its token
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum[:6])
+}
+
+// newUUID makes a random (version 4) uuid
+func newUUID() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
 }
@@ -0,0 +1,216 @@
+package apid
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spins up several instances on loopback and checks that transaction
+// requests end up at the instance owning the token. No db is needed since
+// none of the tokens are actually open.
+func TestTransactionRouting(t *testing.T) {
+	b := httptest.NewServer((&Apid{NodeName: "node-b"}).NewRouter())
+	defer b.Close()
+
+	a := httptest.NewServer((&Apid{NodeName: "node-a", Peers: map[string]string{"node-b": b.URL}}).NewRouter())
+	defer a.Close()
+
+	var tests = []struct {
+		method          string
+		token           string
+		status          int
+		resBodyContains string
+		node            string
+	}{
+		{"PUT", "node-a::1234", 404, "transaction (node-a::1234) not found or expired", ""},
+		{"PUT", "node-b::1234", 404, "transaction (node-b::1234) not found or expired", ""}, // proxied to b
+		{"DELETE", "node-b::1234", 404, "transaction (node-b::1234) not found or expired", ""},
+		{"PUT", "node-c::1234", 404, "belongs to unknown node node-c", "node-c"},
+		{"PUT", "1234", 400, "malformed transaction token", ""},
+		{"PUT", "node-a::", 400, "malformed transaction token", ""},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, a.URL+"/api/v1/transaction", nil)
+		req.Header.Set(TransactionHeader, test.token)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s - %s", test.method, test.token, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if g, w := res.StatusCode, test.status; g != w {
+			t.Errorf("%s %s - Actual status (%d) not equal expected status (%d)", test.method, test.token, g, w)
+		}
+		if g, w := string(body), test.resBodyContains; !strings.Contains(g, w) {
+			t.Errorf("%s %s - Response Body Error, actual does not contain expected (\"%s\")\n\n%s\n\n", test.method, test.token, w, g)
+		}
+		if g, w := res.Header.Get(TransactionNodeHeader), test.node; g != w {
+			t.Errorf("%s %s - Actual node (%s) not equal expected node (%s)", test.method, test.token, g, w)
+		}
+	}
+
+	// b must refuse to bounce a forwarded request back out
+	req, _ := http.NewRequest("PUT", b.URL+"/api/v1/transaction", nil)
+	req.Header.Set(TransactionHeader, "node-a::1234")
+	req.Header.Set(ProxiedHeader, "node-a")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(body), "does not belong to node-b") {
+		t.Errorf("expected forwarded request to be refused, got %s", body)
+	}
+}
+
+// a token already names a transaction, which a batch or a new transaction
+// would silently run outside of
+func TestPostTransactionWithToken(t *testing.T) {
+	router := (&Apid{NodeName: "node-a"}).NewRouter()
+
+	for _, body := range []string{"", `{"operations":[{"method":"insert","table":"user","values":{"name":"jill"}}]}`} {
+		req, _ := http.NewRequest("POST", "/api/v1/transaction", strings.NewReader(body))
+		req.Header.Set(TransactionHeader, "node-a::1234")
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+
+		if g, w := rw.Code, http.StatusConflict; g != w {
+			t.Errorf("%q - got status %d, want %d: %s", body, g, w, rw.Body.String())
+		}
+		if len(rw.Header().Get(TransactionHeader)) > 0 {
+			t.Errorf("%q - a transaction was opened", body)
+		}
+	}
+}
+
+func TestRegistryCap(t *testing.T) {
+	reg := &txRegistry{txs: make(map[string]*openTx), max: 2, timeout: time.Minute, logger: logger}
+	db := stubDB(nil)
+
+	for i := 0; i < 2; i++ {
+		if _, err := reg.open(db, "node"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := reg.open(db, "node")
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusServiceUnavailable {
+		t.Errorf("got %v, want a 503 over the cap", err)
+	}
+	if got := len(reg.rollbackAll()); got != 2 {
+		t.Errorf("rolled back %d, want 2", got)
+	}
+	if _, err := reg.open(db, "node"); err != nil {
+		t.Errorf("got %v, want room once rolled back", err)
+	}
+}
+
+func TestRegistryReaping(t *testing.T) {
+	reg := &txRegistry{txs: make(map[string]*openTx), max: 2, timeout: time.Minute, logger: logger}
+	db := stubDB(nil)
+
+	idle, _ := reg.open(db, "node")
+	busy, _ := reg.open(db, "node")
+	open, _ := reg.get(idle)
+	reg.Lock()
+	open.lastUsed = time.Now().Add(-2 * time.Minute)
+	reg.Unlock()
+
+	reg.reap(idle)
+	reg.reap(busy)
+	if _, ok := reg.get(idle); ok {
+		t.Error("the idle transaction should have been rolled back")
+	}
+	if _, ok := reg.get(busy); !ok {
+		t.Error("the busy transaction should still be open")
+	}
+
+	// and the timer does it unprompted
+	reg.timeout = 10 * time.Millisecond
+	reg.open(db, "node")
+	for i := 0; reg.count() > 1 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := reg.count(); got != 1 {
+		t.Errorf("got %d open, want only the busy one", got)
+	}
+}
+
+// with every connection in a transaction, a new one waits for a connection
+// without keeping the others from finishing
+func TestRegistryFullPool(t *testing.T) {
+	reg := &txRegistry{txs: make(map[string]*openTx), max: 5, timeout: time.Minute, logger: logger}
+	db := stubDB(nil)
+	db.SetMaxOpenConns(1)
+
+	first, err := reg.open(db, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := make(chan error)
+	go func() {
+		_, err := reg.open(db, "node")
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	finished := make(chan bool)
+	go func() {
+		open, ok := reg.remove(first)
+		if ok {
+			open.tx.Rollback()
+		}
+		finished <- ok
+	}()
+
+	for _, wait := range []string{"rollback", "second open"} {
+		select {
+		case ok := <-finished:
+			if !ok {
+				t.Fatal("the first transaction wasn't registered")
+			}
+		case err := <-second:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("deadlocked waiting for the %s", wait)
+		}
+	}
+	if got := reg.count(); got != 1 {
+		t.Errorf("got %d open, want 1", got)
+	}
+}
+
+// the list is public, so it can't hand out tokens
+func TestRegistryList(t *testing.T) {
+	reg := &txRegistry{txs: make(map[string]*openTx), max: 2, timeout: time.Minute, logger: logger}
+	token, err := reg.open(stubDB(nil), "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos := reg.list()
+	if len(infos) != 1 {
+		t.Fatalf("got %d transactions, want 1", len(infos))
+	}
+	if g, w := infos[0].ID, tokenID(token); g != w || len(g) != 12 {
+		t.Errorf("got id (%s), want (%s)", g, w)
+	}
+	if g, w := infos[0].Node, "node-a"; g != w {
+		t.Errorf("got node (%s), want (%s)", g, w)
+	}
+	j, _ := json.Marshal(infos)
+	if id := strings.SplitN(token, tokenSeparator, 2)[1]; strings.Contains(string(j), id) {
+		t.Errorf("got %s, the token should not be listed", j)
+	}
+}
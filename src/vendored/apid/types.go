@@ -0,0 +1,202 @@
+package apid
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**********************************
+ *   Column Types to JSON Types   *
+ **********************************/
+
+/*
+the driver hands us int64, float64, []byte, time.Time, or nil depending on
+the column and whether the query was prepared. jsonValue uses the column's
+DATA_TYPE, COLUMN_TYPE, and NUMERIC_SCALE to turn that into a faithful json
+value:
+    NULL                          null
+    tinyint(1), bit(1)            true / false
+    integers, year, bit(n)        number
+    float, double                 number
+    decimal                       exact string, or number with DecimalsAsNumbers
+    date                          "2006-01-02"
+    datetime, timestamp           RFC 3339, assumed UTC
+    json                          embedded json
+    binary, blob                  base64 string
+    everything else               string
+*/
+
+// mysql formats for the text protocol
+const (
+	mysqlDate     = "2006-01-02"
+	mysqlDateTime = "2006-01-02 15:04:05.999999999"
+)
+
+// jsonValue converts a scanned value to its json representation. col may be
+// nil for columns that aren't on the table (count(*) and the like).
+func jsonValue(col *TableSchema, v interface{}, decimalsAsNumbers bool) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if col == nil {
+		if b, ok := v.([]byte); ok {
+			return string(b), nil
+		}
+		return v, nil
+	}
+
+	dataType := strings.ToLower(col.DATA_TYPE.String)
+	columnType := strings.ToLower(col.COLUMN_TYPE.String)
+
+	switch dataType {
+	case "tinyint", "bit":
+		if strings.HasPrefix(columnType, dataType+"(1)") {
+			n, err := toInt(v, dataType == "bit")
+			if err != nil {
+				return nil, err
+			}
+			return n != 0, nil
+		}
+		if dataType == "bit" {
+			return toInt(v, true)
+		}
+		return toInteger(v, columnType)
+	case "smallint", "mediumint", "int", "integer", "bigint", "year":
+		return toInteger(v, columnType)
+	case "float", "double", "real":
+		switch v := v.(type) {
+		case float64:
+			return v, nil
+		case int64:
+			return float64(v), nil
+		}
+		f, err := strconv.ParseFloat(toString(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s value for %s", dataType, col.COLUMN_NAME.String)
+		}
+		return f, nil
+	case "decimal", "numeric":
+		s := toString(v)
+		if f, ok := v.(float64); ok {
+			scale, _ := strconv.Atoi(col.NUMERIC_SCALE.String)
+			s = strconv.FormatFloat(f, 'f', scale, 64)
+		}
+		if decimalsAsNumbers {
+			return json.Number(s), nil
+		}
+		return s, nil
+	case "date", "datetime", "timestamp":
+		return toTime(v, dataType)
+	case "json":
+		b := []byte(toString(v))
+		if !json.Valid(b) {
+			return string(b), nil
+		}
+		return json.RawMessage(b), nil
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		// encoding/json base64 encodes []byte
+		if b, ok := v.([]byte); ok {
+			return b, nil
+		}
+		return []byte(toString(v)), nil
+	default:
+		return toString(v), nil
+	}
+}
+
+// toString is the text form of a scanned value
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(mysqlDateTime)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// toInteger parses integer columns, keeping unsigned bigints that overflow int64
+func toInteger(v interface{}, columnType string) (interface{}, error) {
+	if n, ok := v.(int64); ok {
+		return n, nil
+	}
+	s := toString(v)
+	if strings.Contains(columnType, "unsigned") {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad integer value (%s)", s)
+		}
+		return n, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad integer value (%s)", s)
+	}
+	return n, nil
+}
+
+// toInt reads an integer. bit columns arrive as big endian bytes.
+func toInt(v interface{}, bits bool) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		if bits {
+			var n int64
+			for _, b := range v {
+				n = n<<8 | int64(b)
+			}
+			return n, nil
+		}
+	}
+	s := toString(v)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad integer value (%s)", s)
+	}
+	return n, nil
+}
+
+// mysqlTime is an RFC 3339 time as the UTC datetime mysql takes, to the
+// microsecond, since mysql refuses the offset. Anything else is left as is.
+func mysqlTime(s string) string {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return s
+	}
+	return t.UTC().Format("2006-01-02 15:04:05.999999")
+}
+
+// toTime formats dates as YYYY-MM-DD and datetimes as RFC 3339. Zero dates are null.
+func toTime(v interface{}, dataType string) (interface{}, error) {
+	t, ok := v.(time.Time)
+	if !ok {
+		s := toString(v)
+		if strings.HasPrefix(s, "0000-00-00") {
+			return nil, nil
+		}
+		var err error
+		if dataType == "date" {
+			t, err = time.Parse(mysqlDate, s)
+		} else {
+			t, err = time.Parse(mysqlDateTime, s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad %s value (%s)", dataType, s)
+		}
+	}
+	if t.IsZero() {
+		return nil, nil
+	}
+
+	if dataType == "date" {
+		return t.Format(mysqlDate), nil
+	}
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
@@ -0,0 +1,131 @@
+package apid
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// makes a column of the given mysql type
+func testCol(dataType, columnType, scale string) *TableSchema {
+	return &TableSchema{
+		COLUMN_NAME:   sql.NullString{String: "col", Valid: true},
+		DATA_TYPE:     sql.NullString{String: dataType, Valid: true},
+		COLUMN_TYPE:   sql.NullString{String: columnType, Valid: true},
+		NUMERIC_SCALE: sql.NullString{String: scale, Valid: len(scale) > 0},
+	}
+}
+
+// checks the json each scanned value turns into. Values are given both as
+// the text protocol ([]byte) and, where it differs, the binary protocol.
+func TestJSONValue(t *testing.T) {
+	loc := time.FixedZone("MDT", -6*60*60)
+
+	var tests = []struct {
+		col      *TableSchema
+		in       interface{}
+		decimals bool
+		want     string
+	}{
+		// nulls stay null no matter the type
+		{testCol("varchar", "varchar(20)", ""), nil, false, `null`},
+		{testCol("int", "int(11)", ""), nil, false, `null`},
+		{testCol("datetime", "datetime", ""), nil, false, `null`},
+
+		// booleans
+		{testCol("tinyint", "tinyint(1)", "0"), []byte("1"), false, `true`},
+		{testCol("tinyint", "tinyint(1)", "0"), []byte("0"), false, `false`},
+		{testCol("tinyint", "tinyint(1)", "0"), int64(1), false, `true`},
+		{testCol("tinyint", "tinyint(1) unsigned", "0"), int64(0), false, `false`},
+		{testCol("bit", "bit(1)", ""), []byte{1}, false, `true`},
+		{testCol("bit", "bit(1)", ""), []byte{0}, false, `false`},
+
+		// integers
+		{testCol("tinyint", "tinyint(4)", "0"), []byte("-12"), false, `-12`},
+		{testCol("smallint", "smallint(6)", "0"), int64(300), false, `300`},
+		{testCol("mediumint", "mediumint(9)", "0"), []byte("70000"), false, `70000`},
+		{testCol("int", "int(11)", "0"), []byte("26"), false, `26`},
+		{testCol("int", "int(11)", "0"), int64(26), false, `26`},
+		{testCol("bigint", "bigint(20)", "0"), []byte("-9223372036854775808"), false, `-9223372036854775808`},
+		{testCol("bigint", "bigint(20) unsigned", "0"), []byte("18446744073709551615"), false, `18446744073709551615`},
+		{testCol("year", "year(4)", ""), []byte("2014"), false, `2014`},
+		{testCol("bit", "bit(16)", ""), []byte{1, 2}, false, `258`},
+
+		// floats
+		{testCol("float", "float", ""), []byte("1.5"), false, `1.5`},
+		{testCol("double", "double", ""), float64(-0.25), false, `-0.25`},
+		{testCol("double", "double", ""), []byte("1e+100"), false, `1e+100`},
+
+		// decimals keep every digit
+		{testCol("decimal", "decimal(20,4)", "4"), []byte("1234567890123456.7890"), false, `"1234567890123456.7890"`},
+		{testCol("decimal", "decimal(20,4)", "4"), []byte("1234567890123456.7890"), true, `1234567890123456.7890`},
+		{testCol("decimal", "decimal(5,2)", "2"), float64(1.5), false, `"1.50"`},
+		{testCol("decimal", "decimal(5,0)", "0"), []byte("-3"), true, `-3`},
+
+		// dates and times
+		{testCol("date", "date", ""), []byte("2014-06-14"), false, `"2014-06-14"`},
+		{testCol("date", "date", ""), time.Date(2014, 6, 14, 0, 0, 0, 0, loc), false, `"2014-06-14"`},
+		{testCol("datetime", "datetime", ""), []byte("2014-06-14 23:01:41"), false, `"2014-06-14T23:01:41Z"`},
+		{testCol("datetime", "datetime(6)", ""), []byte("2014-06-14 23:01:41.123456"), false, `"2014-06-14T23:01:41.123456Z"`},
+		{testCol("timestamp", "timestamp", ""), time.Date(2014, 6, 14, 17, 1, 41, 0, loc), false, `"2014-06-14T23:01:41Z"`},
+		{testCol("datetime", "datetime", ""), []byte("0000-00-00 00:00:00"), false, `null`},
+		{testCol("date", "date", ""), []byte("0000-00-00"), false, `null`},
+		{testCol("time", "time", ""), []byte("-838:59:59"), false, `"-838:59:59"`},
+
+		// json columns are embedded
+		{testCol("json", "json", ""), []byte(`{"a":[1,2]}`), false, `{"a":[1,2]}`},
+		{testCol("json", "json", ""), []byte(`not json`), false, `"not json"`},
+
+		// binary is base64
+		{testCol("blob", "blob", ""), []byte{0, 255}, false, `"AP8="`},
+		{testCol("varbinary", "varbinary(16)", ""), []byte("hi"), false, `"aGk="`},
+
+		// strings
+		{testCol("varchar", "varchar(20)", ""), []byte("jack"), false, `"jack"`},
+		{testCol("text", "text", ""), []byte(""), false, `""`},
+		{testCol("enum", "enum('a','b')", ""), []byte("b"), false, `"b"`},
+		{testCol("set", "set('a','b')", ""), []byte("a,b"), false, `"a,b"`},
+		{testCol("char", "char(2)", ""), []byte("42"), false, `"42"`},
+
+		// columns that aren't on the table pass through
+		{nil, []byte("x"), false, `"x"`},
+		{nil, int64(3), false, `3`},
+	}
+
+	for _, test := range tests {
+		name := "<nil>"
+		if test.col != nil {
+			name = test.col.COLUMN_TYPE.String
+		}
+
+		v, err := jsonValue(test.col, test.in, test.decimals)
+		if err != nil {
+			t.Errorf("%s %v - unexpected error %s", name, test.in, err)
+			continue
+		}
+		j, err := json.Marshal(v)
+		if err != nil {
+			t.Errorf("%s %v - unable to marshal %s", name, test.in, err)
+			continue
+		}
+		if g, w := string(j), test.want; g != w {
+			t.Errorf("%s %v - got %s, want %s", name, test.in, g, w)
+		}
+	}
+
+	// garbage from the db is an error rather than a silent string
+	for _, test := range []struct {
+		col *TableSchema
+		in  interface{}
+	}{
+		{testCol("int", "int(11)", "0"), []byte("abc")},
+		{testCol("bigint", "bigint(20) unsigned", "0"), []byte("-1")},
+		{testCol("double", "double", ""), []byte("abc")},
+		{testCol("datetime", "datetime", ""), []byte("yesterday")},
+	} {
+		if v, err := jsonValue(test.col, test.in, false); err == nil {
+			t.Errorf("%s %s - expected error, got %v", test.col.COLUMN_TYPE.String, test.in, v)
+		}
+	}
+}
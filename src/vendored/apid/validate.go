@@ -0,0 +1,443 @@
+package apid
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"vendored/apid/query"
+)
+
+/******************
+ *   Validation   *
+ ******************/
+
+/*
+writes are checked against the table's columns before any sql runs, rather
+than leaving the database to complain about the first problem it finds.
+each column's rule comes from its TableSchema:
+    NOT NULL, no default           required on insert, never null
+    CHARACTER_MAXIMUM_LENGTH       the longest string, in characters
+    integer COLUMN_TYPEs           the range of the type, signed or unsigned
+    decimal(p,s)                   at most p-s digits before the point
+    enum(...), set(...)            the members
+    date                           YYYY-MM-DD
+    datetime, timestamp            RFC 3339 or YYYY-MM-DD hh:mm:ss
+numbers may be sent as strings, as decimals are returned. json columns
+take anything, and are sent objects and arrays as text. types apid doesn't
+know take anything but objects and arrays, which the driver can't send.
+RFC 3339 datetimes are sent in UTC without the offset mysql refuses.
+
+every broken rule is reported in one 422, with an errors member listing the
+column and problem of each. the rules are also each column's json schema in
+_meta, so what _meta publishes is what gets checked.
+*/
+
+// FieldError is a value a column won't take
+type FieldError struct {
+	Column string `json:"column"`
+	Detail string `json:"detail"`
+}
+
+// rule is what a column accepts
+type rule struct {
+	// types are the json types taken, all of them when empty
+	types    []string
+	nullable bool
+
+	// required columns have to be given on insert
+	required bool
+
+	// maxLength is in characters, zero for no limit
+	maxLength int
+
+	// min and max bound numbers, written with scale decimal places
+	min, max *big.Rat
+	scale    int
+
+	// members of an enum, or of a set when set is true
+	members []string
+	set     bool
+
+	// format is the json schema format of dates
+	format string
+
+	// json columns take objects and arrays
+	json bool
+}
+
+// integer column sizes in bits
+var intBits = map[string]uint{"tinyint": 8, "smallint": 16, "mediumint": 24, "int": 32, "integer": 32, "bigint": 64}
+
+// columnRule makes the rule for a column
+func columnRule(c *TableSchema) *rule {
+	dataType := strings.ToLower(c.DATA_TYPE.String)
+	columnType := strings.ToLower(c.COLUMN_TYPE.String)
+	extra := strings.ToLower(c.EXTRA.String)
+	generated := strings.Contains(extra, "auto_increment") || strings.Contains(extra, "generated")
+	unsigned := strings.Contains(columnType, "unsigned")
+
+	r := &rule{
+		nullable: c.IS_NULLABLE.String != "NO" || strings.Contains(extra, "auto_increment"),
+		required: c.IS_NULLABLE.String == "NO" && !c.COLUMN_DEFAULT.Valid && !generated,
+	}
+
+	switch dataType {
+	case "tinyint", "bit":
+		if strings.HasPrefix(columnType, dataType+"(1)") {
+			r.types = []string{"boolean", "integer"}
+		} else {
+			r.types = []string{"integer"}
+		}
+		if dataType == "bit" {
+			n := 1
+			if open := strings.Index(columnType, "("); open >= 0 {
+				n, _ = strconv.Atoi(strings.TrimSuffix(columnType[open+1:], ")"))
+			}
+			r.min, r.max = intRange(uint(n), true)
+		} else {
+			r.min, r.max = intRange(intBits[dataType], unsigned)
+		}
+	case "smallint", "mediumint", "int", "integer", "bigint":
+		r.types = []string{"integer"}
+		r.min, r.max = intRange(intBits[dataType], unsigned)
+	case "year":
+		r.types = []string{"integer"}
+		r.min, r.max = big.NewRat(1901, 1), big.NewRat(2155, 1)
+	case "float", "double", "real":
+		r.types = []string{"number"}
+		if unsigned {
+			r.min = new(big.Rat)
+		}
+	case "decimal", "numeric":
+		// decimals are returned as strings, so they're taken as strings too
+		r.types = []string{"number", "string"}
+		precision, _ := strconv.Atoi(c.NUMERIC_PRECISION.String)
+		r.scale, _ = strconv.Atoi(c.NUMERIC_SCALE.String)
+		if precision > 0 {
+			// 10^(p-s) - 10^-s, 999.99 for decimal(5,2)
+			whole := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(precision)), nil)
+			r.max = new(big.Rat).SetFrac(new(big.Int).Sub(whole, big.NewInt(1)), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(r.scale)), nil))
+			r.min = new(big.Rat).Neg(r.max)
+			if unsigned {
+				r.min = new(big.Rat)
+			}
+		}
+	case "char", "varchar", "tinytext", "text", "mediumtext", "longtext":
+		r.types = []string{"string"}
+		r.maxLength, _ = strconv.Atoi(c.CHARACTER_MAXIMUM_LENGTH.String)
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob", "time":
+		r.types = []string{"string"}
+	case "enum", "set":
+		r.types = []string{"string"}
+		r.members = typeMembers(c.COLUMN_TYPE.String)
+		r.set = dataType == "set"
+	case "date":
+		r.types = []string{"string"}
+		r.format = "date"
+	case "datetime", "timestamp":
+		r.types = []string{"string"}
+		r.format = "date-time"
+	case "json":
+		r.json = true
+	}
+	return r
+}
+
+// intRange is the smallest and largest integer of a size
+func intRange(bits uint, unsigned bool) (*big.Rat, *big.Rat) {
+	n := new(big.Int).Lsh(big.NewInt(1), bits)
+	if unsigned {
+		return new(big.Rat), new(big.Rat).SetInt(n.Sub(n, big.NewInt(1)))
+	}
+	half := new(big.Int).Rsh(n, 1)
+	return new(big.Rat).SetInt(new(big.Int).Neg(half)), new(big.Rat).SetInt(half.Sub(half, big.NewInt(1)))
+}
+
+// typeMembers are the quoted members of an enum('a','b') or set('a','b')
+// COLUMN_TYPE, where a doubled quote is a quote
+func typeMembers(columnType string) []string {
+	members := make([]string, 0)
+	open := strings.Index(columnType, "(")
+	if open < 0 {
+		return members
+	}
+	s := strings.TrimSuffix(columnType[open+1:], ")")
+	for len(s) > 0 {
+		if s[0] != '\'' {
+			s = s[1:]
+			continue
+		}
+		var member strings.Builder
+		i := 1
+		for ; i < len(s); i++ {
+			if s[i] == '\'' {
+				if i+1 < len(s) && s[i+1] == '\'' {
+					member.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			member.WriteByte(s[i])
+		}
+		members = append(members, member.String())
+		if i < len(s) {
+			i++
+		}
+		s = s[i:]
+	}
+	return members
+}
+
+// takes is true when the rule takes the json type
+func (r *rule) takes(jsonType string) bool {
+	for _, t := range r.types {
+		if t == jsonType {
+			return true
+		}
+	}
+	return false
+}
+
+// check is what's wrong with v, empty when nothing is
+func (r *rule) check(v interface{}) string {
+	if v == nil {
+		if r.nullable {
+			return ""
+		}
+		return "can't be null"
+	}
+	if len(r.types) == 0 {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			if !r.json {
+				return "can't be an object or array"
+			}
+		}
+		return ""
+	}
+
+	switch v := v.(type) {
+	case bool:
+		if r.takes("boolean") {
+			return ""
+		}
+	case float64:
+		// bodies decode to json.Number, so this is a value made in go.
+		// its shortest decimal form is checked, not its binary fraction
+		n, _ := new(big.Rat).SetString(strconv.FormatFloat(v, 'g', -1, 64))
+		return r.checkNumber(n)
+	case json.Number:
+		if n, ok := new(big.Rat).SetString(string(v)); ok {
+			return r.checkNumber(n)
+		}
+	case string:
+		// mysql takes numbers as strings too
+		if r.takes("integer") || r.takes("number") {
+			n, ok := new(big.Rat).SetString(strings.TrimSpace(v))
+			switch {
+			case ok:
+				return r.checkNumber(n)
+			case r.takes("number"):
+				return "must be a number"
+			}
+			return "must be an integer"
+		}
+		if r.takes("string") {
+			return r.checkString(v)
+		}
+	}
+	return "must be " + r.typeNames()
+}
+
+// checkNumber checks the type and range of a number
+func (r *rule) checkNumber(n *big.Rat) string {
+	switch {
+	case !r.takes("integer") && !r.takes("number"):
+		return "must be " + r.typeNames()
+	case !r.takes("number") && !n.IsInt():
+		return "must be an integer"
+	case r.min != nil && n.Cmp(r.min) < 0:
+		return "must be at least " + r.min.FloatString(r.scale)
+	case r.max != nil && n.Cmp(r.max) > 0:
+		return "must be at most " + r.max.FloatString(r.scale)
+	}
+	return ""
+}
+
+// checkString checks the length, members, and format of a string
+func (r *rule) checkString(s string) string {
+	if r.maxLength > 0 && utf8.RuneCountInString(s) > r.maxLength {
+		return fmt.Sprintf("must be at most %d characters", r.maxLength)
+	}
+	if len(r.members) > 0 {
+		given := []string{s}
+		if r.set {
+			given = strings.Split(s, ",")
+			if len(s) == 0 {
+				given = nil
+			}
+		}
+		for _, g := range given {
+			if !stringIn(g, r.members) {
+				return "must be " + r.memberNames()
+			}
+		}
+	}
+	switch r.format {
+	case "date":
+		if _, err := time.Parse(mysqlDate, s); err != nil {
+			return "must be a date, YYYY-MM-DD"
+		}
+	case "date-time":
+		_, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			_, err = time.Parse(mysqlDateTime, s)
+		}
+		if err != nil {
+			return "must be a date and time, RFC 3339 or YYYY-MM-DD hh:mm:ss"
+		}
+	}
+	return ""
+}
+
+// typeNames says what types are taken, for errors
+func (r *rule) typeNames() string {
+	names := make([]string, len(r.types))
+	for i, t := range r.types {
+		names[i] = map[string]string{"boolean": "a boolean", "integer": "an integer", "number": "a number", "string": "a string"}[t]
+	}
+	return strings.Join(names, " or ")
+}
+
+// memberNames says what members are taken, for errors
+func (r *rule) memberNames() string {
+	if r.set {
+		return "a comma separated list of " + strings.Join(r.members, ", ")
+	}
+	return "one of " + strings.Join(r.members, ", ")
+}
+
+func stringIn(s string, list []string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// schema is the rule as the json schema of a column. Sets, which json schema
+// can't list, get a pattern.
+func (r *rule) schema(p *Property) {
+	var types []interface{}
+	for _, t := range r.types {
+		types = append(types, t)
+	}
+	if len(types) > 0 && r.nullable {
+		types = append(types, "null")
+	}
+	if len(types) == 1 {
+		p.DataType = types[0]
+	} else if len(types) > 1 {
+		p.DataType = types
+	}
+
+	p.MaxLength = r.maxLength
+	p.Format = r.format
+	if r.min != nil {
+		p.Minimum = json.Number(r.min.FloatString(r.scale))
+	}
+	if r.max != nil {
+		p.Maximum = json.Number(r.max.FloatString(r.scale))
+	}
+	if len(r.members) > 0 && !r.set {
+		for _, m := range r.members {
+			p.Enum = append(p.Enum, m)
+		}
+		if r.nullable {
+			p.Enum = append(p.Enum, nil)
+		}
+	}
+	if r.set {
+		quoted := make([]string, len(r.members))
+		for i, m := range r.members {
+			quoted[i] = regexp.QuoteMeta(m)
+		}
+		member := "(" + strings.Join(quoted, "|") + ")"
+		p.Pattern = "^(" + member + "(," + member + ")*)?$"
+	}
+}
+
+// bind turns a value the column takes into one the driver can send
+func (r *rule) bind(v interface{}) interface{} {
+	if r.json {
+		return jsonArg(v)
+	}
+	if s, ok := v.(string); ok && r.format == "date-time" {
+		return mysqlTime(s)
+	}
+	return v
+}
+
+// bindValues readies the values to be written to a table for the driver.
+// Values a column won't take are left for validate to report.
+func (a *Apid) bindValues(table string, v map[string]interface{}) {
+	t, ok := a.Tables[table]
+	if !ok {
+		return
+	}
+	for _, c := range t.Cols {
+		name := c.COLUMN_NAME.String
+		if val, ok := v[name]; ok {
+			v[name] = columnRule(c).bind(val)
+		}
+	}
+}
+
+// validate checks the values to be written to a table. An insert has to
+// give every required column, and so does a write setting one back to its
+// default, since it has none.
+func (a *Apid) validate(table string, v map[string]interface{}, insert bool) error {
+	t, ok := a.Tables[table]
+	if !ok {
+		return nil
+	}
+	var fields []FieldError
+	for _, c := range t.Cols {
+		name := c.COLUMN_NAME.String
+		r := columnRule(c)
+
+		val, ok := v[name]
+		if (!ok && insert) || val == query.Default {
+			if r.required {
+				fields = append(fields, FieldError{Column: name, Detail: "is required"})
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if detail := r.check(val); len(detail) > 0 {
+			fields = append(fields, FieldError{Column: name, Detail: detail})
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	e := errorf(http.StatusUnprocessableEntity, "%d invalid field(s) on %s", len(fields), table)
+	e.Table, e.Fields = table, fields
+	if len(fields) == 1 {
+		e.Column = fields[0].Column
+		e.Detail = fmt.Sprintf("%s on %s %s", fields[0].Column, table, fields[0].Detail)
+	}
+	return e
+}
@@ -0,0 +1,229 @@
+package apid
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"vendored/apid/query"
+)
+
+// makes a column for validating, NOT NULL when notNull
+func ruleCol(name, dataType, columnType string, notNull bool) *TableSchema {
+	c := testCol(dataType, columnType, "")
+	c.COLUMN_NAME = sql.NullString{String: name, Valid: true}
+	c.IS_NULLABLE = sql.NullString{String: "YES", Valid: true}
+	if notNull {
+		c.IS_NULLABLE.String = "NO"
+	}
+	return c
+}
+
+// a product table with a column of most kinds
+func validateApid() *Apid {
+	id := ruleCol("id", "int", "int(10) unsigned", true)
+	id.COLUMN_KEY = sql.NullString{String: "PRI", Valid: true}
+	id.EXTRA = sql.NullString{String: "auto_increment", Valid: true}
+	name := ruleCol("name", "varchar", "varchar(5)", true)
+	name.CHARACTER_MAXIMUM_LENGTH = sql.NullString{String: "5", Valid: true}
+	stock := ruleCol("stock", "smallint", "smallint(6)", true)
+	stock.COLUMN_DEFAULT = sql.NullString{String: "0", Valid: true}
+	price := ruleCol("price", "decimal", "decimal(5,2)", false)
+	price.NUMERIC_PRECISION = sql.NullString{String: "5", Valid: true}
+	price.NUMERIC_SCALE = sql.NullString{String: "2", Valid: true}
+
+	t := &Table{Name: "product", Cols: []*TableSchema{
+		id, name, stock, price,
+		ruleCol("size", "enum", "enum('s','m','it''s big')", false),
+		ruleCol("tags", "set", "set('new','sale')", false),
+		ruleCol("active", "tinyint", "tinyint(1)", false),
+		ruleCol("added", "date", "date", false),
+		ruleCol("seen", "datetime", "datetime", false),
+		ruleCol("extra", "json", "json", false),
+		ruleCol("views", "bigint", "bigint(20) unsigned", false),
+		ruleCol("spot", "point", "point", false),
+	}}
+	return &Apid{Tables: map[string]*Table{"product": t}}
+}
+
+func TestRuleCheck(t *testing.T) {
+	a := validateApid()
+	var tests = []struct {
+		col    string
+		value  interface{}
+		detail string
+	}{
+		{"id", nil, ""},
+		{"id", float64(4294967295), ""},
+		{"id", json.Number("4294967296"), "must be at most 4294967295"},
+		{"id", "-1", "must be at least 0"},
+		{"id", 1.5, "must be an integer"},
+		{"id", "one", "must be an integer"},
+		{"name", "jack", ""},
+		{"name", "jäckie", "must be at most 5 characters"},
+		{"name", nil, "can't be null"},
+		{"name", 5.0, "must be a string"},
+		{"stock", json.Number("-32768"), ""},
+		{"stock", json.Number("32768"), "must be at most 32767"},
+		{"price", "999.99", ""},
+		{"price", -999.99, ""},
+		{"price", "1000", "must be at most 999.99"},
+		{"price", "cheap", "must be a number"},
+		{"size", "it's big", ""},
+		{"size", "xl", "must be one of s, m, it's big"},
+		{"tags", "", ""},
+		{"tags", "new,sale", ""},
+		{"tags", "new,old", "must be a comma separated list of new, sale"},
+		{"active", true, ""},
+		{"active", json.Number("128"), "must be at most 127"},
+		{"active", "yes", "must be an integer"},
+		{"added", "2014-06-14", ""},
+		{"added", "06/14/2014", "must be a date, YYYY-MM-DD"},
+		{"seen", "2014-06-14T23:01:41Z", ""},
+		{"seen", "2014-06-14 23:01:41", ""},
+		{"seen", "yesterday", "must be a date and time, RFC 3339 or YYYY-MM-DD hh:mm:ss"},
+		{"extra", map[string]interface{}{"a": 1}, ""},
+		{"extra", []interface{}{1, "a"}, ""},
+		{"name", map[string]interface{}{"a": 1}, "must be a string"},
+		{"spot", "POINT(1 2)", ""},
+		{"spot", []interface{}{1, 2}, "can't be an object or array"},
+		{"views", json.Number("18446744073709551615"), ""},
+		{"views", json.Number("18446744073709551616"), "must be at most 18446744073709551615"},
+	}
+	for _, test := range tests {
+		if got := columnRule(a.Tables["product"].Col(test.col)).check(test.value); got != test.detail {
+			t.Errorf("%s %v - got (%s), want (%s)", test.col, test.value, got, test.detail)
+		}
+	}
+}
+
+// every bad field is reported at once
+func TestValidate(t *testing.T) {
+	a := validateApid()
+
+	err := a.validate("product", map[string]interface{}{"stock": 1e6, "size": "xl", "price": "1"}, true)
+	e, ok := err.(*Error)
+	if !ok || e.Status != http.StatusUnprocessableEntity {
+		t.Fatalf("got %v, want a 422", err)
+	}
+	want := []FieldError{
+		{Column: "name", Detail: "is required"},
+		{Column: "stock", Detail: "must be at most 32767"},
+		{Column: "size", Detail: "must be one of s, m, it's big"},
+	}
+	if !reflect.DeepEqual(e.Fields, want) {
+		t.Errorf("got %v, want %v", e.Fields, want)
+	}
+
+	// updates only check what they set, unless it's going back to a default
+	if err := a.validate("product", map[string]interface{}{"price": "2.50"}, false); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+	if err := a.validate("product", map[string]interface{}{"name": query.Default}, false); err == nil {
+		t.Error("expected an error setting a column without a default to its default")
+	}
+}
+
+// numbers too big for a float64 get to the query as they were sent
+func TestBigNumbers(t *testing.T) {
+	a := validateApid()
+	req, _ := http.NewRequest("POST", "/api/v1/crud/product", strings.NewReader(`{"name":"jack","views":18446744073709551615}`))
+	v, err := a.readJSONBody(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, args, err := a.insertQuery("product", v)
+	if err != nil {
+		t.Fatalf("got %v, want the largest unsigned bigint taken", err)
+	}
+	if w := []interface{}{"jack", json.Number("18446744073709551615")}; !reflect.DeepEqual(args, w) {
+		t.Errorf("got args %v, want %v", args, w)
+	}
+}
+
+// objects and arrays go to json columns as text, and datetimes go without
+// an offset, as the driver and mysql take them
+func TestBindValues(t *testing.T) {
+	a := validateApid()
+	for _, test := range []struct {
+		values map[string]interface{}
+		args   []interface{}
+	}{
+		{map[string]interface{}{"name": "jack", "extra": map[string]interface{}{"a": []interface{}{1, 2}}}, []interface{}{`{"a":[1,2]}`, "jack"}},
+		{map[string]interface{}{"name": "jack", "seen": "2014-06-14T23:01:41.5+02:00"}, []interface{}{"jack", "2014-06-14 21:01:41.5"}},
+		{map[string]interface{}{"name": "jack", "seen": "2014-06-14T23:01:41Z"}, []interface{}{"jack", "2014-06-14 23:01:41"}},
+		{map[string]interface{}{"name": "jack", "seen": "2014-06-14 23:01:41"}, []interface{}{"jack", "2014-06-14 23:01:41"}},
+	} {
+		_, args, err := a.insertQuery("product", test.values)
+		if err != nil {
+			t.Errorf("%v - unexpected error %s", test.values, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%v - got args %v, want %v", test.values, args, test.args)
+		}
+	}
+}
+
+func TestValidatedWrites(t *testing.T) {
+	router := validateApid().NewRouter()
+
+	for _, test := range []struct {
+		method, url, body string
+		columns           []string
+	}{
+		{"POST", "/api/v1/crud/product", `{"price":"1000","size":"xl"}`, []string{"name", "price", "size"}},
+		{"PUT", "/api/v1/crud/product", `{"id":1,"name":null}`, []string{"name"}},
+		{"PATCH", "/api/v1/crud/product/1", `{"active":2.5}`, []string{"active"}},
+		{"PUT", "/api/v1/crud/product/1", `{"price":1}`, []string{"name"}},
+		{"POST", "/api/v1/crud/product", `{"name":"jack","spot":{"x":1}}`, []string{"spot"}},
+	} {
+		req, _ := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+
+		if g, w := rw.Code, http.StatusUnprocessableEntity; g != w {
+			t.Errorf("%s %s %s - got status %d, want %d: %s", test.method, test.url, test.body, g, w, rw.Body.String())
+			continue
+		}
+		var p Problem
+		if err := json.Unmarshal(rw.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		var columns []string
+		for _, f := range p.Errors {
+			columns = append(columns, f.Column)
+		}
+		if !reflect.DeepEqual(columns, test.columns) {
+			t.Errorf("%s %s %s - got errors on %v, want %v", test.method, test.url, test.body, columns, test.columns)
+		}
+	}
+}
+
+// _meta publishes the rules writes are checked with
+func TestMetaRules(t *testing.T) {
+	m := GenMeta(validateApid().Tables["product"], "/api/v1/crud/product/", "POST")
+
+	if w := []string{"name"}; !reflect.DeepEqual(m.Required, w) {
+		t.Errorf("got required %v, want %v", m.Required, w)
+	}
+	for col, want := range map[string]string{
+		"id":     `{"description":"","type":["integer","null"],"column_type":"int(10) unsigned","minimum":0,"maximum":4294967295}`,
+		"name":   `{"description":"","type":"string","column_type":"varchar(5)","maxLength":5}`,
+		"price":  `{"description":"","type":["number","string","null"],"column_type":"decimal(5,2)","minimum":-999.99,"maximum":999.99}`,
+		"size":   `{"description":"","type":["string","null"],"column_type":"enum('s','m','it''s big')","enum":["s","m","it's big",null]}`,
+		"tags":   `{"description":"","type":["string","null"],"column_type":"set('new','sale')","pattern":"^((new|sale)(,(new|sale))*)?$"}`,
+		"added":  `{"description":"","type":["string","null"],"column_type":"date","format":"date"}`,
+		"extra":  `{"description":"","type":"json","column_type":"json"}`,
+		"active": `{"description":"","type":["boolean","integer","null"],"column_type":"tinyint(1)","minimum":-128,"maximum":127}`,
+	} {
+		j, _ := json.Marshal(m.Properties[col])
+		if string(j) != want {
+			t.Errorf("%s - got %s, want %s", col, j, want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package apid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// writes to a view are refused before the db is touched
+func TestReadOnlyViews(t *testing.T) {
+	a := testApid("report", "id", "total")
+	a.Tables["report"].View = true
+	a.Tables["report"].ReadOnly = true
+	router := a.NewRouter()
+
+	for _, test := range []struct{ method, url string }{
+		{"POST", "/api/v1/crud/report"},
+		{"PUT", "/api/v1/crud/report"},
+		{"DELETE", "/api/v1/crud/report"},
+		{"PUT", "/api/v1/crud/report/1"},
+		{"PATCH", "/api/v1/crud/report/1"},
+		{"DELETE", "/api/v1/crud/report/1"},
+	} {
+		req, _ := http.NewRequest(test.method, test.url, strings.NewReader(`{"total":1}`))
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+
+		if g, w := rw.Code, http.StatusMethodNotAllowed; g != w {
+			t.Errorf("%s %s - got status %d, want %d", test.method, test.url, g, w)
+		}
+		if g, w := rw.Header().Get("Allow"), "GET"; g != w {
+			t.Errorf("%s %s - got Allow (%s), want (%s)", test.method, test.url, g, w)
+		}
+	}
+
+	// only GET is described
+	req, _ := http.NewRequest("GET", "/api/v1/crud/report/_meta", nil)
+	req.RequestURI = "/api/v1/crud/report/_meta"
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	if body := rw.Body.String(); !strings.Contains(body, "MySQL View report") || strings.Contains(body, `"method":"POST"`) {
+		t.Errorf("_meta should only describe GET on the view, got %s", body)
+	}
+
+	// updatable views can be opted in to writes
+	if a.writable(a.Tables["report"]) {
+		t.Errorf("views should be read only by default")
+	}
+	a.WritableViews = true
+	if a.writable(a.Tables["report"]) {
+		t.Errorf("views that aren't updatable should stay read only")
+	}
+	a.Tables["report"].Updatable = true
+	if !a.writable(a.Tables["report"]) || len(a.methods(a.Tables["report"])) != 4 {
+		t.Errorf("updatable views should take writes with WritableViews")
+	}
+}